@@ -0,0 +1,386 @@
+package siteengines
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+	. "github.com/xyproto/genericsite"
+	"github.com/xyproto/pinterface"
+	. "github.com/xyproto/webhandle"
+)
+
+// This part lets users change their own password, email address and display name,
+// and delete their own account
+
+const (
+	// How long the link for confirming a new email address works
+	emailChangeDuration = 24 * time.Hour
+	// The longest display name, in letters
+	maxDisplayNameLength = 50
+)
+
+// A change to an account, for the account history
+type AccountChange struct {
+	When time.Time
+	IP   string
+	What string // ie. "password changed"
+}
+
+// Record a change to an account, for the account history
+func RecordAccountChange(state pinterface.IUserState, username, ip, what string) error {
+	changes, err := state.Creator().NewList("accountChanges:" + username)
+	if err != nil {
+		return err
+	}
+	return changes.Add(time.Now().UTC().Format(time.RFC3339) + " " + ip + " " + what)
+}
+
+// The last n changes to an account, oldest first
+func AccountHistory(state pinterface.IUserState, username string, n int) ([]AccountChange, error) {
+	changes, err := state.Creator().NewList("accountChanges:" + username)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := changes.LastN(n)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]AccountChange, 0, len(entries))
+	for _, entry := range entries {
+		fields := strings.SplitN(entry, " ", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		when, err := time.Parse(time.RFC3339, fields[0])
+		if err != nil {
+			continue
+		}
+		records = append(records, AccountChange{when, fields[1], fields[2]})
+	}
+	return records, nil
+}
+
+// The name that is shown for a user. This is the username, unless a display name has been set.
+func DisplayName(state pinterface.IUserState, username string) string {
+	if name, err := state.Users().Get(username, "displayname"); err == nil && name != "" {
+		return name
+	}
+	return username
+}
+
+// Check that a display name is not too long, and has no markup or control characters
+func validDisplayName(name string) bool {
+	if utf8.RuneCountInString(name) > maxDisplayNameLength || strings.ContainsAny(name, "<>&\"'") {
+		return false
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// Check that an email address looks valid, the same way as when registering
+func validEmail(email string) bool {
+	return strings.Contains(email, "@") && strings.Contains(email, ".") && !strings.Contains(email, " ") && email == CleanUserInput(email)
+}
+
+// Tell the owner of an account, at the given address, that something has been changed
+func (ue *UserEngine) sendAccountChangedEmail(site, username, email, change, ip string) {
+	err := sendTemplateEmail(ue.mailer, "accountChanged", &EmailData{
+		Site:     site,
+		Username: username,
+		Email:    email,
+		Link:     "https://" + site + "/forgot-password",
+		IP:       ip,
+		Change:   change,
+	})
+	if err != nil {
+		log.Println("Could not send the account changed email to " + username + ": " + err.Error())
+	}
+}
+
+// Record a change, and tell the owner at the address the account had before the change
+func (ue *UserEngine) accountChanged(site, username, oldEmail, change, ip string) {
+	RecordAccountChange(ue.state, username, ip, change)
+	ue.sendAccountChangedEmail(site, username, oldEmail, change, ip)
+}
+
+// Send a link for confirming a new email address, to the new address
+func (ue *UserEngine) sendEmailChangeEmail(site, username, email, token string) error {
+	return sendTemplateEmail(ue.mailer, "emailChange", &EmailData{
+		Site:      site,
+		Username:  username,
+		Email:     email,
+		Link:      "https://" + site + "/account/email/" + token,
+		NotMeLink: "https://" + site + "/not-requested",
+	})
+}
+
+// Check the current password of a user that changes the account. Wrong passwords count
+// as failed logins, so that a stolen session can't be used for guessing the password.
+// Returns an empty string if the password is correct, or else a message for the user.
+func (ue *UserEngine) checkCurrentPassword(site string, req *http.Request, username string) string {
+	ip := ClientIP(req)
+	if wait, ok := ue.throttle.Wait(ip, username); ok {
+		return "Too many wrong passwords. Try again in " + formatWait(wait) + "."
+	}
+	if !ue.state.CorrectPassword(username, req.FormValue("password")) {
+		if ue.loginFailed(site, ip, username) {
+			return "Wrong password. The account has been locked for a while, because of too many wrong passwords."
+		}
+		return "Wrong password."
+	}
+	return ""
+}
+
+// The account settings page
+func (ue *UserEngine) GenerateAccountPage() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		username := LoggedInUsername(ue.state, req)
+		if username == "" {
+			return "<div class=\"no\">Not logged in</div>"
+		}
+		email, _ := ue.state.Email(username)
+		s := "<p>Logged in as " + username + ", with the email address " + CleanUserInput(email) + ".</p>"
+		if pending, err := ue.pendingEmails.Get(username); err == nil {
+			s += "<p>A link for confirming " + CleanUserInput(pending) + " has been sent to that address.</p>"
+		}
+
+		s += "<h3>Display name</h3>"
+		s += "<form method=\"POST\" action=\"/account/displayname\">"
+		s += "Display name: <input name=\"displayname\" value=\"" + DisplayName(ue.state, username) + "\"> "
+		s += "<input type=\"submit\" value=\"Save\">"
+		s += "</form>"
+
+		s += "<h3>Password</h3>"
+		s += "<form method=\"POST\" action=\"/account/password\">"
+		s += "Current password: <input type=\"password\" name=\"password\"><br />"
+		s += "New password: <input type=\"password\" name=\"password1\"><br />"
+		s += "Confirm new password: <input type=\"password\" name=\"password2\"><br />"
+		s += "<input type=\"submit\" value=\"Change password\">"
+		s += "</form>"
+
+		s += "<h3>Email address</h3>"
+		s += "<form method=\"POST\" action=\"/account/email\">"
+		s += "Current password: <input type=\"password\" name=\"password\"><br />"
+		s += "New email address: <input name=\"email\"><br />"
+		s += "<input type=\"submit\" value=\"Change email address\">"
+		s += "</form>"
+
+		s += "<h3>Security</h3>"
+		s += "<p><a href=\"/2fa\">Two-factor authentication</a> <a href=\"/sessions\">Sessions</a></p>"
+
+		if changes, err := AccountHistory(ue.state, username, 10); err == nil && len(changes) > 0 {
+			s += "<h3>Recent changes</h3>"
+			s += "<table>"
+			s += "<tr><th>When</th><th>IP address</th><th>Change</th></tr>"
+			for rownr := range changes {
+				// Newest first
+				change := changes[len(changes)-1-rownr]
+				if rownr%2 == 0 {
+					s += "<tr class=\"even\">"
+				} else {
+					s += "<tr class=\"odd\">"
+				}
+				s += "<td>" + change.When.Local().Format("2006-01-02 15:04") + "</td>"
+				s += "<td>" + CleanUserInput(change.IP) + "</td>"
+				s += "<td>" + CleanUserInput(change.What) + "</td>"
+				s += "</tr>"
+			}
+			s += "</table>"
+		}
+
+		s += ue.apiTokensHTML(username)
+
+		s += "<h3>Personal data</h3>"
+		s += "<p><a href=\"/account/export\">Download everything that is stored about " + username + "</a>, as JSON files in a ZIP archive.</p>"
+
+		s += "<h3>Delete account</h3>"
+		s += "<p>Everything that is stored about " + username + " is deleted. This can not be undone.</p>"
+		s += "<form method=\"POST\" action=\"/account/delete\">"
+		s += "Current password: <input type=\"password\" name=\"password\"><br />"
+		s += "<input type=\"checkbox\" name=\"sure\" value=\"yes\"> I want to delete " + username + "<br />"
+		s += "<input type=\"submit\" value=\"Delete account\">"
+		s += "</form>"
+		return s
+	}
+}
+
+func (ue *UserEngine) GenerateChangeDisplayName(site string) StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		username := LoggedInUsername(ue.state, req)
+		if username == "" {
+			return MessageOKback("Account", "Not logged in")
+		}
+		name := strings.TrimSpace(req.FormValue("displayname"))
+		if !validDisplayName(name) {
+			return MessageOKback("Account", "The display name can be at most 50 letters, without markup or quotes.")
+		}
+		if name == DisplayName(ue.state, username) {
+			return MessageOKurl("Account", "The display name is unchanged.", "/account")
+		}
+		if name == "" || name == username {
+			ue.state.Users().DelKey(username, "displayname")
+		} else {
+			ue.state.Users().Set(username, "displayname", name)
+		}
+		email, _ := ue.state.Email(username)
+		ue.accountChanged(site, username, email, "display name changed to "+DisplayName(ue.state, username), ClientIP(req))
+		return MessageOKurl("Account", "OK, the display name is now "+DisplayName(ue.state, username)+".", "/account")
+	}
+}
+
+func (ue *UserEngine) GenerateChangePassword(site string) StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		username := LoggedInUsername(ue.state, req)
+		if username == "" {
+			return MessageOKback("Account", "Not logged in")
+		}
+		if msg := ue.checkCurrentPassword(site, req, username); msg != "" {
+			return MessageOKback("Account", msg)
+		}
+		password1 := req.FormValue("password1")
+		if password1 == "" {
+			return MessageOKback("Account", "Can't use a blank password.")
+		}
+		if password1 != req.FormValue("password2") {
+			return MessageOKback("Account", "The password and confirmation password must be equal.")
+		}
+		if err := ValidUsernamePassword(username, password1); err != nil {
+			return MessageOKback("Account", err.Error())
+		}
+		ue.state.SetPassword(username, password1)
+		// Log out the other sessions and revoke the API tokens, in case someone else knew the old password
+		ue.apiTokens.RevokeAll(username)
+		current := ue.currentSession(req)
+		if sessions, err := ue.sessions.ForUser(username); err == nil {
+			for _, session := range sessions {
+				if current == nil || session.ID != current.ID {
+					ue.sessions.Revoke(session.ID)
+				}
+			}
+		}
+		email, _ := ue.state.Email(username)
+		ue.accountChanged(site, username, email, "password changed", ClientIP(req))
+		return MessageOKurl("Account", "OK, the password has been changed. Other sessions have been logged out, and the API tokens have been revoked.", "/account")
+	}
+}
+
+// Send a confirmation link to the new email address. The address is changed when the link is followed.
+func (ue *UserEngine) GenerateChangeEmail(site string) StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		username := LoggedInUsername(ue.state, req)
+		if username == "" {
+			return MessageOKback("Account", "Not logged in")
+		}
+		if msg := ue.checkCurrentPassword(site, req, username); msg != "" {
+			return MessageOKback("Account", msg)
+		}
+		email := strings.TrimSpace(req.FormValue("email"))
+		if !validEmail(email) {
+			return MessageOKback("Account", "Please use a valid email address.")
+		}
+		if oldEmail, err := ue.state.Email(username); err == nil && strings.EqualFold(oldEmail, email) {
+			return MessageOKback("Account", "That is the current email address.")
+		}
+		if !ue.limits.allow("emailChange:"+username, email) {
+			return MessageOKback("Account", "A confirmation link has already been sent to "+email+" today.")
+		}
+		token, err := ue.emailChanges.Issue(username)
+		if err == nil {
+			err = ue.pendingEmails.Set(username, email)
+		}
+		if err == nil {
+			err = ue.sendEmailChangeEmail(site, username, email, token)
+		}
+		if err != nil {
+			ue.limits.forget("emailChange:"+username, email)
+			return MessageOKback("Account", "Could not send the e-mail to "+email+", please try again later.")
+		}
+		return MessageOKurl("Account", "A link for confirming the new email address has been sent to "+email+".", "/account")
+	}
+}
+
+// Change the email address, when the link that was sent to the new address is followed
+func (ue *UserEngine) GenerateConfirmEmailChange(site string) StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		username, err := ue.emailChanges.Use(mux.Vars(req)["token"])
+		if err != nil {
+			return MessageOKurl("Account", err.Error(), "/account")
+		}
+		email, err := ue.pendingEmails.Get(username)
+		if err != nil || !ue.state.HasUser(username) {
+			return MessageOKurl("Account", invalidTokenErr.Error(), "/account")
+		}
+		ue.pendingEmails.Del(username)
+		oldEmail, _ := ue.state.Email(username)
+		ue.state.Users().Set(username, "email", email)
+		ue.accountChanged(site, username, oldEmail, "email address changed to "+email, ClientIP(req))
+		return MessageOKurl("Account", "OK, the email address for "+username+" is now "+email+".", "/account")
+	}
+}
+
+func (ue *UserEngine) GenerateDeleteAccount(site string) StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		username := LoggedInUsername(ue.state, req)
+		if username == "" {
+			return MessageOKback("Account", "Not logged in")
+		}
+		if msg := ue.checkCurrentPassword(site, req, username); msg != "" {
+			return MessageOKback("Account", msg)
+		}
+		if req.FormValue("sure") != "yes" {
+			return MessageOKback("Account", "Please check the box, to be sure.")
+		}
+		email, _ := ue.state.Email(username)
+		ip := ClientIP(req)
+		ue.sendAccountChangedEmail(site, username, email, "account deleted", ip)
+		// The history is erased along with the account, so the deletion is recorded in the log
+		log.Println("Account deleted: " + username + ", from " + ip)
+		if err := EraseUser(ue.personalDataEngines(), username); err != nil {
+			return MessageOKback("Account", "Could not delete everything about "+username+": "+err.Error())
+		}
+		ue.state.ClearCookie(w)
+		return MessageOKurl("Account", "The account "+username+" has been deleted. Goodbye!", "/")
+	}
+}
+
+// Download everything that is stored about the current user
+func (ue *UserEngine) GenerateExportAccount() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		username := LoggedInUsername(ue.state, req)
+		if username == "" {
+			return MessageOKback("Account", "Not logged in")
+		}
+		// Everything about the user is only for the browser, or for tokens that can do everything anyway
+		if t := requestAPIToken(req); t != nil && !t.HasScope("admin") {
+			return MessageOKback("Account", "The API token does not allow exporting the account.")
+		}
+		return servePersonalDataZip(w, ue.personalDataEngines(), username)
+	}
+}
+
+func (ue *UserEngine) ServeAccountSettingsPages(r *mux.Router, basecp BaseCP, menuEntries MenuEntries, site string) {
+	accountCP := basecp(ue.state)
+	accountCP.ContentTitle = "Account"
+
+	tvgf := DynamicMenuFactoryGenerator(menuEntries)
+	tvg := tvgf(ue.state)
+
+	r.HandleFunc("/account", accountCP.WrapSimpleContextHandle(r, ue.GenerateAccountPage(), tvg)).Methods("GET")
+	r.Handle("/account/displayname", ue.GenerateChangeDisplayName(site)).Methods("POST")
+	r.Handle("/account/password", ue.GenerateChangePassword(site)).Methods("POST")
+	r.Handle("/account/email", ue.GenerateChangeEmail(site)).Methods("POST")
+	r.Handle("/account/email/{token}", ue.GenerateConfirmEmailChange(site)).Methods("GET")
+	r.Handle("/account/delete", ue.GenerateDeleteAccount(site)).Methods("POST")
+	r.Handle("/account/export", ue.GenerateExportAccount()).Methods("GET")
+	r.Handle("/account/tokens", ue.GenerateCreateAPIToken(site)).Methods("POST")
+	r.Handle("/account/tokens/revoke/{id}", ue.GenerateRevokeAPIToken()).Methods("GET")
+}
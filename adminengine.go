@@ -1,9 +1,12 @@
 package siteengines
 
 import (
+	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/hoisie/web"
+	"github.com/gorilla/mux"
 	. "github.com/xyproto/genericsite"
 	"github.com/xyproto/pinterface"
 	"github.com/xyproto/symbolhash"
@@ -13,15 +16,40 @@ import (
 // This part handles the "admin" pages
 
 type AdminEngine struct {
-	state pinterface.IUserState
+	state   pinterface.IUserState
+	panels  []AdminPanel // Engines that add information to the dashboard
+	engines []Engine     // All enabled engines, for exporting and erasing personal data
 }
 
 func NewAdminEngine(state pinterface.IUserState) (*AdminEngine, error) {
-	return &AdminEngine{state}, nil
+	return &AdminEngine{state: state}, nil
 }
 
-func (ae *AdminEngine) ServePages(basecp BaseCP, menuEntries MenuEntries) {
-	ae.serveSystem()
+func (ae *AdminEngine) Name() string {
+	return "admin"
+}
+
+func (ae *AdminEngine) MenuLinks() []string {
+	return []string{"Admin:/admin"}
+}
+
+// Add information from another engine to the dashboard
+func (ae *AdminEngine) AddPanel(panel AdminPanel) {
+	ae.panels = append(ae.panels, panel)
+}
+
+func (ae *AdminEngine) ServeEngine(r *mux.Router, ec *EngineConfig) {
+	ae.engines = ec.Engines
+	for _, engine := range ec.Engines {
+		if panel, ok := engine.(AdminPanel); ok {
+			ae.AddPanel(panel)
+		}
+	}
+	ae.ServePages(r, ec.BaseCP, ec.MenuEntries)
+}
+
+func (ae *AdminEngine) ServePages(r *mux.Router, basecp BaseCP, menuEntries MenuEntries) {
+	ae.serveSystem(r)
 
 	state := ae.state
 
@@ -32,15 +60,19 @@ func (ae *AdminEngine) ServePages(basecp BaseCP, menuEntries MenuEntries) {
 	// template content generator
 	tpvf := DynamicMenuFactoryGenerator(menuEntries)
 
-	web.Get("/admin", adminCP.WrapSimpleContextHandle(GenerateAdminStatus(state), tpvf(state)))
-	web.Get("/css/admin.css", ae.GenerateCSS(adminCP.ColorScheme))
+	r.HandleFunc("/admin", adminCP.WrapSimpleContextHandle(r, ae.GenerateDashboard(), tpvf(state))).Methods("GET")
+	r.Handle("/css/admin.css", ae.GenerateCSS(adminCP.ColorScheme)).Methods("GET")
+
+	eraseCP := basecp(state)
+	eraseCP.ContentTitle = "Erase personal data"
+	r.HandleFunc("/personaldata/erase/{username}", eraseCP.WrapSimpleContextHandle(r, ae.GenerateEraseUserForm(), tpvf(state))).Methods("GET")
 }
 
 // TODO: Log and graph when people visit pages and when people contribute content
 // This one is wrapped by ServeAdminPages
-func GenerateAdminStatus(state pinterface.IUserState) SimpleContextHandle {
-	return func(ctx *web.Context) string {
-		if !state.AdminRights(ctx.Request) {
+func GenerateAdminStatus(state pinterface.IUserState) StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		if !HasAdminRights(state, req) {
 			return "<div class=\"no\">Not logged in as Administrator</div>"
 		}
 
@@ -50,7 +82,7 @@ func GenerateAdminStatus(state pinterface.IUserState) SimpleContextHandle {
 		s += "<strong>User table</strong><br />"
 		s += "<table class=\"whitebg\">"
 		s += "<tr>"
-		s += "<th>Username</th><th>Confirmed</th><th>Logged in</th><th>Administrator</th><th>Admin toggle</th><th>Remove user</th><th>Email</th><th>Password hash</th>"
+		s += "<th>Username</th><th>Confirmed</th><th>Logged in</th><th>Administrator</th><th>Admin toggle</th><th>Remove user</th><th>Personal data</th><th>Email</th><th>Password hash</th><th>Last seen IP</th>"
 		s += "</tr>"
 		usernames, err := state.AllUsernames()
 		if err == nil {
@@ -62,11 +94,16 @@ func GenerateAdminStatus(state pinterface.IUserState) SimpleContextHandle {
 				}
 				s += "<td><a class=\"username\" href=\"/status/" + username + "\">" + username + "</a></td>"
 				s += TableCell(state.IsConfirmed(username))
-				s += TableCell(state.IsLoggedIn(username))
+				if state.IsLoggedIn(username) {
+					s += "<td class=\"yes\">yes (<a class=\"careful\" href=\"/sessions/logout/" + username + "\">force logout</a>)</td>"
+				} else {
+					s += TableCell(false)
+				}
 				s += TableCell(state.IsAdmin(username))
 				s += "<td><a class=\"darkgrey\" href=\"/admintoggle/" + username + "\">admin toggle</a></td>"
 				// TODO: Ask for confirmation first with a MessageOKurl("blabla", "blabla", "/actually/remove/stuff")
 				s += "<td><a class=\"careful\" href=\"/remove/" + username + "\">remove</a></td>"
+				s += "<td><a class=\"darkgrey\" href=\"/personaldata/export/" + username + "\">export</a> <a class=\"careful\" href=\"/personaldata/erase/" + username + "\">erase</a></td>"
 				email, err := state.Email(username)
 				if err == nil {
 					// The cleanup happens at registration time, but it's ok with an extra cleanup
@@ -80,15 +117,28 @@ func GenerateAdminStatus(state pinterface.IUserState) SimpleContextHandle {
 						s += "<td>" + symbolhash.New(passwordHash, 16).String() + "</td>"
 					}
 				}
+				if ip, when, err := LastSeenIP(state, username); err == nil {
+					s += "<td><a href=\"/iphistory/" + username + "\">" + ip + "</a> (" + when.Format("2006-01-02 15:04") + ")</td>"
+				} else {
+					s += "<td>never</td>"
+				}
 				s += "</tr>"
 			}
 		}
 		s += "</table>"
 		s += "<br />"
+		if collisions, err := UsernameCollisions(state); err == nil && len(collisions) > 0 {
+			s += "<strong>Usernames that only differ in case</strong><br />"
+			s += "These users can only log in with the exact case of their username. Consider removing all but one of each.<br />"
+			for _, usernames := range collisions {
+				s += "<span class=\"careful\">" + strings.Join(usernames, ", ") + "</span><br />"
+			}
+			s += "<br />"
+		}
 		s += "<strong>Unconfirmed users</strong><br />"
 		s += "<table>"
 		s += "<tr>"
-		s += "<th>Username</th><th>Confirmation link</th><th>Remove</th>"
+		s += "<th>Username</th><th>Confirmation link</th><th>Age</th><th>Remove</th>"
 		s += "</tr>"
 		usernames, err = state.AllUnconfirmedUsernames()
 		if err == nil {
@@ -100,6 +150,11 @@ func GenerateAdminStatus(state pinterface.IUserState) SimpleContextHandle {
 					panic("ERROR: Could not get confirmation code")
 				}
 				s += "<td><a class=\"somewhatcareful\" href=\"/confirm/" + confirmationCode + "\">" + confirmationCode + "</a></td>"
+				if age, err := ConfirmationCodeAge(state, username); err == nil {
+					s += "<td>" + formatAge(age) + "</td>"
+				} else {
+					s += "<td>unknown</td>"
+				}
 				s += "<td><a class=\"careful\" href=\"/removeunconfirmed/" + username + "\">remove</a></td>"
 				s += "</tr>"
 			}
@@ -109,12 +164,27 @@ func GenerateAdminStatus(state pinterface.IUserState) SimpleContextHandle {
 	}
 }
 
-func GenerateStatusCurrentUser(state pinterface.IUserState) SimpleContextHandle {
-	return func(ctx *web.Context) string {
-		if !state.AdminRights(ctx.Request) {
+// The administrator status, followed by the panels from the other engines
+func (ae *AdminEngine) GenerateDashboard() StringHandle {
+	status := GenerateAdminStatus(ae.state)
+	return func(w http.ResponseWriter, req *http.Request) string {
+		s := status(w, req)
+		if !HasAdminRights(ae.state, req) {
+			return s
+		}
+		for _, panel := range ae.panels {
+			s += "<br />" + panel.AdminStatus(req)
+		}
+		return s
+	}
+}
+
+func GenerateStatusCurrentUser(state pinterface.IUserState) StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		if !HasAdminRights(state, req) {
 			return MessageOKback("Status", "Not logged in as Administrator")
 		}
-		username := state.Username(ctx.Request)
+		username := state.Username(req)
 		if username == "" {
 			return MessageOKback("Current user status", "No user logged in")
 		}
@@ -129,13 +199,16 @@ func GenerateStatusCurrentUser(state pinterface.IUserState) SimpleContextHandle
 	}
 }
 
-func GenerateStatusUser(state pinterface.IUserState) WebHandle {
-	return func(ctx *web.Context, username string) string {
+func GenerateStatusUser(state pinterface.IUserState) StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		username := mux.Vars(req)["username"]
 		if username == "" {
 			return MessageOKback("Status", "No username given")
 		}
-		if !state.HasUser(username) {
-			return MessageOKback("Status", username+" does not exist")
+		if found := FindUsername(state, username); found != "" {
+			username = found
+		} else {
+			return MessageOKback("Status", CleanUserInput(username)+" does not exist")
 		}
 		loggedinStatus := "not logged in"
 		if state.IsLoggedIn(username) {
@@ -149,16 +222,32 @@ func GenerateStatusUser(state pinterface.IUserState) WebHandle {
 	}
 }
 
+// Format a duration as days, hours or minutes, whichever fits
+func formatAge(age time.Duration) string {
+	switch {
+	case age >= 48*time.Hour:
+		return strconv.Itoa(int(age/(24*time.Hour))) + " days"
+	case age >= 2*time.Hour:
+		return strconv.Itoa(int(age/time.Hour)) + " hours"
+	default:
+		return strconv.Itoa(int(age/time.Minute)) + " minutes"
+	}
+}
+
 // Remove an unconfirmed user
-func GenerateRemoveUnconfirmedUser(state pinterface.IUserState) WebHandle {
-	return func(ctx *web.Context, username string) string {
-		if !state.AdminRights(ctx.Request) {
+func GenerateRemoveUnconfirmedUser(state pinterface.IUserState) StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		username := mux.Vars(req)["username"]
+		if !HasAdminRights(state, req) {
 			return MessageOKback("Remove unconfirmed user", "Not logged in as Administrator")
 		}
 
 		if username == "" {
 			return MessageOKback("Remove unconfirmed user", "Can't remove blank user.")
 		}
+		if found := FindUsername(state, username); found != "" {
+			username = found
+		}
 
 		found := false
 		usernames, err := state.AllUnconfirmedUsernames()
@@ -186,17 +275,20 @@ func GenerateRemoveUnconfirmedUser(state pinterface.IUserState) WebHandle {
 
 // TODO: Undo for removing users
 // Remove a user
-func GenerateRemoveUser(state pinterface.IUserState) WebHandle {
-	return func(ctx *web.Context, username string) string {
-		if !state.AdminRights(ctx.Request) {
+func GenerateRemoveUser(state pinterface.IUserState) StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		username := mux.Vars(req)["username"]
+		if !HasAdminRights(state, req) {
 			return MessageOKback("Remove user", "Not logged in as Administrator")
 		}
 
 		if username == "" {
 			return MessageOKback("Remove user", "Can't remove blank user")
 		}
-		if !state.HasUser(username) {
-			return MessageOKback("Remove user", username+" doesn't exists, could not remove")
+		if found := FindUsername(state, username); found != "" {
+			username = found
+		} else {
+			return MessageOKback("Remove user", CleanUserInput(username)+" doesn't exists, could not remove")
 		}
 
 		// Remove the user
@@ -206,9 +298,9 @@ func GenerateRemoveUser(state pinterface.IUserState) WebHandle {
 	}
 }
 
-func GenerateAllUsernames(state pinterface.IUserState) SimpleContextHandle {
-	return func(ctx *web.Context) string {
-		if !state.AdminRights(ctx.Request) {
+func GenerateAllUsernames(state pinterface.IUserState) StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		if !HasAdminRights(state, req) {
 			return MessageOKback("List usernames", "Not logged in as Administrator")
 		}
 		s := ""
@@ -222,20 +314,23 @@ func GenerateAllUsernames(state pinterface.IUserState) SimpleContextHandle {
 	}
 }
 
-func GenerateToggleAdmin(state pinterface.IUserState) WebHandle {
-	return func(ctx *web.Context, username string) string {
-		if !state.AdminRights(ctx.Request) {
+func GenerateToggleAdmin(state pinterface.IUserState) StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		username := mux.Vars(req)["username"]
+		if !HasAdminRights(state, req) {
 			return MessageOKback("Admin toggle", "Not logged in as Administrator")
 		}
 		if username == "" {
 			return MessageOKback("Admin toggle", "Can't set toggle empty username")
 		}
-		if !state.HasUser(username) {
+		if found := FindUsername(state, username); found != "" {
+			username = found
+		} else {
 			return MessageOKback("Admin toggle", "Can't toggle non-existing user")
 		}
-		// A special case
-		if username == "admin" {
-			return MessageOKback("Admin toggle", "Can't remove admin rights from the admin user")
+		// So that there is always an administrator left
+		if username == LoggedInUsername(state, req) {
+			return MessageOKback("Admin toggle", "Can't remove admin rights from yourself")
 		}
 		if !state.IsAdmin(username) {
 			state.SetAdminStatus(username)
@@ -246,23 +341,27 @@ func GenerateToggleAdmin(state pinterface.IUserState) WebHandle {
 	}
 }
 
-func (ae *AdminEngine) serveSystem() {
+func (ae *AdminEngine) serveSystem(r *mux.Router) {
 	state := ae.state
 
 	// These are available for everyone
-	web.Get("/status/(.*)", GenerateStatusUser(state))
+	r.Handle("/status/{username}", GenerateStatusUser(state)).Methods("GET")
 
 	// These are only available as administrator, all have checks
-	web.Get("/status", GenerateStatusCurrentUser(state))
-	web.Get("/remove/(.*)", GenerateRemoveUser(state))
-	web.Get("/removeunconfirmed/(.*)", GenerateRemoveUnconfirmedUser(state))
-	web.Get("/users/(.*)", GenerateAllUsernames(state))
-	web.Get("/admintoggle/(.*)", GenerateToggleAdmin(state))
+	r.Handle("/status", GenerateStatusCurrentUser(state)).Methods("GET")
+	r.Handle("/remove/{username}", GenerateRemoveUser(state)).Methods("GET")
+	r.Handle("/removeunconfirmed/{username}", GenerateRemoveUnconfirmedUser(state)).Methods("GET")
+	r.Handle("/users", GenerateAllUsernames(state)).Methods("GET")
+	// Anything after /users/ is ignored, like before
+	r.Handle("/users/{rest:.*}", GenerateAllUsernames(state)).Methods("GET")
+	r.Handle("/admintoggle/{username}", GenerateToggleAdmin(state)).Methods("GET")
+	r.Handle("/personaldata/export/{username}", ae.GenerateExportUser()).Methods("GET")
+	r.Handle("/personaldata/erase/{username}", ae.GenerateEraseUser()).Methods("POST")
 }
 
-func (ae *AdminEngine) GenerateCSS(cs *ColorScheme) SimpleContextHandle {
-	return func(ctx *web.Context) string {
-		ctx.ContentType("css")
+func (ae *AdminEngine) GenerateCSS(cs *ColorScheme) StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		w.Header().Add("Content-Type", "text/css")
 		// TODO: Consider if menus should be hidden this way when visiting a subpage
 		//#menuAdmin {
 		//	display: none;
@@ -0,0 +1,407 @@
+package siteengines
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/xyproto/pinterface"
+	. "github.com/xyproto/webhandle"
+)
+
+// This part lets users create personal access tokens, so that scripts can use
+// the pages with an "Authorization: Bearer" header instead of logging in
+
+// Personal access tokens start with this, so that they can be told apart from other bearer tokens
+const apiTokenPrefix = "pat_"
+
+var (
+	noAPITokenErr      = errors.New("The API token does not exist, or has been revoked.")
+	unknownAPIScopeErr = errors.New("Unknown API token scope.")
+)
+
+// What each scope is for, as shown on the account page
+var apiScopeDescriptions = map[string]string{
+	"read":  "read pages, but change nothing",
+	"chat":  "read and write in the chat",
+	"wiki":  "read and edit wiki pages",
+	"admin": "everything the user can do, including administration",
+}
+
+// The scopes, in the order they are shown
+var apiScopes = []string{"read", "chat", "wiki", "admin"}
+
+var (
+	apiScopeRoutesMut sync.RWMutex
+	// The routes each scope allows, as the method and the path template of the route.
+	// The "admin" scope allows all routes.
+	apiScopeRoutes = map[string][]string{
+		"read": {
+			"GET /api/hosts/{hostname}/ips",
+			"GET /api/ips",
+			"GET /api/ips/last",
+			"GET /getchatlines",
+			"GET /getip",
+			"GET /search",
+			"GET /sessions",
+			"GET /status",
+			"GET /timetable",
+			"GET /timetable/{userdate}",
+			"GET /wiki",
+			"GET /wiki/{pageid:.*}",
+			"GET /wikipages",
+			"GET /wikisource/{pageid:.*}",
+		},
+		"chat": {
+			"GET /chat",
+			"GET /getchatlines",
+			"POST /say",
+			"POST /setchatlines",
+		},
+		"wiki": {
+			"GET /wiki",
+			"GET /wiki/{pageid:.*}",
+			"GET /wikiedit/{pageid:.*}",
+			"GET /wikipages",
+			"GET /wikisource/{pageid:.*}",
+			"POST /wiki",
+		},
+	}
+)
+
+// Let tokens with the given scope use the given routes, ie. "POST /wiki".
+// For engines in other packages, that have pages that scripts may use.
+func AllowAPIRoutes(scope string, routes ...string) {
+	apiScopeRoutesMut.Lock()
+	defer apiScopeRoutesMut.Unlock()
+	apiScopeRoutes[scope] = append(apiScopeRoutes[scope], routes...)
+}
+
+// A personal access token. Only the hash of the token itself is stored.
+type APIToken struct {
+	ID       string // The hash of the token
+	Username string
+	Name     string // Chosen by the user, ie. "backup script"
+	Scopes   []string
+	Created  time.Time
+	LastUsed time.Time // Zero if the token has not been used
+}
+
+// Check if the token may be used for the given method and route path template
+func (t *APIToken) Allows(method, pathTemplate string) bool {
+	route := method + " " + pathTemplate
+	apiScopeRoutesMut.RLock()
+	defer apiScopeRoutesMut.RUnlock()
+	for _, scope := range t.Scopes {
+		if scope == "admin" {
+			return true
+		}
+		for _, allowed := range apiScopeRoutes[scope] {
+			if allowed == route {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type APITokens struct {
+	state  pinterface.IUserState
+	tokens pinterface.IHashMap // The token hashes, with "username", "name", "scopes", "created" and "lastused" fields
+}
+
+func NewAPITokens(state pinterface.IUserState) (*APITokens, error) {
+	tokens, err := state.Creator().NewHashMap("apiTokens")
+	if err != nil {
+		return nil, err
+	}
+	return &APITokens{state: state, tokens: tokens}, nil
+}
+
+// Create a token with the given name and scopes. Returns the token, which is only available now.
+func (at *APITokens) Create(username, name string, scopes []string) (string, error) {
+	for _, scope := range scopes {
+		if _, ok := apiScopeDescriptions[scope]; !ok {
+			return "", unknownAPIScopeErr
+		}
+	}
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	token = apiTokenPrefix + token
+	id := hashToken(token)
+	now := time.Now().UTC().Format(time.RFC3339)
+	for field, value := range map[string]string{"name": name, "scopes": strings.Join(scopes, ","), "created": now, "username": username} {
+		if err := at.tokens.Set(id, field, value); err != nil {
+			at.tokens.Del(id)
+			return "", err
+		}
+	}
+	return token, nil
+}
+
+// Get a token by ID
+func (at *APITokens) Get(id string) (*APIToken, error) {
+	username, err := at.tokens.Get(id, "username")
+	if err != nil {
+		return nil, noAPITokenErr
+	}
+	t := &APIToken{ID: id, Username: username}
+	t.Name, _ = at.tokens.Get(id, "name")
+	if scopes, err := at.tokens.Get(id, "scopes"); err == nil && scopes != "" {
+		t.Scopes = strings.Split(scopes, ",")
+	}
+	if created, err := at.tokens.Get(id, "created"); err == nil {
+		t.Created, _ = time.Parse(time.RFC3339, created)
+	}
+	if lastUsed, err := at.tokens.Get(id, "lastused"); err == nil {
+		t.LastUsed, _ = time.Parse(time.RFC3339, lastUsed)
+	}
+	return t, nil
+}
+
+// Find the token that is sent by a script, and note that it is in use.
+// Tokens that belong to removed users are removed.
+func (at *APITokens) Find(token string) (*APIToken, error) {
+	t, err := at.Get(hashToken(token))
+	if err != nil {
+		return nil, err
+	}
+	if !at.state.HasUser(t.Username) {
+		at.tokens.Del(t.ID)
+		return nil, noAPITokenErr
+	}
+	// Stored as seldom as the activity of sessions
+	if now := time.Now(); now.Sub(t.LastUsed) > sessionActivityInterval {
+		t.LastUsed = now
+		at.tokens.Set(t.ID, "lastused", now.UTC().Format(time.RFC3339))
+	}
+	return t, nil
+}
+
+// The tokens of a user, sorted by name
+func (at *APITokens) ForUser(username string) ([]*APIToken, error) {
+	ids, err := at.tokens.All()
+	if err != nil {
+		return nil, err
+	}
+	var tokens []*APIToken
+	for _, id := range ids {
+		t, err := at.Get(id)
+		if err != nil || t.Username != username {
+			continue
+		}
+		tokens = append(tokens, t)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].Name < tokens[j].Name
+	})
+	return tokens, nil
+}
+
+// Make a token stop working
+func (at *APITokens) Revoke(id string) error {
+	return at.tokens.Del(id)
+}
+
+// Make all tokens of a user stop working
+func (at *APITokens) RevokeAll(username string) error {
+	tokens, err := at.ForUser(username)
+	if err != nil {
+		return err
+	}
+	for _, t := range tokens {
+		at.Revoke(t.ID)
+	}
+	return nil
+}
+
+// The path template of the route that matched the request, or the path if there is none
+func routeTemplate(req *http.Request) string {
+	if route := mux.CurrentRoute(req); route != nil {
+		if tpl, err := route.GetPathTemplate(); err == nil {
+			return tpl
+		}
+	}
+	return req.URL.Path
+}
+
+// The key for the API token in the request context
+type contextKey int
+
+const apiTokenContextKey contextKey = 0
+
+// The API token the request was made with, or nil if there is none
+func requestAPIToken(req *http.Request) *APIToken {
+	t, _ := req.Context().Value(apiTokenContextKey).(*APIToken)
+	return t
+}
+
+// Check if the token has the given scope
+func (t *APIToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// The user that is logged in, or that the API token of the request belongs to.
+// Returns an empty string if there is no such user.
+func LoggedInUsername(state pinterface.IUserState, req *http.Request) string {
+	if t := requestAPIToken(req); t != nil {
+		return t.Username
+	}
+	username := state.Username(req)
+	if username == "" || !state.IsLoggedIn(username) {
+		return ""
+	}
+	return username
+}
+
+// Check if the request has administrator rights. With an API token,
+// the token must have the admin scope and belong to an administrator.
+func HasAdminRights(state pinterface.IUserState, req *http.Request) bool {
+	if t := requestAPIToken(req); t != nil {
+		return t.HasScope("admin") && state.IsAdmin(t.Username)
+	}
+	return state.AdminRights(req)
+}
+
+// Let requests with a personal access token act as the user the token belongs to,
+// for the routes that the scopes of the token allow. Used as middleware for all pages,
+// after checkSession. Other bearer tokens, like the one for the IP API, are left alone.
+// The token is placed in the request context, where LoggedInUsername and HasAdminRights find it.
+func (ue *UserEngine) checkAPIToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		token := bearerToken(req)
+		if !strings.HasPrefix(token, apiTokenPrefix) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		t, err := ue.apiTokens.Find(token)
+		if err != nil {
+			writeJSONError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		if !t.Allows(req.Method, routeTemplate(req)) {
+			writeJSONError(w, http.StatusForbidden, "The API token does not allow "+req.Method+" "+req.URL.Path+".")
+			return
+		}
+		// The token was created without two-factor authentication, which is now required
+		if ue.twoFactor.Required(t.Username) && !ue.twoFactor.Enabled(t.Username) {
+			writeJSONError(w, http.StatusForbidden, "Two-factor authentication must be set up before the API token can be used.")
+			return
+		}
+		// Only the token counts, not any cookies that came with it
+		removeRequestCookie(req, "user")
+		removeRequestCookie(req, sessionCookieName)
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), apiTokenContextKey, t)))
+	})
+}
+
+// The API token section of the account page
+func (ue *UserEngine) apiTokensHTML(username string) string {
+	s := "<h3>API tokens</h3>"
+	s += "<p>Scripts can use a token instead of logging in, with an <code>Authorization: Bearer</code> header.</p>"
+	if tokens, err := ue.apiTokens.ForUser(username); err == nil && len(tokens) > 0 {
+		s += "<table>"
+		s += "<tr><th>Name</th><th>Scopes</th><th>Created</th><th>Last used</th><th>Revoke</th></tr>"
+		for rownr, t := range tokens {
+			if rownr%2 == 0 {
+				s += "<tr class=\"even\">"
+			} else {
+				s += "<tr class=\"odd\">"
+			}
+			s += "<td>" + t.Name + "</td>"
+			s += "<td>" + strings.Join(t.Scopes, ", ") + "</td>"
+			s += "<td>" + t.Created.Local().Format("2006-01-02 15:04") + "</td>"
+			if t.LastUsed.IsZero() {
+				s += "<td>never</td>"
+			} else {
+				s += "<td>" + t.LastUsed.Local().Format("2006-01-02 15:04") + "</td>"
+			}
+			s += "<td><a class=\"careful\" href=\"/account/tokens/revoke/" + t.ID + "\">revoke</a></td>"
+			s += "</tr>"
+		}
+		s += "</table>"
+	}
+	s += "<form method=\"POST\" action=\"/account/tokens\">"
+	s += "Name: <input name=\"name\"><br />"
+	for _, scope := range apiScopes {
+		if scope == "admin" && !ue.state.IsAdmin(username) {
+			continue
+		}
+		s += "<input type=\"checkbox\" name=\"scope\" value=\"" + scope + "\"> " + scope + ": " + apiScopeDescriptions[scope] + "<br />"
+	}
+	s += "<input type=\"submit\" value=\"Create token\">"
+	s += "</form>"
+	return s
+}
+
+// Create a token for the current user. Only from a browser, not with another token.
+func (ue *UserEngine) GenerateCreateAPIToken(site string) StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		username := LoggedInUsername(ue.state, req)
+		if username == "" || ue.currentSession(req) == nil {
+			return MessageOKback("API token", "Not logged in")
+		}
+		name := strings.TrimSpace(req.FormValue("name"))
+		if name == "" {
+			return MessageOKback("API token", "Please give the token a name, so that you know what it is for.")
+		}
+		// The same rules as for display names
+		if !validDisplayName(name) {
+			return MessageOKback("API token", "The name can be at most 50 letters, without markup or quotes.")
+		}
+		scopes := req.Form["scope"]
+		if len(scopes) == 0 {
+			return MessageOKback("API token", "Please select at least one scope.")
+		}
+		for _, scope := range scopes {
+			if scope == "admin" && !ue.state.IsAdmin(username) {
+				return MessageOKback("API token", "Only administrators can create tokens with the admin scope.")
+			}
+		}
+		tokens, err := ue.apiTokens.ForUser(username)
+		if err != nil {
+			return MessageOKback("API token", "Could not retrieve the tokens")
+		}
+		for _, t := range tokens {
+			if t.Name == name {
+				return MessageOKback("API token", "There is already a token named "+name+".")
+			}
+		}
+		token, err := ue.apiTokens.Create(username, name, scopes)
+		if err != nil {
+			return MessageOKback("API token", err.Error())
+		}
+		email, _ := ue.state.Email(username)
+		ue.accountChanged(site, username, email, "API token \""+name+"\" created", ClientIP(req))
+		return MessageOKurl("API token", "OK, this is the token. Copy it now, since it is only shown once.<br /><br /><code>"+token+"</code>", "/account")
+	}
+}
+
+// Revoke a token of the current user. Only from a browser, not with another token.
+func (ue *UserEngine) GenerateRevokeAPIToken() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		username := LoggedInUsername(ue.state, req)
+		if username == "" || ue.currentSession(req) == nil {
+			return MessageOKback("API token", "Not logged in")
+		}
+		t, err := ue.apiTokens.Get(mux.Vars(req)["id"])
+		if err != nil || t.Username != username {
+			return MessageOKurl("API token", noAPITokenErr.Error(), "/account")
+		}
+		ue.apiTokens.Revoke(t.ID)
+		RecordAccountChange(ue.state, username, ClientIP(req), "API token \""+t.Name+"\" revoked")
+		return MessageOKurl("API token", "OK, the token "+t.Name+" no longer works.", "/account")
+	}
+}
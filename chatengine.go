@@ -1,10 +1,13 @@
 package siteengines
 
 import (
+	"net/http"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/hoisie/web"
+	"github.com/gorilla/mux"
 	. "github.com/xyproto/genericsite"
 	. "github.com/xyproto/onthefly"
 	"github.com/xyproto/pinterface"
@@ -15,8 +18,11 @@ import (
 // This part handles the "chat" pages
 
 type ChatEngine struct {
-	chatState *ChatState
-	state     pinterface.IUserState
+	chatState  *ChatState
+	state      pinterface.IUserState
+	bans       *IPBans
+	moderation *ModerationEngine // Holds chat lines until they are approved, may be nil
+	mut        sync.Mutex        // So that no lines are added while the lines are erased
 }
 
 type ChatState struct {
@@ -49,10 +55,45 @@ func NewChatEngine(userState pinterface.IUserState) (*ChatEngine, error) {
 		chatState.userInfo = userInfoHashMap
 	}
 
-	return &ChatEngine{chatState, userState}, nil
+	bans, err := NewIPBans(userState)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ChatEngine{chatState: chatState, state: userState, bans: bans}, nil
+}
+
+func (ce *ChatEngine) Name() string {
+	return "chat"
+}
+
+func (ce *ChatEngine) MenuLinks() []string {
+	return []string{"Chat:/chat"}
 }
 
-func (ce *ChatEngine) ServePages(basecp BaseCP, menuEntries MenuEntries) {
+func (ce *ChatEngine) ServeEngine(r *mux.Router, ec *EngineConfig) {
+	ce.ServePages(r, ec.BaseCP, ec.MenuEntries)
+}
+
+// List the chat participants on the administrator dashboard
+func (ce *ChatEngine) AdminStatus(req *http.Request) string {
+	s := "<strong>Chat participants</strong><br />"
+	s += "<table>"
+	s += "<tr>"
+	s += "<th>Username</th><th>Chatting</th><th>Last seen</th>"
+	s += "</tr>"
+	for _, username := range ce.ChatUsers() {
+		s += "<tr>"
+		s += "<td><a class=\"username\" href=\"/status/" + username + "\">" + username + "</a></td>"
+		s += TableCell(ce.IsChatting(username))
+		s += "<td>" + ce.GetLastSeen(username) + "</td>"
+		s += "</tr>"
+	}
+	s += "</table>"
+	return s
+}
+
+func (ce *ChatEngine) ServePages(r *mux.Router, basecp BaseCP, menuEntries MenuEntries) {
 	chatCP := basecp(ce.state)
 	chatCP.ContentTitle = "Chat"
 	chatCP.ExtraCSSurls = append(chatCP.ExtraCSSurls, "/css/chat.css")
@@ -60,12 +101,12 @@ func (ce *ChatEngine) ServePages(basecp BaseCP, menuEntries MenuEntries) {
 	tvgf := DynamicMenuFactoryGenerator(menuEntries)
 	tvg := tvgf(ce.state)
 
-	web.Get("/chat", chatCP.WrapSimpleContextHandle(ce.GenerateChatCurrentUser(), tvg))
-	web.Post("/say", ce.GenerateSayCurrentUser())
-	web.Get("/css/chat.css", ce.GenerateCSS(chatCP.ColorScheme))
-	web.Post("/setchatlines", ce.GenerateSetChatLinesCurrentUser())
+	r.HandleFunc("/chat", chatCP.WrapSimpleContextHandle(r, ce.GenerateChatCurrentUser(), tvg)).Methods("GET")
+	r.Handle("/say", ce.GenerateSayCurrentUser()).Methods("POST")
+	r.Handle("/css/chat.css", ce.GenerateCSS(chatCP.ColorScheme)).Methods("GET")
+	r.Handle("/setchatlines", ce.GenerateSetChatLinesCurrentUser()).Methods("POST")
 	// For debugging
-	web.Get("/getchatlines", ce.GenerateGetChatLinesCurrentUser())
+	r.Handle("/getchatlines", ce.GenerateGetChatLinesCurrentUser()).Methods("GET")
 }
 
 func (ce *ChatEngine) SetLines(username string, lines int) {
@@ -164,13 +205,114 @@ func (ce *ChatEngine) JoinChat(username string) {
 }
 
 func (ce *ChatEngine) Say(username, text string) {
-	timestamp := time.Now().String()
-	textline := timestamp[11:19] + "&nbsp;&nbsp;" + username + "> " + text
-	ce.chatState.said.Add(textline)
+	ce.mut.Lock()
+	ce.chatState.said.Add(chatLine(username, text))
+	ce.mut.Unlock()
 	// Store the timestamp for when the user was last seen as well
 	ce.Seen(username)
 }
 
+// Format a line of chat
+func chatLine(username, text string) string {
+	timestamp := time.Now().String()
+	return timestamp[11:19] + "&nbsp;&nbsp;" + username + "> " + text
+}
+
+// The username of a line of chat, as formatted by chatLine
+func chatLineUsername(line string) string {
+	pos := strings.Index(line, "&nbsp;&nbsp;")
+	if pos < 0 {
+		return ""
+	}
+	rest := line[pos+len("&nbsp;&nbsp;"):]
+	end := strings.Index(rest, "> ")
+	if end < 0 {
+		return ""
+	}
+	return rest[:end]
+}
+
+// The lines the user has said, and the chat settings of the user
+func (ce *ChatEngine) ExportPersonalData(username string) (interface{}, error) {
+	lines, err := ce.chatState.said.All()
+	if err != nil {
+		return nil, err
+	}
+	said := []string{}
+	for _, line := range lines {
+		if chatLineUsername(line) == username {
+			said = append(said, strings.Replace(line, "&nbsp;", " ", -1))
+		}
+	}
+	return map[string]interface{}{
+		"said":     said,
+		"lines":    ce.GetLines(username),
+		"lastseen": ce.GetLastSeen(username),
+	}, nil
+}
+
+// Remove the lines the user has said, and the chat settings of the user
+func (ce *ChatEngine) ErasePersonalData(username string) error {
+	ce.mut.Lock()
+	defer ce.mut.Unlock()
+	lines, err := ce.chatState.said.All()
+	if err != nil {
+		return err
+	}
+	var kept []string
+	for _, line := range lines {
+		if chatLineUsername(line) != username {
+			kept = append(kept, line)
+		}
+	}
+	if len(kept) < len(lines) {
+		// Lists can't remove single lines, so the list is filled again.
+		// A copy is kept until then, so that the lines of the other users can be put back.
+		backup, err := ce.state.Creator().NewList("saidBackup")
+		if err != nil {
+			return err
+		}
+		if err := fillList(backup, lines); err != nil {
+			backup.Remove()
+			return err
+		}
+		if err := fillList(ce.chatState.said, kept); err != nil {
+			if fillList(ce.chatState.said, lines) == nil {
+				backup.Remove()
+			}
+			return err
+		}
+		backup.Remove()
+	}
+	ce.chatState.active.Del(username)
+	return ce.chatState.userInfo.Del(username)
+}
+
+// Replace the contents of a list
+func fillList(list pinterface.IList, values []string) error {
+	if err := list.Clear(); err != nil {
+		return err
+	}
+	for _, value := range values {
+		if err := list.Add(value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Hold chat lines in the moderation queue
+func (ce *ChatEngine) SetModeration(me *ModerationEngine) {
+	ce.moderation = me
+	me.Handle("chat", ModerationHooks{
+		Approved: func(item *ModerationItem) {
+			ce.mut.Lock()
+			defer ce.mut.Unlock()
+			ce.chatState.said.Add(item.Data)
+		},
+	})
+}
+
 func LeaveChat(ce *ChatEngine, username string) {
 	// Leave the chat
 	ce.chatState.active.Del(username)
@@ -180,7 +322,7 @@ func LeaveChat(ce *ChatEngine, username string) {
 
 // Get current users of the chat
 func (ce *ChatEngine) ChatUsers() []string {
-	chatUsernames, err := ce.chatState.active.GetAll()
+	chatUsernames, err := ce.chatState.active.All()
 	if err != nil {
 		return []string{}
 	}
@@ -189,7 +331,7 @@ func (ce *ChatEngine) ChatUsers() []string {
 
 // Get current text of the chat
 func (ce *ChatEngine) ChatText() []string {
-	chatText, err := ce.chatState.said.GetAll()
+	chatText, err := ce.chatState.said.All()
 	if err != nil {
 		return []string{}
 	}
@@ -198,7 +340,7 @@ func (ce *ChatEngine) ChatText() []string {
 
 // Get the last N entries
 func (ce *ChatEngine) GetLastChatText(n int) []string {
-	chatText, err := ce.chatState.said.GetLastN(n)
+	chatText, err := ce.chatState.said.LastN(n)
 	if err != nil {
 		return []string{}
 	}
@@ -217,15 +359,12 @@ func (ce *ChatEngine) chatText(lines int) string {
 	return retval + "</div>"
 }
 
-func (ce *ChatEngine) GenerateChatCurrentUser() SimpleContextHandle {
-	return func(ctx *web.Context) string {
-		username := ce.state.Username(ctx.Request)
+func (ce *ChatEngine) GenerateChatCurrentUser() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		username := LoggedInUsername(ce.state, req)
 		if username == "" {
 			return "No user logged in"
 		}
-		if !ce.state.IsLoggedIn(username) {
-			return "Not logged in"
-		}
 
 		ce.JoinChat(username)
 
@@ -294,40 +433,46 @@ func (ce *ChatEngine) GenerateChatCurrentUser() SimpleContextHandle {
 	}
 }
 
-func (ce *ChatEngine) GenerateSayCurrentUser() SimpleContextHandle {
-	return func(ctx *web.Context) string {
-		username := ce.state.Username(ctx.Request)
+func (ce *ChatEngine) GenerateSayCurrentUser() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		username := LoggedInUsername(ce.state, req)
 		if username == "" {
 			return "No user logged in"
 		}
-		if !ce.state.IsLoggedIn(username) {
-			return "Not logged in"
-		}
 		if !ce.IsChatting(username) {
 			return "Not currently chatting"
 		}
-		said, found := ctx.Params["said"]
-		if !found || said == "" {
+		if ban := ce.bans.Banned(ClientIP(req)); ban != nil {
+			return ban.Message()
+		}
+		said := req.FormValue("said")
+		if said == "" {
 			// Return the text instead of giving an error for easy use of /say to refresh the content
 			// Note that as long as Say below isn't called, the user will be marked as inactive eventually
 			return ce.chatText(ce.GetLines(username))
 		}
 
+		if ce.moderation != nil && ce.moderation.Holds("chat", username) {
+			textline := chatLine(username, CleanUserInput(said))
+			ce.Seen(username)
+			if _, err := ce.moderation.Hold("chat", username, textline, textline); err != nil {
+				return ce.chatText(ce.GetLines(username)) + "<br /><i>Could not send the message.</i>"
+			}
+			return ce.chatText(ce.GetLines(username)) + "<br /><i>Your message is waiting to be approved by a moderator.</i>"
+		}
+
 		ce.Say(username, CleanUserInput(said))
 
 		return ce.chatText(ce.GetLines(username))
 	}
 }
 
-func (ce *ChatEngine) GenerateGetChatLinesCurrentUser() SimpleContextHandle {
-	return func(ctx *web.Context) string {
-		username := ce.state.Username(ctx.Request)
+func (ce *ChatEngine) GenerateGetChatLinesCurrentUser() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		username := LoggedInUsername(ce.state, req)
 		if username == "" {
 			return "No user logged in"
 		}
-		if !ce.state.IsLoggedIn(username) {
-			return "Not logged in"
-		}
 		if !ce.IsChatting(username) {
 			return "Not currently chatting"
 		}
@@ -337,20 +482,17 @@ func (ce *ChatEngine) GenerateGetChatLinesCurrentUser() SimpleContextHandle {
 	}
 }
 
-func (ce *ChatEngine) GenerateSetChatLinesCurrentUser() SimpleContextHandle {
-	return func(ctx *web.Context) string {
-		username := ce.state.Username(ctx.Request)
+func (ce *ChatEngine) GenerateSetChatLinesCurrentUser() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		username := LoggedInUsername(ce.state, req)
 		if username == "" {
 			return "No user logged in"
 		}
-		if !ce.state.IsLoggedIn(username) {
-			return "Not logged in"
-		}
 		if !ce.IsChatting(username) {
 			return "Not currently chatting"
 		}
-		lines, found := ctx.Params["lines"]
-		if !found || lines == "" {
+		lines := req.FormValue("lines")
+		if lines == "" {
 			return MessageOKback("Set chat lines", "Missing value for preferred number of lines")
 		}
 		num, err := strconv.Atoi(lines)
@@ -365,9 +507,9 @@ func (ce *ChatEngine) GenerateSetChatLinesCurrentUser() SimpleContextHandle {
 	}
 }
 
-func (ce *ChatEngine) GenerateCSS(cs *ColorScheme) SimpleContextHandle {
-	return func(ctx *web.Context) string {
-		ctx.ContentType("css")
+func (ce *ChatEngine) GenerateCSS(cs *ColorScheme) StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		w.Header().Add("Content-Type", "text/css")
 		return `
 .yes {
 	background-color: #90ff90;
@@ -0,0 +1,254 @@
+package siteengines
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xyproto/pinterface"
+)
+
+// This part finds the IP address of the client and keeps track of
+// which IP addresses each user has been seen at.
+
+// The time a user was last seen is only stored this often, to avoid writing for every request
+const lastSeenInterval = time.Minute
+
+var (
+	trustedProxiesMut sync.RWMutex
+	trustedProxies    []*net.IPNet // Only these may set X-Forwarded-For or Forwarded
+)
+
+// Set which proxies are trusted to report the client IP address with
+// the X-Forwarded-For or Forwarded headers, ie. "127.0.0.1/32" or "10.0.0.0/8".
+// No proxies are trusted by default.
+func SetTrustedProxies(cidrs ...string) error {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return errors.New("Invalid CIDR for a trusted proxy: " + cidr)
+		}
+		networks = append(networks, network)
+	}
+	trustedProxiesMut.Lock()
+	trustedProxies = networks
+	trustedProxiesMut.Unlock()
+	return nil
+}
+
+// Check if the given IP address belongs to a trusted proxy
+func trustedProxy(ip net.IP) bool {
+	trustedProxiesMut.RLock()
+	defer trustedProxiesMut.RUnlock()
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse an address that may have a port, brackets or quotes, like in the forwarding headers
+func parseForwardedIP(s string) net.IP {
+	s = strings.Trim(strings.TrimSpace(s), "\"")
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	return net.ParseIP(strings.Trim(s, "[]"))
+}
+
+// The addresses from the Forwarded header, or else from the X-Forwarded-For header.
+// The closest proxy is last.
+func forwardedIPs(req *http.Request) []net.IP {
+	var ips []net.IP
+	if forwarded := req.Header["Forwarded"]; len(forwarded) > 0 {
+		for _, element := range strings.Split(strings.Join(forwarded, ","), ",") {
+			for _, pair := range strings.Split(element, ";") {
+				pair = strings.TrimSpace(pair)
+				if len(pair) > 4 && strings.EqualFold(pair[:4], "for=") {
+					ips = append(ips, parseForwardedIP(pair[4:]))
+				}
+			}
+		}
+		return ips
+	}
+	for _, field := range strings.Split(strings.Join(req.Header["X-Forwarded-For"], ","), ",") {
+		if strings.TrimSpace(field) != "" {
+			ips = append(ips, parseForwardedIP(field))
+		}
+	}
+	return ips
+}
+
+// Find the IP address of the client. The forwarding headers are only
+// used if the request comes from a trusted proxy, and then the closest
+// address that is not a trusted proxy is used.
+func ClientIP(req *http.Request) string {
+	remote := parseForwardedIP(req.RemoteAddr)
+	if remote == nil {
+		return ""
+	}
+	if !trustedProxy(remote) {
+		return remote.String()
+	}
+	client := remote
+	ips := forwardedIPs(req)
+	for i := len(ips) - 1; i >= 0; i-- {
+		if ips[i] == nil {
+			// Can't trust anything further away than a malformed entry
+			break
+		}
+		client = ips[i]
+		if !trustedProxy(client) {
+			break
+		}
+	}
+	return client.String()
+}
+
+// Record that a user has been seen at the given IP address.
+// The IP history of the user is only extended when the address changes,
+// and the time is only updated once per lastSeenInterval for the same address.
+func RecordUserIP(state pinterface.IUserState, username, ip string) error {
+	if username == "" || ip == "" {
+		return nil
+	}
+	creator := state.Creator()
+	userIPs, err := creator.NewHashMap("userIPs")
+	if err != nil {
+		return err
+	}
+	lastIP, err := userIPs.Get(username, "lastip")
+	if err == nil && lastIP == ip {
+		if lastseen, err := userIPs.Get(username, "lastseen"); err == nil {
+			if when, err := time.Parse(time.RFC3339, lastseen); err == nil && time.Since(when) < lastSeenInterval {
+				return nil
+			}
+		}
+	}
+	if err != nil || lastIP != ip {
+		history, err := creator.NewList("userIPHistory:" + username)
+		if err != nil {
+			return err
+		}
+		if err := history.Add(ip); err != nil {
+			return err
+		}
+		if err := userIPs.Set(username, "lastip", ip); err != nil {
+			return err
+		}
+	}
+	return userIPs.Set(username, "lastseen", time.Now().UTC().Format(time.RFC3339))
+}
+
+// All the IP addresses a user has been seen at, oldest first
+func UserIPs(state pinterface.IUserState, username string) ([]string, error) {
+	history, err := state.Creator().NewList("userIPHistory:" + username)
+	if err != nil {
+		return nil, err
+	}
+	return history.All()
+}
+
+// Move the IP histories that were stored as "userIPs:" + username lists to
+// "userIPHistory:" + username. The old name is the same key as the "userIPs"
+// hash map element for the user, so the time the user was last seen could
+// not be stored next to it.
+func MigrateUserIPHistory(state pinterface.IUserState) error {
+	creator := state.Creator()
+	userIPs, err := creator.NewHashMap("userIPs")
+	if err != nil {
+		return err
+	}
+	// Both the hash map elements and the old lists are listed here
+	usernames, err := userIPs.All()
+	if err != nil {
+		return err
+	}
+	for _, username := range usernames {
+		oldHistory, err := creator.NewList("userIPs:" + username)
+		if err != nil {
+			return err
+		}
+		ips, err := oldHistory.All()
+		if err != nil || len(ips) == 0 {
+			// Not a list, but the hash map element
+			continue
+		}
+		history, err := creator.NewList("userIPHistory:" + username)
+		if err != nil {
+			return err
+		}
+		for _, ip := range ips {
+			if err := history.Add(ip); err != nil {
+				return err
+			}
+		}
+		if err := oldHistory.Remove(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The IP address a user was last seen at, and when
+func LastSeenIP(state pinterface.IUserState, username string) (string, time.Time, error) {
+	userIPs, err := state.Creator().NewHashMap("userIPs")
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	ip, err := userIPs.Get(username, "lastip")
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	lastseen, err := userIPs.Get(username, "lastseen")
+	if err != nil {
+		return ip, time.Time{}, nil
+	}
+	when, err := time.Parse(time.RFC3339, lastseen)
+	if err != nil {
+		return ip, time.Time{}, nil
+	}
+	return ip, when, nil
+}
+
+// A successful login
+type LoginRecord struct {
+	When time.Time
+	IP   string
+}
+
+// Record a successful login, for the login history
+func RecordLogin(state pinterface.IUserState, username, ip string) error {
+	logins, err := state.Creator().NewList("logins:" + username)
+	if err != nil {
+		return err
+	}
+	return logins.Add(time.Now().UTC().Format(time.RFC3339) + " " + ip)
+}
+
+// The last n logins of a user, oldest first
+func LoginHistory(state pinterface.IUserState, username string, n int) ([]LoginRecord, error) {
+	logins, err := state.Creator().NewList("logins:" + username)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := logins.LastN(n)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]LoginRecord, 0, len(entries))
+	for _, entry := range entries {
+		fields := strings.SplitN(entry, " ", 2)
+		when, err := time.Parse(time.RFC3339, fields[0])
+		if err != nil || len(fields) != 2 {
+			continue
+		}
+		records = append(records, LoginRecord{when, fields[1]})
+	}
+	return records, nil
+}
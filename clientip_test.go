@@ -0,0 +1,98 @@
+package siteengines
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	if err := SetTrustedProxies("10.0.0.0/8", "2001:db8:ffff::/48"); err != nil {
+		t.Fatal(err)
+	}
+	defer SetTrustedProxies()
+	tests := []struct {
+		remote, forwardedFor, forwarded, ip string
+	}{
+		{"192.0.2.1:1234", "", "", "192.0.2.1"},
+		{"[2001:db8::2]:443", "", "", "2001:db8::2"},
+		// Only trusted proxies may forward
+		{"192.0.2.1:1234", "203.0.113.5", "", "192.0.2.1"},
+		{"10.0.0.1:80", "203.0.113.5", "", "203.0.113.5"},
+		{"10.0.0.1:80", "", "", "10.0.0.1"},
+		// The closest address that is not a trusted proxy
+		{"10.0.0.1:80", "198.51.100.7, 203.0.113.5, 10.0.0.2", "", "203.0.113.5"},
+		{"10.0.0.1:80", "10.0.0.3, 10.0.0.2", "", "10.0.0.3"},
+		// Nothing further away than a malformed entry is used
+		{"10.0.0.1:80", "198.51.100.7, garbage", "", "10.0.0.1"},
+		{"10.0.0.1:80", "198.51.100.7:4711", "", "198.51.100.7"},
+		// Forwarded is preferred over X-Forwarded-For
+		{"10.0.0.1:80", "203.0.113.5", "for=198.51.100.7;proto=https, for=10.0.0.2", "198.51.100.7"},
+		{"[2001:db8:ffff::1]:80", "", "For=\"[2001:db8::1]:4711\"", "2001:db8::1"},
+		{"", "", "", ""},
+		{"not an address", "", "", ""},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = test.remote
+		if test.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", test.forwardedFor)
+		}
+		if test.forwarded != "" {
+			req.Header.Set("Forwarded", test.forwarded)
+		}
+		if ip := ClientIP(req); ip != test.ip {
+			t.Errorf("%s %q %q: got %q, expected %q", test.remote, test.forwardedFor, test.forwarded, ip, test.ip)
+		}
+	}
+	if err := SetTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Error("an invalid proxy range was accepted")
+	}
+}
+
+func TestRecordUserIP(t *testing.T) {
+	state := NewMemoryUserState()
+	for _, ip := range []string{"192.0.2.1", "192.0.2.1", "198.51.100.7", "192.0.2.1", ""} {
+		if err := RecordUserIP(state, "bob", ip); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ips, err := UserIPs(state, "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only changes of address are added to the history
+	if len(ips) != 3 || ips[0] != "192.0.2.1" || ips[1] != "198.51.100.7" || ips[2] != "192.0.2.1" {
+		t.Errorf("got %v", ips)
+	}
+	ip, when, err := LastSeenIP(state, "bob")
+	if err != nil || ip != "192.0.2.1" || when.IsZero() {
+		t.Errorf("got %s, %v, %v", ip, when, err)
+	}
+}
+
+func TestMigrateUserIPHistory(t *testing.T) {
+	state := NewMemoryUserState()
+	old, _ := state.Creator().NewList("userIPs:bob")
+	old.Add("192.0.2.1")
+	old.Add("198.51.100.7")
+	RecordUserIP(state, "alice", "192.0.2.2")
+	if err := MigrateUserIPHistory(state); err != nil {
+		t.Fatal(err)
+	}
+	if ips, _ := UserIPs(state, "bob"); len(ips) != 2 || ips[0] != "192.0.2.1" || ips[1] != "198.51.100.7" {
+		t.Errorf("got %v", ips)
+	}
+	if ips, _ := old.All(); len(ips) != 0 {
+		t.Errorf("the old history is still there: %v", ips)
+	}
+	// The last seen address can now be stored
+	if err := RecordUserIP(state, "bob", "203.0.113.5"); err != nil {
+		t.Fatal(err)
+	}
+	if ip, _, err := LastSeenIP(state, "bob"); ip != "203.0.113.5" {
+		t.Errorf("got %s, %v", ip, err)
+	}
+	if ips, _ := UserIPs(state, "alice"); len(ips) != 1 {
+		t.Errorf("got %v for alice", ips)
+	}
+}
@@ -0,0 +1,218 @@
+package siteengines
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/xyproto/cookie"
+	"github.com/xyproto/pinterface"
+)
+
+// This part keeps the confirmation codes indexed by code, so that
+// confirming a user does not have to look at every unconfirmed user.
+
+const (
+	confirmationCodeLength = 20
+	// How long a confirmation link works, by default
+	defaultConfirmationDuration = 7 * 24 * time.Hour
+)
+
+var (
+	confirmationInvalidErr = errors.New("The confirmation link is no longer valid.")
+	confirmationExpiredErr = errors.New("The confirmation link has expired.")
+)
+
+// The confirmation codes of the unconfirmed users, and when they were created
+type ConfirmationCodes struct {
+	state    pinterface.IUserState
+	codes    pinterface.IHashMap // The codes, with "username" and "created" fields
+	duration time.Duration
+	mut      sync.Mutex
+	stop     chan struct{} // For stopping the background sweep
+	// Removes a user that never confirmed, may be nil. The UserEngine also
+	// removes what was stored for registering, so that the username is free again.
+	removeUser func(username string) error
+}
+
+func NewConfirmationCodes(state pinterface.IUserState) (*ConfirmationCodes, error) {
+	codes, err := state.Creator().NewHashMap("confirmationCodes")
+	if err != nil {
+		return nil, err
+	}
+	cc := &ConfirmationCodes{state: state, codes: codes, duration: defaultConfirmationDuration}
+	// Index the codes of users that registered before there was an index
+	if unconfirmed, err := state.AllUnconfirmedUsernames(); err == nil {
+		now := time.Now().UTC().Format(time.RFC3339)
+		for _, username := range unconfirmed {
+			code, err := state.ConfirmationCode(username)
+			if err != nil {
+				continue
+			}
+			if found, err := codes.Has(code, "username"); err == nil && !found {
+				codes.Set(code, "username", username)
+				codes.Set(code, "created", now)
+			}
+		}
+	}
+	return cc, nil
+}
+
+// Set how long the confirmation links work. 0 means forever.
+func (cc *ConfirmationCodes) SetDuration(duration time.Duration) {
+	cc.mut.Lock()
+	defer cc.mut.Unlock()
+	cc.duration = duration
+}
+
+// Generate a confirmation code that is not already in use
+func (cc *ConfirmationCodes) generate() (string, error) {
+	length := confirmationCodeLength
+	for {
+		code := cookie.RandomHumanFriendlyString(length)
+		found, err := cc.codes.Has(code, "username")
+		if err != nil {
+			return "", err
+		}
+		if !found {
+			return code, nil
+		}
+		// Increase the length every time there is a collision
+		length++
+		if length > maxConfirmationCodeLength {
+			return "", errors.New("Too many generated confirmation codes are not unique.")
+		}
+	}
+}
+
+// Give a user a new confirmation code, and mark the user as unconfirmed.
+// Any previous code for the user stops working.
+func (cc *ConfirmationCodes) Add(username string) (string, error) {
+	code, err := cc.generate()
+	if err != nil {
+		return "", err
+	}
+	cc.Remove(username)
+	if err := cc.codes.Set(code, "username", username); err != nil {
+		return "", err
+	}
+	if err := cc.codes.Set(code, "created", time.Now().UTC().Format(time.RFC3339)); err != nil {
+		return "", err
+	}
+	cc.state.AddUnconfirmed(username, code)
+	return code, nil
+}
+
+// Find the unconfirmed user that has the given confirmation code
+func (cc *ConfirmationCodes) Find(code string) (string, error) {
+	username, err := cc.codes.Get(code, "username")
+	if err != nil {
+		return "", confirmationInvalidErr
+	}
+	// The user may have been removed or confirmed some other way
+	if current, err := cc.state.ConfirmationCode(username); err != nil || current != code {
+		cc.codes.Del(code)
+		return "", confirmationInvalidErr
+	}
+	cc.mut.Lock()
+	duration := cc.duration
+	cc.mut.Unlock()
+	if age, err := cc.age(code); duration > 0 && (err != nil || age > duration) {
+		return username, confirmationExpiredErr
+	}
+	return username, nil
+}
+
+// Remove the confirmation code of a user, without marking the user as confirmed
+func (cc *ConfirmationCodes) Remove(username string) {
+	if code, err := cc.state.ConfirmationCode(username); err == nil {
+		cc.codes.Del(code)
+	}
+	cc.state.RemoveUnconfirmed(username)
+}
+
+// How long ago the given code was created
+func (cc *ConfirmationCodes) age(code string) (time.Duration, error) {
+	created, err := cc.codes.Get(code, "created")
+	if err != nil {
+		return 0, err
+	}
+	when, err := time.Parse(time.RFC3339, created)
+	if err != nil {
+		return 0, err
+	}
+	return time.Since(when), nil
+}
+
+// Remove the unconfirmed users that registered more than maxAge ago.
+// Returns the removed usernames.
+func (cc *ConfirmationCodes) Sweep(maxAge time.Duration) []string {
+	codes, err := cc.codes.All()
+	if err != nil {
+		return nil
+	}
+	var removed []string
+	for _, code := range codes {
+		username, err := cc.codes.Get(code, "username")
+		if err != nil {
+			cc.codes.Del(code)
+			continue
+		}
+		if current, err := cc.state.ConfirmationCode(username); err != nil || current != code {
+			// Left behind by a user that was confirmed or removed
+			cc.codes.Del(code)
+			continue
+		}
+		if age, err := cc.age(code); err == nil && age > maxAge && !cc.state.IsConfirmed(username) {
+			cc.codes.Del(code)
+			if cc.removeUser != nil {
+				cc.removeUser(username)
+			} else {
+				cc.state.RemoveUser(username)
+			}
+			removed = append(removed, username)
+		}
+	}
+	return removed
+}
+
+// Run Sweep in the background, at the given interval.
+// An interval of 0 stops the background sweep.
+func (cc *ConfirmationCodes) SweepEvery(interval, maxAge time.Duration) {
+	cc.mut.Lock()
+	defer cc.mut.Unlock()
+	if cc.stop != nil {
+		close(cc.stop)
+		cc.stop = nil
+	}
+	if interval <= 0 {
+		return
+	}
+	stop := make(chan struct{})
+	cc.stop = stop
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				cc.Sweep(maxAge)
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// How long ago the confirmation code of an unconfirmed user was created
+func ConfirmationCodeAge(state pinterface.IUserState, username string) (time.Duration, error) {
+	code, err := state.ConfirmationCode(username)
+	if err != nil {
+		return 0, err
+	}
+	codes, err := state.Creator().NewHashMap("confirmationCodes")
+	if err != nil {
+		return 0, err
+	}
+	return (&ConfirmationCodes{state: state, codes: codes}).age(code)
+}
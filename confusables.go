@@ -0,0 +1,107 @@
+package siteengines
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/xyproto/pinterface"
+)
+
+// This part finds usernames that look like other usernames, like "admin" and "adrnin"
+
+// Characters that look alike, from the confusables in Unicode TR39, mapped to
+// a lowercase prototype. Only the letters and digits that ValidUsernamePassword
+// allows in usernames are included. The Norwegian letters æ, ø and å are kept as
+// they are, so that ie. "bob" and "bøb" are different users.
+var confusables = map[rune]string{
+	'0': "o", '1': "l",
+	'm': "rn", 'd': "cl", 'w': "vv",
+}
+
+// Replace each rune that is found in the table
+func mapRunes(s string, table map[rune]string) string {
+	var sb strings.Builder
+	for _, r := range s {
+		if replacement, ok := table[r]; ok {
+			sb.WriteString(replacement)
+		} else {
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// The skeleton of a username, which is the same for usernames that look alike.
+// Case is folded before looking up the confusable characters.
+func UsernameSkeleton(username string) string {
+	return mapRunes(strings.ToLower(username), confusables)
+}
+
+// An index of the skeletons of all usernames, and a list of reserved usernames
+type UsernameSkeletons struct {
+	state     pinterface.IUserState
+	skeletons pinterface.IKeyValue // The skeletons, with a username as the value
+	reserved  []string
+	mut       sync.RWMutex
+}
+
+func NewUsernameSkeletons(state pinterface.IUserState) (*UsernameSkeletons, error) {
+	skeletons, err := state.Creator().NewKeyValue("usernameSkeletons")
+	if err != nil {
+		return nil, err
+	}
+	us := &UsernameSkeletons{state: state, skeletons: skeletons, reserved: []string{"admin"}}
+	// Index the users that registered before there was an index
+	if usernames, err := state.AllUsernames(); err == nil {
+		for _, username := range usernames {
+			if _, err := skeletons.Get(UsernameSkeleton(username)); err != nil {
+				skeletons.Set(UsernameSkeleton(username), username)
+			}
+		}
+	}
+	return us, nil
+}
+
+// Set the usernames that no other username may look like. The default is "admin".
+func (us *UsernameSkeletons) SetReserved(usernames ...string) {
+	us.mut.Lock()
+	defer us.mut.Unlock()
+	us.reserved = usernames
+}
+
+// Add a username to the index
+func (us *UsernameSkeletons) Add(username string) error {
+	return us.skeletons.Set(UsernameSkeleton(username), username)
+}
+
+// Remove a username from the index
+func (us *UsernameSkeletons) Remove(username string) error {
+	if found, err := us.skeletons.Get(UsernameSkeleton(username)); err != nil || found != username {
+		return nil
+	}
+	return us.skeletons.Del(UsernameSkeleton(username))
+}
+
+// Find a reserved or existing username that looks like the given username.
+// Returns an empty string if there is none.
+func (us *UsernameSkeletons) Confusable(username string) string {
+	skeleton := UsernameSkeleton(username)
+	us.mut.RLock()
+	for _, reserved := range us.reserved {
+		if UsernameSkeleton(reserved) == skeleton {
+			us.mut.RUnlock()
+			return reserved
+		}
+	}
+	us.mut.RUnlock()
+	other, err := us.skeletons.Get(skeleton)
+	if err != nil {
+		return ""
+	}
+	if !us.state.HasUser(other) || UsernameSkeleton(other) != skeleton {
+		// Left behind by a user that has been removed, or by an older version of the table
+		us.skeletons.Del(skeleton)
+		return ""
+	}
+	return other
+}
@@ -0,0 +1,74 @@
+package siteengines
+
+import "testing"
+
+func TestUsernameSkeleton(t *testing.T) {
+	tests := []struct {
+		a, b      string
+		confusing bool
+	}{
+		{"admin", "adrnin", true},
+		{"admin", "ADMIN", true},
+		{"admln", "adm1n", true},
+		{"bob", "b0b", true},
+		{"willy", "vvilly", true},
+		{"clara", "dara", true},
+		{"bob", "rob", false},
+		{"admin", "admln", false},
+		{"bob", "bøb", false}, // Norwegian names are different names
+		{"aase", "åse", false},
+		{"ærlig", "aerlig", false},
+		{"admin", "administrator", false},
+		{"alice", "alicia", false},
+	}
+	for _, test := range tests {
+		if got := UsernameSkeleton(test.a) == UsernameSkeleton(test.b); got != test.confusing {
+			t.Errorf("%s and %s: got %v, expected %v", test.a, test.b, got, test.confusing)
+		}
+	}
+}
+
+func TestUsernameSkeletons(t *testing.T) {
+	state := NewMemoryUserState()
+	us, err := NewUsernameSkeletons(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	us.SetReserved("admin")
+	state.AddUser("bob", "hunter22", "bob@example.com")
+	us.Add("bob")
+	tests := []struct {
+		username, confusable string
+	}{
+		{"adrnin", "admin"},
+		{"B0B", "bob"},
+		{"alice", ""},
+	}
+	for _, test := range tests {
+		if got := us.Confusable(test.username); got != test.confusable {
+			t.Errorf("%s: got %q, expected %q", test.username, got, test.confusable)
+		}
+	}
+	// Removing a look-alike leaves the original in place
+	us.Remove("b0b")
+	if got := us.Confusable("bob"); got != "bob" {
+		t.Errorf("got %q after removing a look-alike, expected \"bob\"", got)
+	}
+	us.Remove("bob")
+	if got := us.Confusable("b0b"); got != "" {
+		t.Errorf("got %q after removing bob", got)
+	}
+	// Users that are removed without removing the skeleton are not confusable either
+	state.AddUser("carol", "hunter22", "carol@example.com")
+	us.Add("carol")
+	state.RemoveUser("carol")
+	if got := us.Confusable("caro1"); got != "" {
+		t.Errorf("got %q for a removed user", got)
+	}
+	// Skeletons from before æ, ø and å were kept are not used
+	state.AddUser("bøb", "hunter22", "bob@example.com")
+	us.skeletons.Set("bob", "bøb")
+	if got := us.Confusable("bob"); got != "" {
+		t.Errorf("got %q from an old skeleton", got)
+	}
+}
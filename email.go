@@ -0,0 +1,248 @@
+package siteengines
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/xyproto/pinterface"
+)
+
+// How often the same kind of email can be sent to the same address
+const emailLimitDuration = 24 * time.Hour
+
+// The data that is available in the email templates
+type EmailData struct {
+	Site      string   // ie. "archlinux.no"
+	Username  string   //
+	Usernames []string // For the "forgotUsername" email
+	Email     string   // The address the email is sent to
+	Link      string   // What the email is about, ie. a confirmation link
+	NotMeLink string   // For the "Did you not request this?" footer, which is left out if this is empty
+	IP        string   // For the "accountLocked" email
+	Until     string   // For the "accountLocked" email
+	Change    string   // For the "accountChanged" email, ie. "password changed"
+}
+
+// The subject, plain text and HTML templates for one kind of email
+type emailTemplate struct {
+	subject *texttemplate.Template
+	text    *texttemplate.Template
+	html    *htmltemplate.Template
+}
+
+const (
+	textFooter = `{{if .NotMeLink}}
+--
+Did you not request this email? Click here:
+{{.NotMeLink}}
+{{end}}`
+	htmlFooter = `{{if .NotMeLink}}<hr><p style="font-size: small;">Did you not request this email? <a href="{{.NotMeLink}}">Click here</a>.</p>{{end}}`
+)
+
+var (
+	emailTemplatesMut sync.RWMutex
+	emailTemplates    = make(map[string]*emailTemplate)
+)
+
+func init() {
+	SetEmailTemplate("confirmation",
+		"Welcome, {{.Username}}",
+		`Hi and welcome to {{.Site}}!
+
+Confirm the registration by following this link:
+{{.Link}}
+
+Thank you.
+
+Best regards,
+    The {{.Site}} registration system
+`,
+		`<p>Hi and welcome to {{.Site}}!</p>
+<p>Confirm the registration by following this link:<br><a href="{{.Link}}">{{.Link}}</a></p>
+<p>Thank you.</p>
+<p>Best regards,<br>The {{.Site}} registration system</p>`)
+
+	SetEmailTemplate("passwordReset",
+		"Password reset for {{.Username}}",
+		`Hi {{.Username}},
+
+Someone, hopefully you, asked to reset the password for {{.Username}} at {{.Site}}.
+
+Choose a new password by following this link:
+{{.Link}}
+
+The link can only be used once, and expires in one hour.
+
+Best regards,
+    The {{.Site}} registration system
+`,
+		`<p>Hi {{.Username}},</p>
+<p>Someone, hopefully you, asked to reset the password for {{.Username}} at {{.Site}}.</p>
+<p>Choose a new password by following this link:<br><a href="{{.Link}}">{{.Link}}</a></p>
+<p>The link can only be used once, and expires in one hour.</p>
+<p>Best regards,<br>The {{.Site}} registration system</p>`)
+
+	SetEmailTemplate("forgotUsername",
+		"Your username at {{.Site}}",
+		`Hi,
+
+Someone, hopefully you, asked for the usernames that are registered with {{.Email}} at {{.Site}}.
+{{range .Usernames}}
+    {{.}}{{end}}
+
+Best regards,
+    The {{.Site}} registration system
+`,
+		`<p>Hi,</p>
+<p>Someone, hopefully you, asked for the usernames that are registered with {{.Email}} at {{.Site}}.</p>
+<ul>{{range .Usernames}}<li>{{.}}</li>{{end}}</ul>
+<p>Best regards,<br>The {{.Site}} registration system</p>`)
+
+	SetEmailTemplate("accountLocked",
+		"Your account at {{.Site}} has been locked",
+		`Hi {{.Username}},
+
+There have been too many failed logins for {{.Username}} at {{.Site}}, the last one from {{.IP}}.
+The account has been locked until {{.Until}}.
+
+If this was not you, someone may be trying to guess your password.
+You can choose a new password by following this link:
+{{.Link}}
+
+Best regards,
+    The {{.Site}} registration system
+`,
+		`<p>Hi {{.Username}},</p>
+<p>There have been too many failed logins for {{.Username}} at {{.Site}}, the last one from {{.IP}}.<br>
+The account has been locked until {{.Until}}.</p>
+<p>If this was not you, someone may be trying to guess your password.<br>
+You can choose a new password by following this link:<br><a href="{{.Link}}">{{.Link}}</a></p>
+<p>Best regards,<br>The {{.Site}} registration system</p>`)
+
+	SetEmailTemplate("emailChange",
+		"Confirm your new email address at {{.Site}}",
+		`Hi {{.Username}},
+
+Someone, hopefully you, asked to use {{.Email}} as the email address for {{.Username}} at {{.Site}}.
+
+Confirm the new address by following this link:
+{{.Link}}
+
+Best regards,
+    The {{.Site}} registration system
+`,
+		`<p>Hi {{.Username}},</p>
+<p>Someone, hopefully you, asked to use {{.Email}} as the email address for {{.Username}} at {{.Site}}.</p>
+<p>Confirm the new address by following this link:<br><a href="{{.Link}}">{{.Link}}</a></p>
+<p>Best regards,<br>The {{.Site}} registration system</p>`)
+
+	SetEmailTemplate("accountChanged",
+		"Your account at {{.Site}} has been changed",
+		`Hi {{.Username}},
+
+This is to let you know about a change to {{.Username}} at {{.Site}}, from {{.IP}}:
+    {{.Change}}
+
+If this was not you, choose a new password by following this link:
+{{.Link}}
+
+Best regards,
+    The {{.Site}} registration system
+`,
+		`<p>Hi {{.Username}},</p>
+<p>This is to let you know about a change to {{.Username}} at {{.Site}}, from {{.IP}}:<br>{{.Change}}</p>
+<p>If this was not you, choose a new password by following this link:<br><a href="{{.Link}}">{{.Link}}</a></p>
+<p>Best regards,<br>The {{.Site}} registration system</p>`)
+}
+
+// Replace the templates for one kind of email, ie. "confirmation", "passwordReset", "forgotUsername",
+// "accountLocked", "emailChange" or "accountChanged".
+// See EmailData for the available fields. The "Did you not request this?" footer is added to both versions.
+func SetEmailTemplate(name, subject, text, html string) error {
+	subjectTemplate, err := texttemplate.New(name).Parse(subject)
+	if err != nil {
+		return err
+	}
+	textTemplate, err := texttemplate.New(name).Parse(text + textFooter)
+	if err != nil {
+		return err
+	}
+	htmlTemplate, err := htmltemplate.New(name).Parse(html + htmlFooter)
+	if err != nil {
+		return err
+	}
+	emailTemplatesMut.Lock()
+	defer emailTemplatesMut.Unlock()
+	emailTemplates[name] = &emailTemplate{subjectTemplate, textTemplate, htmlTemplate}
+	return nil
+}
+
+// Build an email from the templates with the given name, and send it
+func sendTemplateEmail(mailer Mailer, name string, data *EmailData) error {
+	emailTemplatesMut.RLock()
+	t, ok := emailTemplates[name]
+	emailTemplatesMut.RUnlock()
+	if !ok {
+		panic("ERROR: No email template named " + name)
+	}
+	var subject, text, html bytes.Buffer
+	if err := t.subject.Execute(&subject, data); err != nil {
+		return err
+	}
+	if err := t.text.Execute(&text, data); err != nil {
+		return err
+	}
+	if err := t.html.Execute(&html, data); err != nil {
+		return err
+	}
+	return mailer.Send(&EmailMessage{
+		FromName: data.Site,
+		From:     "noreply@" + data.Site,
+		To:       data.Email,
+		Subject:  strings.TrimSpace(subject.String()),
+		Text:     text.String(),
+		HTML:     html.String(),
+	})
+}
+
+// Keeps track of when each kind of email was last sent to each address
+type emailLimits struct {
+	sent pinterface.IHashMap // Email addresses, with the kind of email as the key and the time as the value
+	mut  sync.Mutex
+}
+
+func newEmailLimits(state pinterface.IUserState) (*emailLimits, error) {
+	sent, err := state.Creator().NewHashMap("emailLimits")
+	if err != nil {
+		return nil, err
+	}
+	return &emailLimits{sent: sent}, nil
+}
+
+// Check if an email of the given kind can be sent to the address.
+// If it can, it is counted as sent.
+func (el *emailLimits) allow(kind, email string) bool {
+	email = strings.ToLower(strings.TrimSpace(email))
+	el.mut.Lock()
+	defer el.mut.Unlock()
+	if last, err := el.sent.Get(email, kind); err == nil {
+		if when, err := time.Parse(time.RFC3339, last); err == nil && time.Since(when) < emailLimitDuration {
+			return false
+		}
+	}
+	return el.sent.Set(email, kind, time.Now().UTC().Format(time.RFC3339)) == nil
+}
+
+// Forget everything that has been sent to an address
+func (el *emailLimits) forgetAddress(email string) {
+	el.sent.Del(strings.ToLower(strings.TrimSpace(email)))
+}
+
+// Don't count an email as sent after all, ie. if sending failed
+func (el *emailLimits) forget(kind, email string) {
+	el.sent.DelKey(strings.ToLower(strings.TrimSpace(email)), kind)
+}
@@ -0,0 +1,200 @@
+package siteengines
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/mux"
+	. "github.com/xyproto/genericsite"
+	"github.com/xyproto/pinterface"
+)
+
+// An Engine is a specific piece of a website, like the chat or the wiki.
+// All the engines in this package qualify as an Engine.
+type Engine interface {
+	// A short, unique and lowercase name, ie. "chat"
+	Name() string
+	// Menu links on the form "Chat:/chat"
+	MenuLinks() []string
+	// The CSS that is specific for this engine
+	GenerateCSS(cs *ColorScheme) StringHandle
+	// Register all the pages of the engine
+	ServeEngine(r *mux.Router, ec *EngineConfig)
+}
+
+// Engines that can be searched by the search engine
+type Searchable interface {
+	// Search for the given text, which is already trimmed and in lowercase
+	Search(searchText string) []SearchResult
+}
+
+// Engines that can add information to the administrator dashboard
+type AdminPanel interface {
+	// Return HTML for the dashboard. Only called when the request has admin rights.
+	AdminStatus(req *http.Request) string
+}
+
+// Engines that can hold content until it has been approved by the moderation engine
+type Moderated interface {
+	// Register the kinds of content the engine can hold, with ModerationEngine.Handle
+	SetModeration(me *ModerationEngine)
+}
+
+// Engines that hold data about users, for exporting and erasing it when a user asks
+type PersonalData interface {
+	// Everything the engine holds about the user, in a form that can be encoded as JSON
+	ExportPersonalData(username string) (interface{}, error)
+	// Delete or anonymize everything the engine holds about the user
+	ErasePersonalData(username string) error
+}
+
+// Everything an engine may need when serving pages
+type EngineConfig struct {
+	BaseCP      BaseCP
+	MenuEntries MenuEntries
+	Site        string         // ie. "archlinux.no", used for sending emails
+	Pages       PageCollection // The static pages of the site, for searching
+	Engines     []Engine       // All enabled engines, for using the optional hooks
+	Mailer      Mailer         // For sending emails, the engines use SMTP to localhost:25 if nil
+}
+
+// Creates an engine, given a user state
+type EngineConstructor func(state pinterface.IUserState) (Engine, error)
+
+var (
+	engineConstructorMut sync.RWMutex
+	engineConstructors   = map[string]EngineConstructor{
+		"admin": func(state pinterface.IUserState) (Engine, error) {
+			e, err := NewAdminEngine(state)
+			if err != nil {
+				return nil, err
+			}
+			return e, nil
+		},
+		"chat": func(state pinterface.IUserState) (Engine, error) {
+			e, err := NewChatEngine(state)
+			if err != nil {
+				return nil, err
+			}
+			return e, nil
+		},
+		"ip": func(state pinterface.IUserState) (Engine, error) {
+			e, err := NewIPEngine(state)
+			if err != nil {
+				return nil, err
+			}
+			return e, nil
+		},
+		"moderation": func(state pinterface.IUserState) (Engine, error) {
+			e, err := NewModerationEngine(state)
+			if err != nil {
+				return nil, err
+			}
+			return e, nil
+		},
+		"search": func(state pinterface.IUserState) (Engine, error) {
+			e, err := NewSearchEngine(state)
+			if err != nil {
+				return nil, err
+			}
+			return e, nil
+		},
+		"timetable": func(state pinterface.IUserState) (Engine, error) {
+			e, err := NewTimeTableEngine(state)
+			if err != nil {
+				return nil, err
+			}
+			return e, nil
+		},
+		"user": func(state pinterface.IUserState) (Engine, error) {
+			e, err := NewUserEngine(state)
+			if err != nil {
+				return nil, err
+			}
+			return e, nil
+		},
+		"wiki": func(state pinterface.IUserState) (Engine, error) {
+			e, err := NewWikiEngine(state)
+			if err != nil {
+				return nil, err
+			}
+			return e, nil
+		},
+	}
+)
+
+// Make an engine available by name, for use with EngineRegistry.Enable.
+// Can also be used for replacing one of the engines in this package.
+func RegisterEngine(name string, constructor EngineConstructor) {
+	engineConstructorMut.Lock()
+	defer engineConstructorMut.Unlock()
+	engineConstructors[name] = constructor
+}
+
+// A collection of enabled engines, in the order they were enabled
+type EngineRegistry struct {
+	state   pinterface.IUserState
+	engines []Engine
+}
+
+func NewEngineRegistry(state pinterface.IUserState) *EngineRegistry {
+	return &EngineRegistry{state: state}
+}
+
+// Create and enable engines by name, ie. "user", "admin", "chat" and "wiki"
+func (er *EngineRegistry) Enable(names ...string) error {
+	for _, name := range names {
+		if _, found := er.Engine(name); found {
+			continue
+		}
+		engineConstructorMut.RLock()
+		constructor, found := engineConstructors[name]
+		engineConstructorMut.RUnlock()
+		if !found {
+			return errors.New("No such engine: " + name)
+		}
+		engine, err := constructor(er.state)
+		if err != nil {
+			return err
+		}
+		er.engines = append(er.engines, engine)
+	}
+	return nil
+}
+
+// Enable an engine that has already been created
+func (er *EngineRegistry) Add(engine Engine) {
+	er.engines = append(er.engines, engine)
+}
+
+// Find an enabled engine by name
+func (er *EngineRegistry) Engine(name string) (Engine, bool) {
+	for _, engine := range er.engines {
+		if engine.Name() == name {
+			return engine, true
+		}
+	}
+	return nil, false
+}
+
+// All enabled engines
+func (er *EngineRegistry) Engines() []Engine {
+	return er.engines
+}
+
+// Menu entries for the given links (ie. "Overview:/"), followed by the links of all enabled engines
+func (er *EngineRegistry) MenuEntries(links ...string) MenuEntries {
+	for _, engine := range er.engines {
+		links = append(links, engine.MenuLinks()...)
+	}
+	return Links2menuEntries(links)
+}
+
+// Serve the pages of all enabled engines
+func (er *EngineRegistry) ServePages(r *mux.Router, ec *EngineConfig) {
+	ec.Engines = er.engines
+	for _, engine := range er.engines {
+		engine.ServeEngine(r, ec)
+	}
+}
@@ -0,0 +1,177 @@
+package siteengines
+
+import (
+	"html"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// This part annotates IP addresses with the country and ASN, from local MaxMind DB files.
+// No network lookups are made.
+
+// How often the database files are checked for changes
+const geoIPCheckInterval = 10 * time.Second
+
+// The country and autonomous system of an IP address
+type GeoIPInfo struct {
+	Country      string // ISO code, ie. "NO"
+	CountryName  string // English name, ie. "Norway"
+	ASN          uint   // ie. 2119
+	Organization string // The owner of the ASN
+}
+
+// A short description, ie. "NO, AS2119 Telenor Norge AS"
+func (info *GeoIPInfo) String() string {
+	s := info.Country
+	if info.ASN != 0 {
+		if s != "" {
+			s += ", "
+		}
+		s += "AS" + strconv.FormatUint(uint64(info.ASN), 10)
+		if info.Organization != "" {
+			s += " " + info.Organization
+		}
+	}
+	return s
+}
+
+// One database file, and when it was loaded
+type geoIPFile struct {
+	filename string
+	modTime  time.Time
+	size     int64
+	reader   *mmdbReader
+}
+
+// Looks up IP addresses in one or more .mmdb files, ie. a country database
+// and an ASN database. The files are reloaded when they change on disk.
+type GeoIP struct {
+	mut       sync.RWMutex
+	files     []*geoIPFile
+	lastCheck time.Time
+}
+
+// Load the given .mmdb files
+func NewGeoIP(filenames ...string) (*GeoIP, error) {
+	g := new(GeoIP)
+	for _, filename := range filenames {
+		file := &geoIPFile{filename: filename}
+		if err := file.load(); err != nil {
+			return nil, err
+		}
+		g.files = append(g.files, file)
+	}
+	g.lastCheck = time.Now()
+	return g, nil
+}
+
+// Read the file, if it has changed since it was last loaded
+func (file *geoIPFile) load() error {
+	fi, err := os.Stat(file.filename)
+	if err != nil {
+		return err
+	}
+	if file.reader != nil && fi.ModTime().Equal(file.modTime) && fi.Size() == file.size {
+		return nil
+	}
+	buf, err := ioutil.ReadFile(file.filename)
+	if err != nil {
+		return err
+	}
+	reader, err := newMMDBReader(buf)
+	if err != nil {
+		return err
+	}
+	file.reader = reader
+	file.modTime = fi.ModTime()
+	file.size = fi.Size()
+	return nil
+}
+
+// Reload the files that have changed. If a file can not be read,
+// for instance while it is being replaced, the old data is kept.
+func (g *GeoIP) reload() {
+	g.mut.RLock()
+	due := time.Since(g.lastCheck) >= geoIPCheckInterval
+	g.mut.RUnlock()
+	if !due {
+		return
+	}
+	g.mut.Lock()
+	defer g.mut.Unlock()
+	if time.Since(g.lastCheck) < geoIPCheckInterval {
+		return
+	}
+	for _, file := range g.files {
+		file.load()
+	}
+	g.lastCheck = time.Now()
+}
+
+// Get a string from nested maps, ie. "country", "names", "en"
+func lookupString(m map[string]interface{}, keys ...string) string {
+	for i, key := range keys {
+		if i == len(keys)-1 {
+			s, _ := m[key].(string)
+			return s
+		}
+		inner, ok := m[key].(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		m = inner
+	}
+	return ""
+}
+
+// Find the country and ASN of an IP address. Returns nil if nothing is known.
+func (g *GeoIP) Lookup(ip string) *GeoIPInfo {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return nil
+	}
+	g.reload()
+	g.mut.RLock()
+	defer g.mut.RUnlock()
+	info := new(GeoIPInfo)
+	for _, file := range g.files {
+		record, err := file.reader.lookup(parsed)
+		if err != nil || record == nil {
+			continue
+		}
+		// GeoIP2 and GeoLite2 country and city databases
+		if country := lookupString(record, "country", "iso_code"); country != "" && info.Country == "" {
+			info.Country = country
+			info.CountryName = lookupString(record, "country", "names", "en")
+		}
+		// GeoIP2 and GeoLite2 ASN databases
+		if asn, ok := record["autonomous_system_number"].(uint64); ok && info.ASN == 0 {
+			info.ASN = uint(asn)
+			info.Organization = lookupString(record, "autonomous_system_organization")
+		}
+	}
+	if info.Country == "" && info.ASN == 0 {
+		return nil
+	}
+	return info
+}
+
+// The IP address, followed by the country and ASN, as HTML
+func (g *GeoIP) Annotate(ip string) string {
+	s := html.EscapeString(ip)
+	if g == nil {
+		return s
+	}
+	if info := g.Lookup(ip); info != nil {
+		title := ""
+		if info.CountryName != "" {
+			title = " title=\"" + html.EscapeString(info.CountryName) + "\""
+		}
+		s += " <span class=\"geoip\"" + title + ">(" + html.EscapeString(info.String()) + ")</span>"
+	}
+	return s
+}
@@ -3,7 +3,7 @@ module github.com/xyproto/siteengines
 go 1.10
 
 require (
-	github.com/hoisie/web v0.1.1-0.20160809141353-a498c022b2c0
+	github.com/gorilla/mux v1.7.3
 	github.com/russross/blackfriday v2.0.0+incompatible
 	github.com/shurcooL/sanitized_anchor_name v1.0.0 // indirect
 	github.com/xyproto/calendar v0.0.0-20200121121400-e88fa386e812
@@ -14,6 +14,5 @@ require (
 	github.com/xyproto/pinterface v0.0.0-20181004125811-9710ef24b684
 	github.com/xyproto/symbolhash v1.0.0
 	github.com/xyproto/webhandle v0.0.0-20200130084443-601d541d9632
-	golang.org/x/net v0.0.0-20200114155413-6afb5195e5aa // indirect
-	golang.org/x/sys v0.0.0-20200124204421-9fbb57f87de9 // indirect
+	golang.org/x/crypto v0.0.0-20200128174031-69ecbb4d6d5d
 )
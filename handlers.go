@@ -0,0 +1,47 @@
+package siteengines
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	. "github.com/xyproto/webhandle"
+)
+
+// A handler that returns the generated content as a string.
+// It can be wrapped by a ContentPage with WrapSimpleContextHandle,
+// or be served directly since it is also a http.Handler.
+type StringHandle func(w http.ResponseWriter, req *http.Request) string
+
+// Serve the string that is returned by the StringHandle
+func (sh StringHandle) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	Ret(w, sh(w, req))
+}
+
+// Write the given value as JSON, with the given HTTP status code
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Write a JSON error message, with the given HTTP status code
+func writeJSONError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, map[string]string{"error": msg})
+}
+
+// Get the token from an "Authorization: Bearer" header, or an empty string
+func bearerToken(req *http.Request) string {
+	const prefix = "Bearer "
+	auth := req.Header.Get("Authorization")
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return ""
+	}
+	return strings.TrimSpace(auth[len(prefix):])
+}
+
+// Compare two secrets without leaking timing information
+func equalSecrets(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
@@ -0,0 +1,498 @@
+package siteengines
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	. "github.com/xyproto/genericsite"
+	"github.com/xyproto/pinterface"
+	. "github.com/xyproto/webhandle"
+)
+
+// This part is about invite links, for sites where registration is by invitation only
+
+var (
+	inviteOnlyErr = errors.New("Registration is by invitation only.")
+	noInviteErr   = errors.New("The invitation is invalid, used up or has expired.")
+)
+
+// An invite link that can be used a limited number of times before it expires
+type Invite struct {
+	ID      string // The hash of the token, the token itself is only in the link
+	By      string
+	Created time.Time
+	Expires time.Time
+	MaxUses int
+	Uses    int
+	Users   []string // The users that have registered with the invite
+}
+
+// Check if the invite can still be used
+func (invite *Invite) Valid(now time.Time) bool {
+	return invite.Uses < invite.MaxUses && now.Before(invite.Expires)
+}
+
+type Invites struct {
+	invites  pinterface.IHashMap // The invite IDs, with "by", "created", "expires", "maxuses", "uses" and "users" fields
+	inviters pinterface.ISet     // Users that can invite, in addition to the administrators
+	state    pinterface.IUserState
+	mut      sync.Mutex // So that an invite is not used more times than allowed
+}
+
+func NewInvites(state pinterface.IUserState) (*Invites, error) {
+	creator := state.Creator()
+	invites := &Invites{state: state}
+	if invitesHashMap, err := creator.NewHashMap("invites"); err != nil {
+		return nil, err
+	} else {
+		invites.invites = invitesHashMap
+	}
+	if invitersSet, err := creator.NewSet("inviters"); err != nil {
+		return nil, err
+	} else {
+		invites.inviters = invitersSet
+	}
+	return invites, nil
+}
+
+// Check if a user can create invites, which administrators and inviters can
+func (invites *Invites) CanInvite(username string) bool {
+	if username == "" {
+		return false
+	}
+	if invites.state.IsAdmin(username) {
+		return true
+	}
+	has, err := invites.inviters.Has(username)
+	return err == nil && has
+}
+
+func (invites *Invites) AddInviter(username string) error {
+	return invites.inviters.Add(username)
+}
+
+func (invites *Invites) RemoveInviter(username string) error {
+	return invites.inviters.Del(username)
+}
+
+// Create an invite, and return the token for the link
+func (invites *Invites) Create(by string, maxUses int, duration time.Duration) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	id := hashToken(token)
+	now := time.Now().UTC()
+	fields := [][2]string{
+		{"by", by},
+		{"created", now.Format(time.RFC3339)},
+		{"expires", now.Add(duration).Format(time.RFC3339)},
+		{"maxuses", strconv.Itoa(maxUses)},
+		{"uses", "0"},
+	}
+	for _, field := range fields {
+		if err := invites.invites.Set(id, field[0], field[1]); err != nil {
+			return "", err
+		}
+	}
+	return token, nil
+}
+
+// Get an invite by ID
+func (invites *Invites) Get(id string) (*Invite, error) {
+	by, err := invites.invites.Get(id, "by")
+	if err != nil {
+		return nil, noInviteErr
+	}
+	invite := &Invite{ID: id, By: by}
+	if created, err := invites.invites.Get(id, "created"); err == nil {
+		invite.Created, _ = time.Parse(time.RFC3339, created)
+	}
+	if expires, err := invites.invites.Get(id, "expires"); err == nil {
+		invite.Expires, _ = time.Parse(time.RFC3339, expires)
+	}
+	if maxUses, err := invites.invites.Get(id, "maxuses"); err == nil {
+		invite.MaxUses, _ = strconv.Atoi(maxUses)
+	}
+	if uses, err := invites.invites.Get(id, "uses"); err == nil {
+		invite.Uses, _ = strconv.Atoi(uses)
+	}
+	if users, err := invites.invites.Get(id, "users"); err == nil && users != "" {
+		invite.Users = strings.Split(users, ",")
+	}
+	return invite, nil
+}
+
+// Find the invite for a token from a link, if it can still be used
+func (invites *Invites) Find(token string) (*Invite, error) {
+	invite, err := invites.Get(hashToken(token))
+	if err != nil {
+		return nil, err
+	}
+	if !invite.Valid(time.Now()) {
+		return nil, noInviteErr
+	}
+	return invite, nil
+}
+
+// All invites, newest first
+func (invites *Invites) All() ([]*Invite, error) {
+	ids, err := invites.invites.All()
+	if err != nil {
+		return nil, err
+	}
+	var all []*Invite
+	for _, id := range ids {
+		if invite, err := invites.Get(id); err == nil {
+			all = append(all, invite)
+		}
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Created.After(all[j].Created)
+	})
+	return all, nil
+}
+
+// Count one use of an invite, by the given new user
+func (invites *Invites) Use(token, username string) error {
+	invites.mut.Lock()
+	defer invites.mut.Unlock()
+	invite, err := invites.Find(token)
+	if err != nil {
+		return err
+	}
+	if err := invites.invites.Set(invite.ID, "uses", strconv.Itoa(invite.Uses+1)); err != nil {
+		return err
+	}
+	return invites.invites.Set(invite.ID, "users", strings.Join(append(invite.Users, username), ","))
+}
+
+// Make an invite stop working
+func (invites *Invites) Revoke(id string) error {
+	return invites.invites.Del(id)
+}
+
+// The invites a user has created, and the invite the user registered with, if any
+func (invites *Invites) ForUser(username string) (created []*Invite, usedBy *Invite, err error) {
+	all, err := invites.All()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, invite := range all {
+		if invite.By == username {
+			created = append(created, invite)
+		}
+		for _, user := range invite.Users {
+			if user == username {
+				usedBy = invite
+			}
+		}
+	}
+	return created, usedBy, nil
+}
+
+// Remove the invites a user has created, and the user from the invites that
+// were used for registering. The number of uses is kept.
+func (invites *Invites) ForgetUser(username string) error {
+	invites.mut.Lock()
+	defer invites.mut.Unlock()
+	created, usedBy, err := invites.ForUser(username)
+	if err != nil {
+		return err
+	}
+	for _, invite := range created {
+		invites.Revoke(invite.ID)
+	}
+	if usedBy != nil && usedBy.By != username {
+		var users []string
+		for _, user := range usedBy.Users {
+			if user != username {
+				users = append(users, user)
+			}
+		}
+		invites.invites.Set(usedBy.ID, "users", strings.Join(users, ","))
+	}
+	return invites.RemoveInviter(username)
+}
+
+// Only allow registration with invite links
+func (ue *UserEngine) SetInviteOnly(inviteOnly bool) {
+	ue.mut.Lock()
+	defer ue.mut.Unlock()
+	ue.inviteOnly = inviteOnly
+}
+
+func (ue *UserEngine) InviteOnly() bool {
+	ue.mut.RLock()
+	defer ue.mut.RUnlock()
+	return ue.inviteOnly
+}
+
+func (ue *UserEngine) Invites() *Invites {
+	return ue.invites
+}
+
+// How long invites can be valid, for the form on the invites page
+var inviteDurations = []struct {
+	value, text string
+}{
+	{"24h", "1 day"},
+	{"168h", "1 week"},
+	{"720h", "30 days"},
+}
+
+// List the invites, with a form for creating new ones
+func (ue *UserEngine) GenerateInvitesPage() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		username := LoggedInUsername(ue.state, req)
+		if username == "" || !ue.invites.CanInvite(username) {
+			return "<div class=\"no\">Not allowed to invite users</div>"
+		}
+		admin := HasAdminRights(ue.state, req)
+		s := "<h2>Invites</h2>"
+		s += "<form method=\"POST\" action=\"/invites\">"
+		s += "Can be used <input name=\"maxuses\" value=\"1\" size=\"3\"> times, for "
+		s += "<select name=\"duration\">"
+		for _, d := range inviteDurations {
+			s += "<option value=\"" + d.value + "\">" + d.text + "</option>"
+		}
+		s += "</select> "
+		s += "<input type=\"submit\" value=\"Create invite\">"
+		s += "</form><br />"
+		s += "<table class=\"whitebg\">"
+		s += "<tr><th>Invite</th><th>By</th><th>Created</th><th>Expires</th><th>Used</th><th>Registered users</th><th>Revoke</th></tr>"
+		all, err := ue.invites.All()
+		if err == nil {
+			now := time.Now()
+			rownr := 0
+			for _, invite := range all {
+				// Only administrators can see the invites of others
+				if !admin && invite.By != username {
+					continue
+				}
+				if rownr%2 == 0 {
+					s += "<tr class=\"even\">"
+				} else {
+					s += "<tr class=\"odd\">"
+				}
+				rownr++
+				s += "<td>" + invite.ID[:8] + "</td>"
+				s += "<td>" + invite.By + "</td>"
+				s += "<td>" + invite.Created.Format("2006-01-02 15:04") + "</td>"
+				s += "<td>" + invite.Expires.Format("2006-01-02 15:04") + "</td>"
+				s += "<td>" + strconv.Itoa(invite.Uses) + "/" + strconv.Itoa(invite.MaxUses) + "</td>"
+				s += "<td>" + strings.Join(invite.Users, ", ") + "</td>"
+				if invite.Valid(now) {
+					s += "<td><a class=\"careful\" href=\"/invites/revoke/" + invite.ID + "\">revoke</a></td>"
+				} else {
+					s += "<td>no longer valid</td>"
+				}
+				s += "</tr>"
+			}
+		}
+		s += "</table>"
+		if !admin {
+			return s
+		}
+		s += "<br /><strong>Inviters</strong> (administrators can always invite)<br />"
+		inviters, err := ue.invites.inviters.All()
+		if err == nil {
+			sort.Strings(inviters)
+			for _, inviter := range inviters {
+				s += inviter + " (<a class=\"careful\" href=\"/invites/removeinviter/" + inviter + "\">remove</a>)<br />"
+			}
+		}
+		s += "<form method=\"POST\" action=\"/invites/inviters\">"
+		s += "Username: <input name=\"username\"> "
+		s += "<input type=\"submit\" value=\"Add inviter\">"
+		s += "</form>"
+		return s
+	}
+}
+
+// Create an invite, and show the link. Site is ie. "archlinux.no".
+func (ue *UserEngine) GenerateCreateInvite(site string) StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		username := LoggedInUsername(ue.state, req)
+		if username == "" || !ue.invites.CanInvite(username) {
+			return MessageOKback("Invite", "Not allowed to invite users")
+		}
+		maxUses, err := strconv.Atoi(strings.TrimSpace(req.FormValue("maxuses")))
+		if err != nil || maxUses < 1 {
+			return MessageOKback("Invite", "The number of uses must be a positive number.")
+		}
+		valid := false
+		for _, d := range inviteDurations {
+			if req.FormValue("duration") == d.value {
+				valid = true
+				break
+			}
+		}
+		duration, err := time.ParseDuration(req.FormValue("duration"))
+		if !valid || err != nil {
+			return MessageOKback("Invite", "Invalid duration.")
+		}
+		token, err := ue.invites.Create(username, maxUses, duration)
+		if err != nil {
+			return MessageOKback("Invite", "Could not create the invite.")
+		}
+		link := "https://" + site + "/invite/" + token
+		return MessageOKurl("Invite", "OK, send this link to the people you wish to invite. It is only shown once.<br /><br /><a href=\""+link+"\">"+link+"</a>", "/invites")
+	}
+}
+
+func (ue *UserEngine) GenerateRevokeInvite() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		username := LoggedInUsername(ue.state, req)
+		if username == "" || !ue.invites.CanInvite(username) {
+			return MessageOKback("Revoke invite", "Not allowed to invite users")
+		}
+		invite, err := ue.invites.Get(mux.Vars(req)["id"])
+		if err != nil || (invite.By != username && !HasAdminRights(ue.state, req)) {
+			return MessageOKback("Revoke invite", noInviteErr.Error())
+		}
+		ue.invites.Revoke(invite.ID)
+		return MessageOKurl("Revoke invite", "OK, the invite no longer works.", "/invites")
+	}
+}
+
+func (ue *UserEngine) GenerateAddInviter() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		if !HasAdminRights(ue.state, req) {
+			return MessageOKback("Inviters", "Not logged in as Administrator")
+		}
+		username := FindUsername(ue.state, req.FormValue("username"))
+		if username == "" {
+			return MessageOKback("Inviters", "Can't find user "+CleanUserInput(req.FormValue("username")))
+		}
+		ue.invites.AddInviter(username)
+		return MessageOKurl("Inviters", "OK, "+username+" can now invite users", "/invites")
+	}
+}
+
+func (ue *UserEngine) GenerateRemoveInviter() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		if !HasAdminRights(ue.state, req) {
+			return MessageOKback("Inviters", "Not logged in as Administrator")
+		}
+		username := mux.Vars(req)["username"]
+		ue.invites.RemoveInviter(username)
+		return MessageOKurl("Inviters", "OK, "+CleanUserInput(username)+" can no longer invite users", "/invites")
+	}
+}
+
+// The registration form for invited users
+func (ue *UserEngine) GenerateAcceptInviteForm() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		token := mux.Vars(req)["token"]
+		invite, err := ue.invites.Find(token)
+		if err != nil {
+			return "<div class=\"no\">" + err.Error() + "</div>"
+		}
+		s := "<p>You have been invited by " + invite.By + ". Choose a username and a password.</p>"
+		s += "<form method=\"POST\" action=\"/invite/" + token + "\">"
+		s += "Username: <input name=\"username\"><br />"
+		s += "Password: <input type=\"password\" name=\"password1\"><br />"
+		s += "Confirm password: <input type=\"password\" name=\"password2\"><br />"
+		s += "Email: <input name=\"email\"><br />"
+		s += "<input type=\"submit\" value=\"Register\">"
+		s += "</form>"
+		return s
+	}
+}
+
+// Register an invited user. The invite takes the place of the confirmation email.
+func (ue *UserEngine) GenerateAcceptInvite() StringHandle {
+	state := ue.state
+	bans, err := NewIPBans(state)
+	if err != nil {
+		panic("ERROR: Could not access the IP bans")
+	}
+	return func(w http.ResponseWriter, req *http.Request) string {
+		if ban := bans.Banned(ClientIP(req)); ban != nil {
+			return MessageOKback("Register", ban.Message())
+		}
+		token := mux.Vars(req)["token"]
+		if _, err := ue.invites.Find(token); err != nil {
+			return MessageOKurl("Register", err.Error(), "/")
+		}
+		password1 := req.FormValue("password1")
+		if password1 == "" {
+			return MessageOKback("Register", "Can't register without a password.")
+		}
+		if password1 != req.FormValue("password2") {
+			return MessageOKback("Register", "The password and confirmation password must be equal.")
+		}
+		email := req.FormValue("email")
+		if !strings.Contains(email, "@") || !strings.Contains(email, ".") || strings.Contains(email, " ") || email != CleanUserInput(email) {
+			return MessageOKback("Register", "Please use a valid email address.")
+		}
+		username := req.FormValue("username")
+		if username == "" {
+			return MessageOKback("Register", "Can't register without a username.")
+		}
+		if err := ValidUsernamePassword(username, password1); err != nil {
+			return MessageOKback("Register", err.Error())
+		}
+		if FindUsername(state, username) != "" {
+			return MessageOKback("Register", "That user already exists, try another username.")
+		}
+		if other := ue.skeletons.Confusable(username); other != "" {
+			return MessageOKback("Register", "That username looks too much like "+other+", try another username.")
+		}
+		if err := ue.invites.Use(token, username); err != nil {
+			return MessageOKurl("Register", err.Error(), "/")
+		}
+		state.AddUser(username, password1, email)
+		AddUsernameKey(state, username)
+		ue.skeletons.Add(username)
+		state.MarkConfirmed(username)
+		return MessageOKurl("Registration complete", "Thanks for registering, you can now log in.", "/login")
+	}
+}
+
+// Show how many invites can still be used, for the administrator dashboard
+func (ue *UserEngine) invitesAdminStatus() string {
+	s := "<strong>Invites</strong><br />"
+	if ue.InviteOnly() {
+		s += "Registration is by invitation only. "
+	}
+	all, err := ue.invites.All()
+	if err != nil {
+		return s + "Could not retrieve the invites.<br />"
+	}
+	valid, registered := 0, 0
+	now := time.Now()
+	for _, invite := range all {
+		if invite.Valid(now) {
+			valid++
+		}
+		registered += invite.Uses
+	}
+	return s + strconv.Itoa(valid) + " invites can be used, and " + strconv.Itoa(registered) + " users have registered with an invite. <a href=\"/invites\">Invites</a><br />"
+}
+
+func (ue *UserEngine) ServeInvitePages(r *mux.Router, basecp BaseCP, menuEntries MenuEntries, site string) {
+	invitesCP := basecp(ue.state)
+	invitesCP.ContentTitle = "Invites"
+
+	acceptCP := basecp(ue.state)
+	acceptCP.ContentTitle = "Register"
+
+	tvgf := DynamicMenuFactoryGenerator(menuEntries)
+	tvg := tvgf(ue.state)
+
+	r.HandleFunc("/invites", invitesCP.WrapSimpleContextHandle(r, ue.GenerateInvitesPage(), tvg)).Methods("GET")
+	r.Handle("/invites", ue.GenerateCreateInvite(site)).Methods("POST")
+	r.Handle("/invites/revoke/{id}", ue.GenerateRevokeInvite()).Methods("GET")
+	r.Handle("/invites/inviters", ue.GenerateAddInviter()).Methods("POST")
+	r.Handle("/invites/removeinviter/{username}", ue.GenerateRemoveInviter()).Methods("GET")
+	r.HandleFunc("/invite/{token}", acceptCP.WrapSimpleContextHandle(r, ue.GenerateAcceptInviteForm(), tvg)).Methods("GET")
+	r.Handle("/invite/{token}", ue.GenerateAcceptInvite()).Methods("POST")
+}
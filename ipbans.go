@@ -0,0 +1,490 @@
+package siteengines
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	. "github.com/xyproto/genericsite"
+	"github.com/xyproto/pinterface"
+	. "github.com/xyproto/webhandle"
+)
+
+// This part handles IP bans and the allow list. Both are lists of IPv4 and IPv6 ranges.
+// Addresses on the allow list are never banned.
+
+var invalidCIDRErr = errors.New("Not a valid IP address or CIDR range.")
+
+// A banned IP range
+type IPBan struct {
+	CIDR    string
+	Reason  string
+	By      string    // The administrator that added the ban
+	Created time.Time //
+	Expires time.Time // Never expires if zero
+}
+
+// Check if the ban has expired at the given time
+func (ban *IPBan) Expired(now time.Time) bool {
+	return !ban.Expires.IsZero() && now.After(ban.Expires)
+}
+
+// The size of an IP mask, for grouping the ranges in the index
+type maskSize struct {
+	ones, bits int
+}
+
+// An index of IP ranges. Looking up an address takes one map lookup per distinct mask size,
+// so it stays fast for thousands of ranges.
+type ipRangeIndex struct {
+	masks  []maskSize
+	ranges map[maskSize]map[string]*IPBan // The keys are the masked network addresses
+}
+
+func newIPRangeIndex() *ipRangeIndex {
+	return &ipRangeIndex{ranges: make(map[maskSize]map[string]*IPBan)}
+}
+
+// Add a network to the index
+func (index *ipRangeIndex) add(network *net.IPNet, ban *IPBan) {
+	ones, bits := network.Mask.Size()
+	size := maskSize{ones, bits}
+	networks, ok := index.ranges[size]
+	if !ok {
+		networks = make(map[string]*IPBan)
+		index.ranges[size] = networks
+		index.masks = append(index.masks, size)
+		// Check the most specific ranges first
+		sort.Slice(index.masks, func(i, j int) bool { return index.masks[i].ones > index.masks[j].ones })
+	}
+	networks[string(network.IP)] = ban
+}
+
+// Find the most specific range that contains the given IP address and has not
+// expired at the given time, or nil
+func (index *ipRangeIndex) find(ip net.IP, now time.Time) *IPBan {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	bits := len(ip) * 8
+	for _, size := range index.masks {
+		if size.bits != bits {
+			continue
+		}
+		masked := ip.Mask(net.CIDRMask(size.ones, size.bits))
+		if ban, ok := index.ranges[size][string(masked)]; ok && !ban.Expired(now) {
+			return ban
+		}
+	}
+	return nil
+}
+
+// Parse an IP address or a CIDR range. Single addresses become /32 or /128 ranges.
+func ParseCIDR(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, invalidCIDRErr
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+	_, network, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, invalidCIDRErr
+	}
+	return network, nil
+}
+
+// The IP bans and the allow list, stored in the backend and cached in an index.
+// The index is rebuilt when another IPBans (possibly in another process) has made changes.
+type IPBans struct {
+	mut     sync.RWMutex
+	bans    pinterface.IHashMap  // Banned ranges, with "reason", "by", "created" and "expires" fields
+	allowed pinterface.ISet      // Ranges that are never banned
+	meta    pinterface.IKeyValue // The "version" is increased for every change
+	version string               // The version the index was built from
+	banned  *ipRangeIndex
+	allow   *ipRangeIndex
+}
+
+func NewIPBans(userState pinterface.IUserState) (*IPBans, error) {
+	creator := userState.Creator()
+	ib := new(IPBans)
+	if bansHashMap, err := creator.NewHashMap("ipBans"); err != nil {
+		return nil, err
+	} else {
+		ib.bans = bansHashMap
+	}
+	if allowSet, err := creator.NewSet("ipAllow"); err != nil {
+		return nil, err
+	} else {
+		ib.allowed = allowSet
+	}
+	// Not "ipBans", since "ipBans:version" would be listed as a banned range
+	if metaKeyValue, err := creator.NewKeyValue("ipBansMeta"); err != nil {
+		return nil, err
+	} else {
+		ib.meta = metaKeyValue
+	}
+	// Remove the version that was stored there before
+	if oldKeyValue, err := creator.NewKeyValue("ipBans"); err == nil {
+		oldKeyValue.Del("version")
+	}
+	return ib, nil
+}
+
+// Mark the stored bans as changed, so that all indexes are rebuilt
+func (ib *IPBans) changed() {
+	ib.meta.Inc("version")
+	ib.mut.Lock()
+	ib.banned = nil
+	ib.mut.Unlock()
+}
+
+// Retrieve a stored ban
+func (ib *IPBans) ban(cidr string) (*IPBan, error) {
+	reason, err := ib.bans.Get(cidr, "reason")
+	if err != nil {
+		return nil, err
+	}
+	ban := &IPBan{CIDR: cidr, Reason: reason}
+	ban.By, _ = ib.bans.Get(cidr, "by")
+	if created, err := ib.bans.Get(cidr, "created"); err == nil {
+		ban.Created, _ = time.Parse(time.RFC3339, created)
+	}
+	if expires, err := ib.bans.Get(cidr, "expires"); err == nil && expires != "" {
+		ban.Expires, _ = time.Parse(time.RFC3339, expires)
+	}
+	return ban, nil
+}
+
+// All bans that have not expired, with the most recent first. Expired bans are removed.
+func (ib *IPBans) All() ([]*IPBan, error) {
+	cidrs, err := ib.bans.All()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var bans []*IPBan
+	for _, cidr := range cidrs {
+		ban, err := ib.ban(cidr)
+		if err != nil {
+			continue
+		}
+		if ban.Expired(now) {
+			ib.bans.Del(cidr)
+			continue
+		}
+		bans = append(bans, ban)
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Created.After(bans[j].Created) })
+	return bans, nil
+}
+
+// All ranges on the allow list
+func (ib *IPBans) Allowed() ([]string, error) {
+	return ib.allowed.All()
+}
+
+// Ban an IP address or range. A duration of 0 means that the ban never expires.
+func (ib *IPBans) Ban(cidr, reason, by string, duration time.Duration) error {
+	network, err := ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	cidr = network.String()
+	now := time.Now().UTC()
+	expires := ""
+	if duration > 0 {
+		expires = now.Add(duration).Format(time.RFC3339)
+	}
+	if err := ib.bans.Set(cidr, "reason", reason); err != nil {
+		return err
+	}
+	ib.bans.Set(cidr, "by", by)
+	ib.bans.Set(cidr, "created", now.Format(time.RFC3339))
+	ib.bans.Set(cidr, "expires", expires)
+	ib.changed()
+	return nil
+}
+
+// Remove a ban
+func (ib *IPBans) Unban(cidr string) error {
+	if network, err := ParseCIDR(cidr); err == nil {
+		cidr = network.String()
+	}
+	if err := ib.bans.Del(cidr); err != nil {
+		return err
+	}
+	ib.changed()
+	return nil
+}
+
+// Add an IP address or range to the allow list
+func (ib *IPBans) Allow(cidr string) error {
+	network, err := ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	if err := ib.allowed.Add(network.String()); err != nil {
+		return err
+	}
+	ib.changed()
+	return nil
+}
+
+// Remove an IP address or range from the allow list
+func (ib *IPBans) Disallow(cidr string) error {
+	if network, err := ParseCIDR(cidr); err == nil {
+		cidr = network.String()
+	}
+	if err := ib.allowed.Del(cidr); err != nil {
+		return err
+	}
+	ib.changed()
+	return nil
+}
+
+// Rebuild the indexes from the stored bans, if they have changed
+func (ib *IPBans) refresh() {
+	version, _ := ib.meta.Get("version")
+	ib.mut.RLock()
+	upToDate := ib.banned != nil && ib.version == version
+	ib.mut.RUnlock()
+	if upToDate {
+		return
+	}
+	banned := newIPRangeIndex()
+	if bans, err := ib.All(); err == nil {
+		for _, ban := range bans {
+			if network, err := ParseCIDR(ban.CIDR); err == nil {
+				banned.add(network, ban)
+			}
+		}
+	}
+	allow := newIPRangeIndex()
+	if cidrs, err := ib.Allowed(); err == nil {
+		for _, cidr := range cidrs {
+			if network, err := ParseCIDR(cidr); err == nil {
+				allow.add(network, &IPBan{CIDR: cidr})
+			}
+		}
+	}
+	ib.mut.Lock()
+	ib.banned = banned
+	ib.allow = allow
+	ib.version = version
+	ib.mut.Unlock()
+}
+
+// Find the ban that applies to the given IP address, or nil if it is not banned
+func (ib *IPBans) Banned(ip string) *IPBan {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return nil
+	}
+	ib.refresh()
+	ib.mut.RLock()
+	defer ib.mut.RUnlock()
+	now := time.Now()
+	if ib.allow.find(parsed, now) != nil {
+		return nil
+	}
+	return ib.banned.find(parsed, now)
+}
+
+// A message for banned visitors
+func (ban *IPBan) Message() string {
+	msg := "Your IP address has been banned"
+	if ban.Reason != "" {
+		msg += ": " + ban.Reason
+	}
+	if !ban.Expires.IsZero() {
+		msg += " (until " + ban.Expires.Format("2006-01-02 15:04") + " UTC)"
+	}
+	return msg + "."
+}
+
+// The expiry options for new bans
+var banDurations = []struct {
+	value, text string
+}{
+	{"1h", "1 hour"},
+	{"24h", "1 day"},
+	{"168h", "1 week"},
+	{"720h", "30 days"},
+	{"", "never"},
+}
+
+// List the bans and the allow list, with forms for adding more
+func (ie *IPEngine) GenerateBansPage() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		if !HasAdminRights(ie.state, req) {
+			return "<div class=\"no\">Not logged in as Administrator</div>"
+		}
+		s := "<h2>IP bans</h2>"
+		s += "Your IP address is " + ClientIP(req) + "<br /><br />"
+		s += "<strong>Banned ranges</strong><br />"
+		s += "<table class=\"whitebg\">"
+		s += "<tr><th>Range</th><th>Reason</th><th>Banned by</th><th>Created</th><th>Expires</th><th>Unban</th></tr>"
+		bans, err := ie.bans.All()
+		if err == nil {
+			for rownr, ban := range bans {
+				if rownr%2 == 0 {
+					s += "<tr class=\"even\">"
+				} else {
+					s += "<tr class=\"odd\">"
+				}
+				s += "<td>" + ban.CIDR + "</td>"
+				s += "<td>" + ban.Reason + "</td>"
+				s += "<td>" + ban.By + "</td>"
+				s += "<td>" + ban.Created.Format("2006-01-02 15:04") + "</td>"
+				if ban.Expires.IsZero() {
+					s += "<td>never</td>"
+				} else {
+					s += "<td>" + ban.Expires.Format("2006-01-02 15:04") + "</td>"
+				}
+				s += "<td><a class=\"careful\" href=\"/ipbans/unban/" + ban.CIDR + "\">unban</a></td>"
+				s += "</tr>"
+			}
+		}
+		s += "</table>"
+		s += "<form method=\"POST\" action=\"/ipbans/ban\">"
+		s += "Range: <input name=\"cidr\" placeholder=\"192.0.2.0/24\"> "
+		s += "Reason: <input name=\"reason\"> "
+		s += "Expires: <select name=\"duration\">"
+		for _, duration := range banDurations {
+			s += "<option value=\"" + duration.value + "\">" + duration.text + "</option>"
+		}
+		s += "</select> "
+		s += "<input type=\"submit\" value=\"Ban\">"
+		s += "</form><br />"
+		s += "<strong>Allowed ranges</strong> (never banned)<br />"
+		s += "<table class=\"whitebg\">"
+		s += "<tr><th>Range</th><th>Remove</th></tr>"
+		allowed, err := ie.bans.Allowed()
+		if err == nil {
+			sort.Strings(allowed)
+			for _, cidr := range allowed {
+				s += "<tr>"
+				s += "<td>" + cidr + "</td>"
+				s += "<td><a class=\"careful\" href=\"/ipbans/disallow/" + cidr + "\">remove</a></td>"
+				s += "</tr>"
+			}
+		}
+		s += "</table>"
+		s += "<form method=\"POST\" action=\"/ipbans/allow\">"
+		s += "Range: <input name=\"cidr\" placeholder=\"10.0.0.0/8\"> "
+		s += "<input type=\"submit\" value=\"Allow\">"
+		s += "</form>"
+		return s
+	}
+}
+
+// Add a ban, from the form on the bans page
+func (ie *IPEngine) GenerateAddBan() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		if !HasAdminRights(ie.state, req) {
+			return MessageOKback("Ban", "Not logged in as Administrator")
+		}
+		var duration time.Duration
+		if val := req.FormValue("duration"); val != "" {
+			parsed, err := time.ParseDuration(val)
+			if err != nil || parsed <= 0 {
+				return MessageOKback("Ban", "Invalid expiry time.")
+			}
+			duration = parsed
+		}
+		cidr := req.FormValue("cidr")
+		reason := CleanUserInput(req.FormValue("reason"))
+		if err := ie.bans.Ban(cidr, reason, LoggedInUsername(ie.state, req), duration); err != nil {
+			return MessageOKback("Ban", err.Error())
+		}
+		return MessageOKurl("Ban", "OK, banned "+CleanUserInput(cidr), "/ipbans")
+	}
+}
+
+// Remove a ban
+func (ie *IPEngine) GenerateUnban() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		if !HasAdminRights(ie.state, req) {
+			return MessageOKback("Unban", "Not logged in as Administrator")
+		}
+		cidr := mux.Vars(req)["cidr"]
+		if err := ie.bans.Unban(cidr); err != nil {
+			return MessageOKback("Unban", "Could not remove the ban for "+CleanUserInput(cidr))
+		}
+		return MessageOKurl("Unban", "OK, unbanned "+CleanUserInput(cidr), "/ipbans")
+	}
+}
+
+// Add a range to the allow list, from the form on the bans page
+func (ie *IPEngine) GenerateAllow() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		if !HasAdminRights(ie.state, req) {
+			return MessageOKback("Allow", "Not logged in as Administrator")
+		}
+		cidr := req.FormValue("cidr")
+		if err := ie.bans.Allow(cidr); err != nil {
+			return MessageOKback("Allow", err.Error())
+		}
+		return MessageOKurl("Allow", "OK, "+CleanUserInput(cidr)+" will never be banned", "/ipbans")
+	}
+}
+
+// Remove a range from the allow list
+func (ie *IPEngine) GenerateDisallow() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		if !HasAdminRights(ie.state, req) {
+			return MessageOKback("Allow", "Not logged in as Administrator")
+		}
+		cidr := mux.Vars(req)["cidr"]
+		if err := ie.bans.Disallow(cidr); err != nil {
+			return MessageOKback("Allow", "Could not remove "+CleanUserInput(cidr)+" from the allow list")
+		}
+		return MessageOKurl("Allow", "OK, removed "+CleanUserInput(cidr)+" from the allow list", "/ipbans")
+	}
+}
+
+// Show the number of bans on the administrator dashboard
+func (ie *IPEngine) AdminStatus(req *http.Request) string {
+	s := "<strong>IP bans</strong><br />"
+	bans, err := ie.bans.All()
+	if err != nil {
+		return s + "Could not retrieve the bans.<br />"
+	}
+	allowed, _ := ie.bans.Allowed()
+	s += strconv.Itoa(len(bans)) + " banned ranges, " + strconv.Itoa(len(allowed)) + " allowed ranges. "
+	s += "<a href=\"/ipbans\">Manage IP bans</a><br />"
+	return s
+}
+
+// The pages for administrators, with bans and IP history
+func (ie *IPEngine) ServeAdminPages(r *mux.Router, basecp BaseCP, menuEntries MenuEntries) {
+	bansCP := basecp(ie.state)
+	bansCP.ContentTitle = "IP bans"
+
+	historyCP := basecp(ie.state)
+	historyCP.ContentTitle = "IP history"
+
+	tvgf := DynamicMenuFactoryGenerator(menuEntries)
+	tvg := tvgf(ie.state)
+
+	r.HandleFunc("/iphistory/{username}", historyCP.WrapSimpleContextHandle(r, ie.GenerateIPHistory(), tvg)).Methods("GET")
+	r.HandleFunc("/ipbans", bansCP.WrapSimpleContextHandle(r, ie.GenerateBansPage(), tvg)).Methods("GET")
+	r.Handle("/ipbans/ban", ie.GenerateAddBan()).Methods("POST")
+	r.Handle("/ipbans/allow", ie.GenerateAllow()).Methods("POST")
+	// The ranges contain a slash, ie. /ipbans/unban/192.0.2.0/24
+	r.Handle("/ipbans/unban/{cidr:.+}", ie.GenerateUnban()).Methods("GET")
+	r.Handle("/ipbans/disallow/{cidr:.+}", ie.GenerateDisallow()).Methods("GET")
+}
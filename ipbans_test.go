@@ -0,0 +1,115 @@
+package siteengines
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIPRangeIndex(t *testing.T) {
+	index := newIPRangeIndex()
+	for _, cidr := range []string{"192.0.2.0/24", "192.0.2.128/25", "198.51.100.7", "2001:db8::/32", "2001:db8:1::1"} {
+		network, err := ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		index.add(network, &IPBan{CIDR: cidr})
+	}
+	tests := []struct {
+		ip, cidr string
+	}{
+		{"192.0.2.5", "192.0.2.0/24"},
+		{"192.0.2.200", "192.0.2.128/25"}, // The most specific range
+		{"::ffff:192.0.2.5", "192.0.2.0/24"},
+		{"192.0.3.1", ""},
+		{"198.51.100.7", "198.51.100.7"},
+		{"198.51.100.8", ""},
+		{"2001:db8:ffff::5", "2001:db8::/32"},
+		{"2001:db8:1::1", "2001:db8:1::1"},
+		{"2001:db9::1", ""},
+	}
+	for _, test := range tests {
+		ban := index.find(net.ParseIP(test.ip), time.Now())
+		switch {
+		case ban == nil && test.cidr != "":
+			t.Errorf("%s: not found, expected %s", test.ip, test.cidr)
+		case ban != nil && ban.CIDR != test.cidr:
+			t.Errorf("%s: found %s, expected %q", test.ip, ban.CIDR, test.cidr)
+		}
+	}
+}
+
+func TestParseCIDR(t *testing.T) {
+	tests := []struct {
+		s, network string
+	}{
+		{"192.0.2.1", "192.0.2.1/32"},
+		{" 192.0.2.1/24 ", "192.0.2.0/24"},
+		{"2001:db8::1", "2001:db8::1/128"},
+		{"2001:db8::1/32", "2001:db8::/32"},
+		{"192.0.2.300", ""},
+		{"192.0.2.1/33", ""},
+		{"", ""},
+	}
+	for _, test := range tests {
+		network, err := ParseCIDR(test.s)
+		if test.network == "" {
+			if err != invalidCIDRErr {
+				t.Errorf("%q: got %v, expected an error", test.s, network)
+			}
+			continue
+		}
+		if err != nil || network.String() != test.network {
+			t.Errorf("%q: got %v, %v, expected %s", test.s, network, err, test.network)
+		}
+	}
+}
+
+func TestIPBans(t *testing.T) {
+	ib, err := NewIPBans(NewMemoryUserState())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ib.Ban("192.0.2.0/24", "spam", "admin", 0); err != nil {
+		t.Fatal(err)
+	}
+	// The expiry time is stored with whole seconds, so this ban has expired right away
+	if err := ib.Ban("198.51.100.0/24", "spam", "admin", time.Nanosecond); err != nil {
+		t.Fatal(err)
+	}
+	// An expired ban does not hide a broader ban
+	if err := ib.Ban("192.0.2.128/25", "spam", "admin", time.Nanosecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := ib.Allow("192.0.2.10"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ib.Ban("not an address", "spam", "admin", 0); err == nil {
+		t.Error("an invalid range was banned")
+	}
+	tests := []struct {
+		ip     string
+		banned bool
+	}{
+		{"192.0.2.1", true},
+		{"192.0.2.200", true},   // The expired /25 is skipped
+		{"192.0.2.10", false},   // On the allow list
+		{"198.51.100.1", false}, // Expired
+		{"203.0.113.1", false},
+		{"not an address", false},
+	}
+	for _, test := range tests {
+		if got := ib.Banned(test.ip) != nil; got != test.banned {
+			t.Errorf("%s: got %v, expected %v", test.ip, got, test.banned)
+		}
+	}
+	if bans, _ := ib.All(); len(bans) != 1 || bans[0].CIDR != "192.0.2.0/24" {
+		t.Errorf("got the bans %v", bans)
+	}
+	if err := ib.Unban("192.0.2.0/24"); err != nil {
+		t.Fatal(err)
+	}
+	if ib.Banned("192.0.2.1") != nil {
+		t.Error("still banned after unbanning")
+	}
+}
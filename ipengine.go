@@ -1,56 +1,457 @@
 package siteengines
 
 import (
-	"github.com/hoisie/web"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	. "github.com/xyproto/genericsite"
 	"github.com/xyproto/pinterface"
 	. "github.com/xyproto/webhandle"
 )
 
+var invalidIPErr = errors.New("Not a valid IPv4 or IPv6 address.")
+
 type IPEngine struct {
-	state pinterface.IUserState
-	data  pinterface.IList
+	state     pinterface.IUserState
+	data      pinterface.IList
+	hosts     pinterface.IHashMap // Hostnames that are updated with dyndns2, with "owner" and "ip" fields
+	zones     []string            // The domains that users can add hostnames under, with dyndns2
+	apiToken  string              // For scripts, may be empty
+	bans      *IPBans             // Banned IP ranges and the allow list
+	throttle  *LoginThrottle      // Slows down guessing of passwords with dyndns2, shared with the UserEngine
+	geoIP     *GeoIP              // For showing the country and ASN of addresses, may be nil
+	twoFactor *TwoFactor          // Accounts with two-factor authentication can't use dyndns2
+	hostsMut  sync.Mutex          // So that two users can't claim the same hostname
 }
 
 func NewIPEngine(userState pinterface.IUserState) (*IPEngine, error) {
 
 	creator := userState.Creator()
 
+	ipEngine := new(IPEngine)
+	ipEngine.state = userState
+
 	// Create a RedisList for storing IP adresses
 	if ips, err := creator.NewList("IPs"); err != nil {
 		return nil, err
 	} else {
-		ipEngine := new(IPEngine)
-		ipEngine.state = userState
 		ipEngine.data = ips
-		return ipEngine, nil
 	}
+
+	if hostsHashMap, err := creator.NewHashMap("dyndnsHosts"); err != nil {
+		return nil, err
+	} else {
+		ipEngine.hosts = hostsHashMap
+	}
+
+	if bans, err := NewIPBans(userState); err != nil {
+		return nil, err
+	} else {
+		ipEngine.bans = bans
+	}
+
+	// Counts the failures in the same place as the UserEngine, until ServeEngine can share it
+	if throttle, err := NewLoginThrottle(userState); err != nil {
+		return nil, err
+	} else {
+		ipEngine.throttle = throttle
+	}
+
+	if twoFactor, err := NewTwoFactor(userState); err != nil {
+		return nil, err
+	} else {
+		ipEngine.twoFactor = twoFactor
+	}
+
+	return ipEngine, nil
+}
+
+func (ie *IPEngine) Name() string {
+	return "ip"
+}
+
+// The IP pages are not meant to be in the menu
+func (ie *IPEngine) MenuLinks() []string {
+	return []string{}
+}
+
+// The IP pages are not styled
+func (ie *IPEngine) GenerateCSS(cs *ColorScheme) StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		w.Header().Add("Content-Type", "text/css")
+		return ""
+	}
+}
+
+func (ie *IPEngine) ServeEngine(r *mux.Router, ec *EngineConfig) {
+	for _, engine := range ec.Engines {
+		if ue, ok := engine.(*UserEngine); ok {
+			ie.SetLoginThrottle(ue.LoginThrottle())
+		}
+	}
+	ie.ServePages(r)
+	ie.ServeAdminPages(r, ec.BaseCP, ec.MenuEntries)
+}
+
+// The banned IP ranges and the allow list
+func (ie *IPEngine) Bans() *IPBans {
+	return ie.bans
+}
+
+// Count failed dyndns2 logins with the given throttle, ie. the one from UserEngine.LoginThrottle,
+// so that wrong passwords lock the account the same way as on the login page
+func (ie *IPEngine) SetLoginThrottle(throttle *LoginThrottle) {
+	ie.throttle = throttle
+}
+
+// Parse an IPv4 or IPv6 address and return it on its normalized form
+func NormalizeIP(val string) (string, error) {
+	ip := net.ParseIP(strings.TrimSpace(val))
+	if ip == nil {
+		return "", invalidIPErr
+	}
+	return ip.String(), nil
+}
+
+// Set the token that scripts can use for the API, with an "Authorization: Bearer" header.
+// An empty token disables token access, which is the default.
+func (ie *IPEngine) SetAPIToken(token string) {
+	ie.apiToken = token
+}
+
+// Let users add hostnames under the given domains, ie. "dyn.example.com", by updating them with dyndns2.
+// The first user to update a hostname becomes the owner. With no domains, which is the default,
+// no new hostnames can be added.
+func (ie *IPEngine) SetDynDNSZones(zones ...string) {
+	ie.zones = nil
+	for _, zone := range zones {
+		ie.zones = append(ie.zones, strings.ToLower(strings.Trim(strings.TrimSpace(zone), ".")))
+	}
+}
+
+// Check if a hostname is below one of the domains that users can add hostnames under
+func (ie *IPEngine) inZone(hostname string) bool {
+	for _, zone := range ie.zones {
+		if zone != "" && strings.HasSuffix(hostname, "."+zone) {
+			return true
+		}
+	}
+	return false
+}
+
+// Show the country and ASN of IP addresses on the administrator pages,
+// using local MaxMind DB files, ie. GeoLite2-Country.mmdb and GeoLite2-ASN.mmdb
+func (ie *IPEngine) SetGeoIPDatabases(filenames ...string) error {
+	geoIP, err := NewGeoIP(filenames...)
+	if err != nil {
+		return err
+	}
+	ie.geoIP = geoIP
+	return nil
+}
+
+// Check if the request is from a logged in user, or has a valid API token
+func (ie *IPEngine) authorized(req *http.Request) bool {
+	if username := LoggedInUsername(ie.state, req); username != "" {
+		return true
+	}
+	token := bearerToken(req)
+	return ie.apiToken != "" && token != "" && equalSecrets(token, ie.apiToken)
+}
+
+// Check if the request is from an administrator, or has a valid API token
+func (ie *IPEngine) adminAuthorized(req *http.Request) bool {
+	if HasAdminRights(ie.state, req) {
+		return true
+	}
+	token := bearerToken(req)
+	return ie.apiToken != "" && token != "" && equalSecrets(token, ie.apiToken)
+}
+
+// Record an IP address, given as JSON ({"ip": "..."}) or as the "ip" form value
+func (ie *IPEngine) APIAddIP(w http.ResponseWriter, req *http.Request) {
+	if !ie.authorized(req) {
+		writeJSONError(w, http.StatusUnauthorized, "Not logged in and no valid API token.")
+		return
+	}
+	var val string
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+		var body struct {
+			IP string `json:"ip"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "Invalid JSON.")
+			return
+		}
+		val = body.IP
+	} else {
+		val = req.FormValue("ip")
+	}
+	ip, err := NormalizeIP(val)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := ie.data.Add(ip); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "Could not store the IP address.")
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]string{"ip": ip})
+}
+
+// Return the last recorded IP address
+func (ie *IPEngine) APILastIP(w http.ResponseWriter, req *http.Request) {
+	if !ie.authorized(req) {
+		writeJSONError(w, http.StatusUnauthorized, "Not logged in and no valid API token.")
+		return
+	}
+	ip, err := ie.data.Last()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "Could not retrieve the IP address.")
+		return
+	}
+	if ip == "" {
+		writeJSONError(w, http.StatusNotFound, "No IP address has been recorded.")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"ip": ip})
+}
+
+// Return all recorded IP addresses, oldest first
+func (ie *IPEngine) APIAllIPs(w http.ResponseWriter, req *http.Request) {
+	if !ie.authorized(req) {
+		writeJSONError(w, http.StatusUnauthorized, "Not logged in and no valid API token.")
+		return
+	}
+	iplist, err := ie.data.All()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "Could not retrieve the IP addresses.")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{"ips": iplist})
+}
+
+// Remove all recorded IP addresses. Only for administrators or with an API token.
+func (ie *IPEngine) APIClearIPs(w http.ResponseWriter, req *http.Request) {
+	if !ie.adminAuthorized(req) {
+		writeJSONError(w, http.StatusUnauthorized, "Not logged in as Administrator and no valid API token.")
+		return
+	}
+	if err := ie.data.Clear(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "Could not remove the IP addresses.")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// The IP history for a hostname that is updated with dyndns2, oldest first
+func (ie *IPEngine) HostIPs(hostname string) ([]string, error) {
+	ips, err := ie.state.Creator().NewList("IPs:" + hostname)
+	if err != nil {
+		return nil, err
+	}
+	return ips.All()
+}
+
+// The hostnames owned by a user
+func (ie *IPEngine) userHosts(username string) ([]string, error) {
+	hostnames, err := ie.hosts.All()
+	if err != nil {
+		return nil, err
+	}
+	var owned []string
+	for _, hostname := range hostnames {
+		if owner, err := ie.hosts.Get(hostname, "owner"); err == nil && owner == username {
+			owned = append(owned, hostname)
+		}
+	}
+	return owned, nil
+}
+
+// The hostnames the user updates with dyndns2, with the IP history of each
+func (ie *IPEngine) ExportPersonalData(username string) (interface{}, error) {
+	hostnames, err := ie.userHosts(username)
+	if err != nil {
+		return nil, err
+	}
+	hosts := make(map[string][]string)
+	for _, hostname := range hostnames {
+		if hosts[hostname], err = ie.HostIPs(hostname); err != nil {
+			return nil, err
+		}
+	}
+	return map[string]interface{}{"hosts": hosts}, nil
+}
+
+// Remove the hostnames the user updates with dyndns2, and their IP history
+func (ie *IPEngine) ErasePersonalData(username string) error {
+	ie.hostsMut.Lock()
+	defer ie.hostsMut.Unlock()
+	hostnames, err := ie.userHosts(username)
+	if err != nil {
+		return err
+	}
+	for _, hostname := range hostnames {
+		if ips, err := ie.state.Creator().NewList("IPs:" + hostname); err == nil {
+			ips.Remove()
+		}
+		if err := ie.hosts.Del(hostname); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Check if a hostname looks like a fully qualified domain name
+func validHostname(hostname string) bool {
+	if len(hostname) > 253 || !strings.Contains(hostname, ".") {
+		return false
+	}
+	for _, label := range strings.Split(hostname, ".") {
+		if label == "" || len(label) > 63 || strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+			return false
+		}
+		for _, letter := range label {
+			if !(letter >= 'a' && letter <= 'z') && !(letter >= '0' && letter <= '9') && letter != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Update one hostname for the given user, returns a dyndns2 return code
+func (ie *IPEngine) updateHost(username, hostname, ip string) string {
+	if !validHostname(hostname) {
+		return "notfqdn"
+	}
+	ie.hostsMut.Lock()
+	defer ie.hostsMut.Unlock()
+	owner, err := ie.hosts.Get(hostname, "owner")
+	if err != nil {
+		// The first user to update a hostname becomes the owner, if it is in one of the zones
+		if !ie.inZone(hostname) {
+			return "nohost"
+		}
+		owner = username
+		if err := ie.hosts.Set(hostname, "owner", owner); err != nil {
+			return "911"
+		}
+	}
+	if owner != username {
+		return "nohost"
+	}
+	if lastIP, err := ie.hosts.Get(hostname, "ip"); err == nil && lastIP == ip {
+		return "nochg " + ip
+	}
+	ips, err := ie.state.Creator().NewList("IPs:" + hostname)
+	if err != nil {
+		return "911"
+	}
+	if err := ips.Add(ip); err != nil {
+		return "911"
+	}
+	ie.hosts.Set(hostname, "ip", ip)
+	return "good " + ip
 }
 
-// Set an IP adress and generate a confirmation page for it
-func (ie *IPEngine) GenerateSetIP() WebHandle {
-	return func(ctx *web.Context, val string) string {
-		if val == "" {
-			return "Empty value, IP not set"
+// Update the IP address of one or more comma separated hostnames, with the dyndns2 protocol.
+// Uses HTTP basic auth with the username and password of a confirmed user,
+// that does not have, and is not required to have, two-factor authentication.
+// Banned and throttled addresses get "abuse", like from dyndns2 services.
+func (ie *IPEngine) GenerateDynDNSUpdate() StringHandle {
+	badauth := func(w http.ResponseWriter) string {
+		w.Header().Set("WWW-Authenticate", "Basic realm=\"dyndns\"")
+		w.WriteHeader(http.StatusUnauthorized)
+		return "badauth"
+	}
+	return func(w http.ResponseWriter, req *http.Request) string {
+		w.Header().Set("Content-Type", "text/plain")
+		clientIP := ClientIP(req)
+		if ie.bans.Banned(clientIP) != nil {
+			return "abuse"
+		}
+		if _, ok := ie.throttle.Wait(clientIP, ""); ok {
+			return "abuse"
+		}
+		username, password, ok := req.BasicAuth()
+		username = FindUsername(ie.state, username)
+		if !ok || username == "" {
+			ie.throttle.Failed(clientIP, "")
+			return badauth(w)
+		}
+		if _, ok := ie.throttle.Wait(clientIP, username); ok {
+			return "abuse"
+		}
+		if !ie.state.IsConfirmed(username) || !ie.state.CorrectPassword(username, password) {
+			ie.throttle.Failed(clientIP, username)
+			return badauth(w)
+		}
+		// Routers can only send the password, which is not enough for these accounts
+		if ie.twoFactor.Enabled(username) || ie.twoFactor.Required(username) {
+			return badauth(w)
+		}
+		ie.throttle.Succeeded(clientIP, username)
+		// Use the address of the client if no IP address is given
+		myip := req.FormValue("myip")
+		if myip == "" {
+			myip = clientIP
 		}
-		ie.data.Add(val)
-		return "OK, set IP to " + val
+		ip, err := NormalizeIP(myip)
+		if err != nil {
+			return "dnserr"
+		}
+		var results []string
+		for _, hostname := range strings.Split(req.FormValue("hostname"), ",") {
+			results = append(results, ie.updateHost(username, strings.ToLower(strings.TrimSpace(hostname)), ip))
+		}
+		return strings.Join(results, "\n")
 	}
 }
 
+// Return the IP history for a hostname. Only for the owner, administrators or with an API token.
+// Hostnames that belong to other users are reported as missing, so that they can't be found this way.
+func (ie *IPEngine) APIHostIPs(w http.ResponseWriter, req *http.Request) {
+	username := LoggedInUsername(ie.state, req)
+	admin := ie.adminAuthorized(req)
+	if username == "" && !admin {
+		writeJSONError(w, http.StatusUnauthorized, "Not logged in and no valid API token.")
+		return
+	}
+	hostname := strings.ToLower(mux.Vars(req)["hostname"])
+	owner, err := ie.hosts.Get(hostname, "owner")
+	if err != nil || (owner != username && !admin) {
+		writeJSONError(w, http.StatusNotFound, "No such hostname.")
+		return
+	}
+	iplist, err := ie.HostIPs(hostname)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "Could not retrieve the IP addresses.")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]string{"ips": iplist})
+}
+
 // Get all the stored IP adresses and generate a page for it
-func (ie *IPEngine) GenerateGetAllIPs() WebHandle {
-	return func(ctx *web.Context, val string) string {
-		username := ie.state.Username(ctx.Request)
+func (ie *IPEngine) GenerateGetAllIPs() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		username := LoggedInUsername(ie.state, req)
 		if username == "" {
 			return "No user logged in"
 		}
-		if !ie.state.IsLoggedIn(username) {
-			return "Not logged in"
-		}
 		s := ""
-		iplist, err := ie.data.GetAll()
+		isAdmin := HasAdminRights(ie.state, req)
+		iplist, err := ie.data.All()
 		if err == nil {
 			for _, val := range iplist {
+				if isAdmin {
+					val = ie.geoIP.Annotate(val)
+				}
 				s += "IP: " + val + "<br />"
 			}
 		}
@@ -59,17 +460,14 @@ func (ie *IPEngine) GenerateGetAllIPs() WebHandle {
 }
 
 // Get the last stored IP adress and generate a page for it
-func (ie *IPEngine) GenerateGetLastIP() WebHandle {
-	return func(ctx *web.Context, val string) string {
-		username := ie.state.Username(ctx.Request)
+func (ie *IPEngine) GenerateGetLastIP() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		username := LoggedInUsername(ie.state, req)
 		if username == "" {
 			return "No user logged in"
 		}
-		if !ie.state.IsLoggedIn(username) {
-			return "Not logged in"
-		}
 		s := ""
-		ip, err := ie.data.GetLast()
+		ip, err := ie.data.Last()
 		if err == nil {
 			s = "IP: " + ip
 		}
@@ -77,9 +475,65 @@ func (ie *IPEngine) GenerateGetLastIP() WebHandle {
 	}
 }
 
-func (ie *IPEngine) ServePages() {
-	// TODO: REST service instead
-	web.Get("/setip/(.*)", ie.GenerateSetIP())
-	web.Get("/getip/(.*)", ie.GenerateGetLastIP())
-	web.Get("/getallips/(.*)", ie.GenerateGetAllIPs())
+// The IP history and login history of a user, for administrators
+func (ie *IPEngine) GenerateIPHistory() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		if !HasAdminRights(ie.state, req) {
+			return "<div class=\"no\">Not logged in as Administrator</div>"
+		}
+		username := FindUsername(ie.state, mux.Vars(req)["username"])
+		if username == "" {
+			return "<div class=\"no\">No such user</div>"
+		}
+		s := "<h2>IP history for " + username + "</h2>"
+		s += "<strong>Addresses</strong><br />"
+		iplist, err := UserIPs(ie.state, username)
+		if err == nil {
+			for _, ip := range iplist {
+				s += ie.geoIP.Annotate(ip) + "<br />"
+			}
+		}
+		s += "<br /><strong>Logins</strong><br />"
+		s += "<table class=\"whitebg\">"
+		s += "<tr><th>Time</th><th>IP</th></tr>"
+		logins, err := LoginHistory(ie.state, username, 50)
+		if err == nil {
+			for i := len(logins) - 1; i >= 0; i-- {
+				s += "<tr>"
+				s += "<td>" + logins[i].When.Format("2006-01-02 15:04") + "</td>"
+				s += "<td>" + ie.geoIP.Annotate(logins[i].IP) + "</td>"
+				s += "</tr>"
+			}
+		}
+		s += "</table>"
+		return s
+	}
+}
+
+// Middleware that records the IP address of logged in users. For the same address,
+// this is only written once per lastSeenInterval, so that CSS and polling are cheap.
+func (ie *IPEngine) RecordClientIPs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if username := LoggedInUsername(ie.state, req); username != "" {
+			RecordUserIP(ie.state, username, ClientIP(req))
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+func (ie *IPEngine) ServePages(r *mux.Router) {
+	r.Use(ie.RecordClientIPs)
+
+	r.Handle("/getip", ie.GenerateGetLastIP()).Methods("GET")
+	r.Handle("/getallips", ie.GenerateGetAllIPs()).Methods("GET")
+
+	// The REST API, returns JSON
+	r.HandleFunc("/api/ips", ie.APIAddIP).Methods("POST")
+	r.HandleFunc("/api/ips", ie.APIAllIPs).Methods("GET")
+	r.HandleFunc("/api/ips", ie.APIClearIPs).Methods("DELETE")
+	r.HandleFunc("/api/ips/last", ie.APILastIP).Methods("GET")
+	r.HandleFunc("/api/hosts/{hostname}/ips", ie.APIHostIPs).Methods("GET")
+
+	// For routers that speak the dyndns2 protocol
+	r.Handle("/nic/update", ie.GenerateDynDNSUpdate()).Methods("GET", "POST")
 }
@@ -0,0 +1,243 @@
+package siteengines
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/xyproto/pinterface"
+	. "github.com/xyproto/webhandle"
+)
+
+// This part slows down guessing of passwords, by counting failed logins
+// per username and per IP address, and by locking accounts for a while.
+
+const (
+	freeLoginFailures   = 3                // Failures before there is any waiting
+	maxLoginDelay       = 15 * time.Minute // The longest wait between attempts
+	loginFailureMemory  = 24 * time.Hour   // How long failures are remembered
+	defaultLockFailures = 10
+	defaultLockDuration = 30 * time.Minute
+)
+
+// A username or IP address that has to wait before logging in again
+type Lockout struct {
+	Key      string // ie. "user:bob" or "ip:192.0.2.1"
+	Failures int
+	Until    time.Time
+	Locked   bool // If the account has been locked, not just slowed down
+}
+
+// The username, or the IP address, the lockout is for
+func (lockout *Lockout) Name() string {
+	return lockout.Key[strings.Index(lockout.Key, ":")+1:]
+}
+
+type LoginThrottle struct {
+	failures     pinterface.IHashMap // "user:" + username or "ip:" + address, with "count", "last", "until" and "locked" fields
+	lockFailures int                 // Failures before an account is locked
+	lockDuration time.Duration
+	mut          sync.Mutex
+}
+
+func NewLoginThrottle(state pinterface.IUserState) (*LoginThrottle, error) {
+	failures, err := state.Creator().NewHashMap("loginFailures")
+	if err != nil {
+		return nil, err
+	}
+	return &LoginThrottle{failures: failures, lockFailures: defaultLockFailures, lockDuration: defaultLockDuration}, nil
+}
+
+// Lock accounts for the given duration after the given number of failed logins
+func (lt *LoginThrottle) SetLockout(failures int, duration time.Duration) {
+	lt.mut.Lock()
+	defer lt.mut.Unlock()
+	lt.lockFailures = failures
+	lt.lockDuration = duration
+}
+
+func (lt *LoginThrottle) get(key string) *Lockout {
+	lockout := &Lockout{Key: key}
+	if count, err := lt.failures.Get(key, "count"); err == nil {
+		lockout.Failures, _ = strconv.Atoi(count)
+	}
+	if until, err := lt.failures.Get(key, "until"); err == nil {
+		lockout.Until, _ = time.Parse(time.RFC3339, until)
+	}
+	if locked, err := lt.failures.Get(key, "locked"); err == nil {
+		lockout.Locked = locked == "true"
+	}
+	return lockout
+}
+
+// How long to wait after the given number of failures, doubling for each failure
+func loginDelay(failures int) time.Duration {
+	if failures <= freeLoginFailures {
+		return 0
+	}
+	n := uint(failures - freeLoginFailures - 1)
+	if n > 20 {
+		return maxLoginDelay
+	}
+	delay := time.Second << n
+	if delay > maxLoginDelay {
+		return maxLoginDelay
+	}
+	return delay
+}
+
+// Check if the IP address, or the username if given, has to wait before trying again.
+// Returns the time left to wait.
+func (lt *LoginThrottle) Wait(ip, username string) (time.Duration, bool) {
+	var wait time.Duration
+	keys := []string{"ip:" + ip}
+	if username != "" {
+		keys = append(keys, "user:"+username)
+	}
+	now := time.Now()
+	for _, key := range keys {
+		if left := lt.get(key).Until.Sub(now); left > wait {
+			wait = left
+		}
+	}
+	return wait, wait > 0
+}
+
+// Count a failed login for the IP address, and for the username if given.
+// Returns true if the account was locked by this failure.
+func (lt *LoginThrottle) Failed(ip, username string) bool {
+	lt.mut.Lock()
+	defer lt.mut.Unlock()
+	now := time.Now()
+	lt.count("ip:"+ip, now)
+	if username == "" {
+		return false
+	}
+	key := "user:" + username
+	lockout := lt.count(key, now)
+	if lockout.Failures >= lt.lockFailures && !lockout.Locked {
+		lt.failures.Set(key, "locked", "true")
+		lt.failures.Set(key, "until", now.Add(lt.lockDuration).UTC().Format(time.RFC3339))
+		return true
+	}
+	return false
+}
+
+// Count one more failure, and set how long to wait
+func (lt *LoginThrottle) count(key string, now time.Time) *Lockout {
+	lockout := lt.get(key)
+	if last, err := lt.failures.Get(key, "last"); err == nil {
+		if when, err := time.Parse(time.RFC3339, last); err == nil && now.Sub(when) > loginFailureMemory {
+			// Start counting from the beginning
+			lt.failures.Del(key)
+			lockout = &Lockout{Key: key}
+		}
+	}
+	if lockout.Locked && now.After(lockout.Until) {
+		// The lock has run out, so count to a new lock
+		lt.failures.Del(key)
+		lockout = &Lockout{Key: key}
+	}
+	lockout.Failures++
+	lt.failures.Set(key, "count", strconv.Itoa(lockout.Failures))
+	lt.failures.Set(key, "last", now.UTC().Format(time.RFC3339))
+	if !lockout.Locked {
+		lockout.Until = now.Add(loginDelay(lockout.Failures))
+		lt.failures.Set(key, "until", lockout.Until.UTC().Format(time.RFC3339))
+	}
+	return lockout
+}
+
+// Forget the failures of the username after a successful login. The failures of the
+// IP address are kept, so that an attacker can't reset them by logging in to an own account.
+func (lt *LoginThrottle) Succeeded(ip, username string) {
+	lt.failures.Del("user:" + username)
+}
+
+// The usernames and IP addresses that have to wait, longest wait first
+func (lt *LoginThrottle) Lockouts() ([]*Lockout, error) {
+	keys, err := lt.failures.All()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var lockouts []*Lockout
+	for _, key := range keys {
+		if lockout := lt.get(key); lockout.Until.After(now) {
+			lockouts = append(lockouts, lockout)
+		}
+	}
+	sort.Slice(lockouts, func(i, j int) bool {
+		return lockouts[i].Until.After(lockouts[j].Until)
+	})
+	return lockouts, nil
+}
+
+// Let a username or IP address log in again right away
+func (lt *LoginThrottle) Clear(key string) error {
+	return lt.failures.Del(key)
+}
+
+// Format a time to wait for a message, ie. "3 minutes"
+func formatWait(wait time.Duration) string {
+	if wait < time.Minute {
+		return strconv.Itoa(int(wait/time.Second)+1) + " seconds"
+	}
+	return strconv.Itoa(int(wait/time.Minute)+1) + " minutes"
+}
+
+func (ue *UserEngine) LoginThrottle() *LoginThrottle {
+	return ue.throttle
+}
+
+// Count a failed login for the IP address and the username, and tell the owner
+// by email if the account was locked by it. Returns true if the account was locked.
+func (ue *UserEngine) loginFailed(site, ip, username string) bool {
+	if !ue.throttle.Failed(ip, username) {
+		return false
+	}
+	if err := ue.sendAccountLockedEmail(site, username, ip); err != nil {
+		log.Println("Could not send the account locked email to " + username + ": " + err.Error())
+	}
+	return true
+}
+
+// Show the lockouts on the administrator dashboard, with links for clearing them
+func (ue *UserEngine) lockoutsAdminStatus() string {
+	s := "<strong>Login lockouts</strong><br />"
+	lockouts, err := ue.throttle.Lockouts()
+	if err != nil {
+		return s + "Could not retrieve the lockouts.<br />"
+	}
+	if len(lockouts) == 0 {
+		return s + "No usernames or IP addresses are locked out.<br />"
+	}
+	for _, lockout := range lockouts {
+		what := "IP address"
+		if strings.HasPrefix(lockout.Key, "user:") {
+			what = "User"
+			if lockout.Locked {
+				what = "Locked user"
+			}
+		}
+		s += what + " " + CleanUserInput(lockout.Name()) + ", " + strconv.Itoa(lockout.Failures) + " failed logins, until " + lockout.Until.Local().Format("2006-01-02 15:04")
+		s += " (<a class=\"careful\" href=\"/lockouts/clear/" + lockout.Key + "\">clear</a>)<br />"
+	}
+	return s
+}
+
+func (ue *UserEngine) GenerateClearLockout() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		if !HasAdminRights(ue.state, req) {
+			return MessageOKback("Lockouts", "Not logged in as Administrator")
+		}
+		key := mux.Vars(req)["key"]
+		ue.throttle.Clear(key)
+		return MessageOKurl("Lockouts", "OK, "+CleanUserInput(key)+" can log in again.", "/admin")
+	}
+}
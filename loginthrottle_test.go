@@ -0,0 +1,103 @@
+package siteengines
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLoginDelay(t *testing.T) {
+	tests := []struct {
+		failures int
+		delay    time.Duration
+	}{
+		{0, 0},
+		{freeLoginFailures, 0},
+		{freeLoginFailures + 1, time.Second},
+		{freeLoginFailures + 2, 2 * time.Second},
+		{freeLoginFailures + 5, 16 * time.Second},
+		{freeLoginFailures + 10, 512 * time.Second},
+		{freeLoginFailures + 11, maxLoginDelay},
+		{1000, maxLoginDelay},
+	}
+	for _, test := range tests {
+		if delay := loginDelay(test.failures); delay != test.delay {
+			t.Errorf("%d failures: got %v, expected %v", test.failures, delay, test.delay)
+		}
+	}
+}
+
+func TestLoginThrottle(t *testing.T) {
+	lt, err := NewLoginThrottle(NewMemoryUserState())
+	if err != nil {
+		t.Fatal(err)
+	}
+	const ip = "192.0.2.1"
+	for i := 1; i <= freeLoginFailures; i++ {
+		if lt.Failed(ip, "bob") {
+			t.Fatal("locked too early")
+		}
+		if wait, ok := lt.Wait(ip, "bob"); ok {
+			t.Errorf("%d failures: has to wait %v", i, wait)
+		}
+	}
+	lt.Failed(ip, "bob")
+	if wait, ok := lt.Wait(ip, "bob"); !ok || wait > time.Second {
+		t.Errorf("got %v, %v, expected to wait up to a second", wait, ok)
+	}
+	// The IP address has to wait for every username, but the username only from this address
+	if _, ok := lt.Wait(ip, "alice"); !ok {
+		t.Error("the IP address did not have to wait")
+	}
+	if _, ok := lt.Wait("192.0.2.2", "alice"); ok {
+		t.Error("another IP address and username had to wait")
+	}
+	lt.Succeeded(ip, "bob")
+	if _, ok := lt.Wait("192.0.2.2", "bob"); ok {
+		t.Error("the username had to wait after logging in")
+	}
+	// Logging in does not forget the failures of the IP address
+	if _, ok := lt.Wait(ip, "alice"); !ok {
+		t.Error("the IP address did not have to wait after logging in")
+	}
+}
+
+func TestLoginThrottleLock(t *testing.T) {
+	lt, err := NewLoginThrottle(NewMemoryUserState())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Failures from many addresses, so that only the username is counted up to the lock
+	for i := 1; i < defaultLockFailures; i++ {
+		if lt.Failed("192.0.2."+strconv.Itoa(i), "bob") {
+			t.Fatalf("locked after %d failures", i)
+		}
+	}
+	if !lt.Failed("192.0.2.100", "bob") {
+		t.Fatalf("not locked after %d failures", defaultLockFailures)
+	}
+	// Only locked once
+	if lt.Failed("192.0.2.100", "bob") {
+		t.Error("locked again")
+	}
+	wait, ok := lt.Wait("198.51.100.7", "bob")
+	if !ok || wait < defaultLockDuration-time.Minute {
+		t.Errorf("got %v, %v, expected to wait about %v", wait, ok, defaultLockDuration)
+	}
+	lockouts, err := lt.Lockouts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lockouts) == 0 || lockouts[0].Name() != "bob" || !lockouts[0].Locked {
+		t.Errorf("got %+v, expected bob to be locked first", lockouts)
+	}
+	lt.Clear("user:bob")
+	if _, ok := lt.Wait("198.51.100.7", "bob"); ok {
+		t.Error("still locked after clearing")
+	}
+	// Failures without a username only count for the IP address
+	lt.SetLockout(1, time.Hour)
+	if lt.Failed("203.0.113.1", "") {
+		t.Error("locked without a username")
+	}
+}
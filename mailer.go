@@ -0,0 +1,237 @@
+package siteengines
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// This part is about sending emails
+
+var (
+	noTLSErr  = errors.New("The mail server does not support STARTTLS.")
+	headerErr = errors.New("Invalid email address.")
+)
+
+// An email with a plain text and an HTML version
+type EmailMessage struct {
+	FromName string // ie. "archlinux.no"
+	From     string // ie. "noreply@archlinux.no"
+	To       string
+	Subject  string
+	Text     string
+	HTML     string // May be empty
+}
+
+// Something that can send emails
+type Mailer interface {
+	Send(msg *EmailMessage) error
+}
+
+// Write quoted-printable text
+func writeQuotedPrintable(w io.Writer, text string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(text)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// Encode the message as a MIME email
+func (msg *EmailMessage) Bytes() ([]byte, error) {
+	for _, address := range []string{msg.From, msg.To} {
+		if address == "" || strings.ContainsAny(address, "\r\n<>") {
+			return nil, headerErr
+		}
+	}
+	var buf bytes.Buffer
+	buf.WriteString("From: " + mime.QEncoding.Encode("utf-8", msg.FromName) + " <" + msg.From + ">\r\n")
+	buf.WriteString("To: " + msg.To + "\r\n")
+	buf.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", msg.Subject) + "\r\n")
+	buf.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	if id, err := randomToken(); err == nil {
+		domain := msg.From[strings.LastIndex(msg.From, "@")+1:]
+		buf.WriteString("Message-ID: <" + id + "@" + domain + ">\r\n")
+	}
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	if msg.HTML == "" {
+		buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+		buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		if err := writeQuotedPrintable(&buf, msg.Text); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	mw := multipart.NewWriter(&buf)
+	buf.WriteString("Content-Type: multipart/alternative; boundary=" + mw.Boundary() + "\r\n\r\n")
+	parts := []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", msg.Text},
+		{"text/html; charset=utf-8", msg.HTML},
+	}
+	for _, part := range parts {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeQuotedPrintable(pw, part.body); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Sends emails with SMTP, using STARTTLS if the server supports it
+type SMTPMailer struct {
+	Host       string
+	Port       int
+	Username   string // No authentication if empty
+	Password   string
+	RequireTLS bool        // Fail if the server does not support STARTTLS
+	TLSConfig  *tls.Config // May be nil
+}
+
+// Create a mailer for the given SMTP server. The username may be empty.
+// Authentication is only done over TLS, or to localhost.
+func NewSMTPMailer(host string, port int, username, password string) *SMTPMailer {
+	return &SMTPMailer{Host: host, Port: port, Username: username, Password: password}
+}
+
+func (sm *SMTPMailer) Send(msg *EmailMessage) error {
+	data, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+	c, err := smtp.Dial(net.JoinHostPort(sm.Host, strconv.Itoa(sm.Port)))
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		config := sm.TLSConfig
+		if config == nil {
+			config = &tls.Config{ServerName: sm.Host}
+		}
+		if err := c.StartTLS(config); err != nil {
+			return err
+		}
+	} else if sm.RequireTLS {
+		return noTLSErr
+	}
+	if sm.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", sm.Username, sm.Password, sm.Host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(msg.From); err != nil {
+		return err
+	}
+	if err := c.Rcpt(msg.To); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+// Writes emails to a maildir, for development and testing.
+// Each email ends up as a file in the "new" directory.
+type FileMailer struct {
+	Dir     string
+	counter uint64
+}
+
+// Create a mailer that writes to the given maildir, which is created if needed
+func NewFileMailer(dir string) (*FileMailer, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, err
+		}
+	}
+	return &FileMailer{Dir: dir}, nil
+}
+
+func (fm *FileMailer) Send(msg *EmailMessage) error {
+	data, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	b := make([]byte, 4)
+	rand.Read(b)
+	// Unique filenames, as described in the maildir specification
+	filename := fmt.Sprintf("%d.M%dP%dQ%dR%s.%s", time.Now().Unix(), time.Now().Nanosecond()/1000, os.Getpid(), atomic.AddUint64(&fm.counter, 1), hex.EncodeToString(b), strings.Replace(hostname, "/", "_", -1))
+	tmpName := filepath.Join(fm.Dir, "tmp", filename)
+	if err := writeNewFile(tmpName, data); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, filepath.Join(fm.Dir, "new", filename))
+}
+
+// Write a file that only the current user can read
+func writeNewFile(filename string, data []byte) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Only logs the emails, for development
+type LogMailer struct {
+	Logger *log.Logger // Uses the standard logger if nil
+}
+
+func NewLogMailer(logger *log.Logger) *LogMailer {
+	return &LogMailer{logger}
+}
+
+func (lm *LogMailer) Send(msg *EmailMessage) error {
+	if _, err := msg.Bytes(); err != nil {
+		return err
+	}
+	s := "Email to " + msg.To + " from " + msg.From + "\nSubject: " + msg.Subject + "\n\n" + msg.Text
+	if lm.Logger != nil {
+		lm.Logger.Println(s)
+	} else {
+		log.Println(s)
+	}
+	return nil
+}
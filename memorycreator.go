@@ -0,0 +1,572 @@
+package siteengines
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/xyproto/pinterface"
+)
+
+// This part is an in-memory replacement for the Redis backed data structures,
+// for running a site or the engines without a Redis server.
+
+var (
+	notFoundErr  = errors.New("Not found.")
+	notIntErr    = errors.New("The value is not an integer.")
+	wrongTypeErr = errors.New("The key holds another type of value.")
+)
+
+// Creates data structures that live in memory and can be snapshot to a file.
+// All the data structures share the same lock, so they are goroutine-safe.
+//
+// Like for Redis and simpleredis, all the data structures share one key space.
+// Lists and sets use the id as the key, while hash maps and key/values use
+// "id:element" and "id:key". Using a key for another type of value gives an error.
+type MemoryCreator struct {
+	mut      sync.RWMutex
+	keys     map[string]interface{} // []string, map[string]bool, map[string]string or string
+	filename string                 // Where to store snapshots, may be empty
+}
+
+// The data that is written to and read from snapshot files
+type memorySnapshot struct {
+	Lists   map[string][]string          `json:"lists"`
+	Sets    map[string][]string          `json:"sets"`
+	Hashes  map[string]map[string]string `json:"hashes"`
+	Strings map[string]string            `json:"strings"`
+
+	// Snapshots from before the key space was shared
+	HashMaps  map[string]map[string]map[string]string `json:"hashmaps,omitempty"`
+	KeyValues map[string]map[string]string            `json:"keyvalues,omitempty"`
+}
+
+type (
+	MemoryList struct {
+		mc *MemoryCreator
+		id string
+	}
+	MemorySet struct {
+		mc *MemoryCreator
+		id string
+	}
+	MemoryHashMap struct {
+		mc *MemoryCreator
+		id string
+	}
+	MemoryKeyValue struct {
+		mc *MemoryCreator
+		id string
+	}
+)
+
+// Create a new in-memory data structure creator, without snapshots
+func NewMemoryCreator() *MemoryCreator {
+	return &MemoryCreator{keys: make(map[string]interface{})}
+}
+
+// Create a new in-memory data structure creator that can be saved to the given file.
+// If the file already exists, the previous snapshot is loaded from it.
+func NewMemoryCreatorFile(filename string) (*MemoryCreator, error) {
+	mc := NewMemoryCreator()
+	mc.filename = filename
+	data, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return mc, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var snapshot memorySnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, err
+	}
+	for key, values := range snapshot.Lists {
+		mc.keys[key] = values
+	}
+	for key, values := range snapshot.Sets {
+		set := make(map[string]bool, len(values))
+		for _, value := range values {
+			set[value] = true
+		}
+		mc.keys[key] = set
+	}
+	for key, fields := range snapshot.Hashes {
+		mc.keys[key] = fields
+	}
+	for key, value := range snapshot.Strings {
+		mc.keys[key] = value
+	}
+	// Move the hash maps and key/values of older snapshots into the shared key space
+	for id, owners := range snapshot.HashMaps {
+		for owner, fields := range owners {
+			mc.keys[id+":"+owner] = fields
+		}
+	}
+	for id, kv := range snapshot.KeyValues {
+		for key, value := range kv {
+			mc.keys[id+":"+key] = value
+		}
+	}
+	return mc, nil
+}
+
+// Write all the data to the snapshot file, if one has been given.
+// The file is replaced atomically, so a crash will never leave half a snapshot.
+func (mc *MemoryCreator) Save() error {
+	if mc.filename == "" {
+		return nil
+	}
+	mc.mut.RLock()
+	snapshot := memorySnapshot{
+		Lists:   make(map[string][]string),
+		Sets:    make(map[string][]string),
+		Hashes:  make(map[string]map[string]string),
+		Strings: make(map[string]string),
+	}
+	for key, value := range mc.keys {
+		switch v := value.(type) {
+		case []string:
+			snapshot.Lists[key] = v
+		case map[string]bool:
+			snapshot.Sets[key] = sortedKeys(v)
+		case map[string]string:
+			snapshot.Hashes[key] = v
+		case string:
+			snapshot.Strings[key] = v
+		}
+	}
+	data, err := json.Marshal(snapshot)
+	mc.mut.RUnlock()
+	if err != nil {
+		return err
+	}
+	tmpfile, err := ioutil.TempFile(filepath.Dir(mc.filename), filepath.Base(mc.filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmpfile.Write(data); err != nil {
+		tmpfile.Close()
+		os.Remove(tmpfile.Name())
+		return err
+	}
+	if err := tmpfile.Close(); err != nil {
+		os.Remove(tmpfile.Name())
+		return err
+	}
+	return os.Rename(tmpfile.Name(), mc.filename)
+}
+
+// For qualifying as a pinterface.IHost. There is nothing to connect to.
+func (mc *MemoryCreator) Ping() error {
+	return nil
+}
+
+// Save a snapshot, if a file has been given. For qualifying as a pinterface.IHost.
+func (mc *MemoryCreator) Close() {
+	mc.Save()
+}
+
+func (mc *MemoryCreator) NewList(id string) (pinterface.IList, error) {
+	return &MemoryList{mc, id}, nil
+}
+
+func (mc *MemoryCreator) NewSet(id string) (pinterface.ISet, error) {
+	return &MemorySet{mc, id}, nil
+}
+
+func (mc *MemoryCreator) NewHashMap(id string) (pinterface.IHashMap, error) {
+	return &MemoryHashMap{mc, id}, nil
+}
+
+func (mc *MemoryCreator) NewKeyValue(id string) (pinterface.IKeyValue, error) {
+	return &MemoryKeyValue{mc, id}, nil
+}
+
+// Return the keys of a map, sorted
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// The keys that start with the given prefix, without the prefix, sorted.
+// Like "KEYS prefix*", it does not matter which type the keys hold.
+func (mc *MemoryCreator) keysWithPrefix(prefix string) []string {
+	var keys []string
+	for key := range mc.keys {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key[len(prefix):])
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Get the list at the given key, or nil if there is none. Must be called with the lock.
+func (mc *MemoryCreator) list(key string) ([]string, error) {
+	value, ok := mc.keys[key]
+	if !ok {
+		return nil, nil
+	}
+	list, ok := value.([]string)
+	if !ok {
+		return nil, wrongTypeErr
+	}
+	return list, nil
+}
+
+// Get the set at the given key, or nil if there is none. Must be called with the lock.
+func (mc *MemoryCreator) set(key string) (map[string]bool, error) {
+	value, ok := mc.keys[key]
+	if !ok {
+		return nil, nil
+	}
+	set, ok := value.(map[string]bool)
+	if !ok {
+		return nil, wrongTypeErr
+	}
+	return set, nil
+}
+
+// Get the hash at the given key, or nil if there is none. Must be called with the lock.
+func (mc *MemoryCreator) hash(key string) (map[string]string, error) {
+	value, ok := mc.keys[key]
+	if !ok {
+		return nil, nil
+	}
+	fields, ok := value.(map[string]string)
+	if !ok {
+		return nil, wrongTypeErr
+	}
+	return fields, nil
+}
+
+// Get the string at the given key. Must be called with the lock.
+func (mc *MemoryCreator) str(key string) (string, bool, error) {
+	value, ok := mc.keys[key]
+	if !ok {
+		return "", false, nil
+	}
+	s, ok := value.(string)
+	if !ok {
+		return "", false, wrongTypeErr
+	}
+	return s, true, nil
+}
+
+/* --- List functions --- */
+
+// Add an element to the end of the list
+func (ml *MemoryList) Add(value string) error {
+	ml.mc.mut.Lock()
+	defer ml.mc.mut.Unlock()
+	list, err := ml.mc.list(ml.id)
+	if err != nil {
+		return err
+	}
+	ml.mc.keys[ml.id] = append(list, value)
+	return nil
+}
+
+// Get all elements of the list
+func (ml *MemoryList) All() ([]string, error) {
+	ml.mc.mut.RLock()
+	defer ml.mc.mut.RUnlock()
+	list, err := ml.mc.list(ml.id)
+	return append([]string{}, list...), err
+}
+
+// Get the last element of the list, or an empty string
+func (ml *MemoryList) Last() (string, error) {
+	ml.mc.mut.RLock()
+	defer ml.mc.mut.RUnlock()
+	list, err := ml.mc.list(ml.id)
+	if err != nil || len(list) == 0 {
+		return "", err
+	}
+	return list[len(list)-1], nil
+}
+
+// Get the last N elements of the list
+func (ml *MemoryList) LastN(n int) ([]string, error) {
+	ml.mc.mut.RLock()
+	defer ml.mc.mut.RUnlock()
+	list, err := ml.mc.list(ml.id)
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		n = 0
+	}
+	if n > len(list) {
+		n = len(list)
+	}
+	return append([]string{}, list[len(list)-n:]...), nil
+}
+
+// Remove this list
+func (ml *MemoryList) Remove() error {
+	ml.mc.mut.Lock()
+	defer ml.mc.mut.Unlock()
+	delete(ml.mc.keys, ml.id)
+	return nil
+}
+
+// Clear the contents
+func (ml *MemoryList) Clear() error {
+	return ml.Remove()
+}
+
+/* --- Set functions --- */
+
+// Add an element to the set
+func (ms *MemorySet) Add(value string) error {
+	ms.mc.mut.Lock()
+	defer ms.mc.mut.Unlock()
+	set, err := ms.mc.set(ms.id)
+	if err != nil {
+		return err
+	}
+	if set == nil {
+		set = make(map[string]bool)
+		ms.mc.keys[ms.id] = set
+	}
+	set[value] = true
+	return nil
+}
+
+// Check if a given value is in the set
+func (ms *MemorySet) Has(value string) (bool, error) {
+	ms.mc.mut.RLock()
+	defer ms.mc.mut.RUnlock()
+	set, err := ms.mc.set(ms.id)
+	return set[value], err
+}
+
+// Get all elements of the set, sorted
+func (ms *MemorySet) All() ([]string, error) {
+	ms.mc.mut.RLock()
+	defer ms.mc.mut.RUnlock()
+	set, err := ms.mc.set(ms.id)
+	return sortedKeys(set), err
+}
+
+// Remove an element from the set
+func (ms *MemorySet) Del(value string) error {
+	ms.mc.mut.Lock()
+	defer ms.mc.mut.Unlock()
+	set, err := ms.mc.set(ms.id)
+	if err != nil {
+		return err
+	}
+	delete(set, value)
+	// Like Redis, remove the set when the last element is gone
+	if set != nil && len(set) == 0 {
+		delete(ms.mc.keys, ms.id)
+	}
+	return nil
+}
+
+// Remove this set
+func (ms *MemorySet) Remove() error {
+	ms.mc.mut.Lock()
+	defer ms.mc.mut.Unlock()
+	delete(ms.mc.keys, ms.id)
+	return nil
+}
+
+// Clear the contents
+func (ms *MemorySet) Clear() error {
+	return ms.Remove()
+}
+
+/* --- HashMap functions --- */
+
+// Set a value given the element id (for instance a user id) and the key (for instance "password")
+func (mh *MemoryHashMap) Set(owner, key, value string) error {
+	mh.mc.mut.Lock()
+	defer mh.mc.mut.Unlock()
+	fields, err := mh.mc.hash(mh.id + ":" + owner)
+	if err != nil {
+		return err
+	}
+	if fields == nil {
+		fields = make(map[string]string)
+		mh.mc.keys[mh.id+":"+owner] = fields
+	}
+	fields[key] = value
+	return nil
+}
+
+// Get a value given the element id and the key. Returns an error if it is missing.
+func (mh *MemoryHashMap) Get(owner, key string) (string, error) {
+	mh.mc.mut.RLock()
+	defer mh.mc.mut.RUnlock()
+	fields, err := mh.mc.hash(mh.id + ":" + owner)
+	if err != nil {
+		return "", err
+	}
+	value, ok := fields[key]
+	if !ok {
+		return "", notFoundErr
+	}
+	return value, nil
+}
+
+// Check if a given element id + key is in the hash map
+func (mh *MemoryHashMap) Has(owner, key string) (bool, error) {
+	mh.mc.mut.RLock()
+	defer mh.mc.mut.RUnlock()
+	fields, err := mh.mc.hash(mh.id + ":" + owner)
+	_, ok := fields[key]
+	return ok, err
+}
+
+// Check if a given element id exists in the hash map at all
+func (mh *MemoryHashMap) Exists(owner string) (bool, error) {
+	mh.mc.mut.RLock()
+	defer mh.mc.mut.RUnlock()
+	_, ok := mh.mc.keys[mh.id+":"+owner]
+	return ok, nil
+}
+
+// Get all element ids, sorted. Like for simpleredis, this is every key
+// that starts with the id and a colon, whatever type it holds.
+func (mh *MemoryHashMap) All() ([]string, error) {
+	mh.mc.mut.RLock()
+	defer mh.mc.mut.RUnlock()
+	return mh.mc.keysWithPrefix(mh.id + ":"), nil
+}
+
+// Get all keys for the given element id, sorted
+func (mh *MemoryHashMap) Keys(owner string) ([]string, error) {
+	mh.mc.mut.RLock()
+	defer mh.mc.mut.RUnlock()
+	fields, err := mh.mc.hash(mh.id + ":" + owner)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Remove a key for an element (for instance the email field for a user)
+func (mh *MemoryHashMap) DelKey(owner, key string) error {
+	mh.mc.mut.Lock()
+	defer mh.mc.mut.Unlock()
+	fields, err := mh.mc.hash(mh.id + ":" + owner)
+	if err != nil {
+		return err
+	}
+	delete(fields, key)
+	// Like Redis, remove the element when the last key is gone
+	if fields != nil && len(fields) == 0 {
+		delete(mh.mc.keys, mh.id+":"+owner)
+	}
+	return nil
+}
+
+// Remove an element (for instance a user)
+func (mh *MemoryHashMap) Del(owner string) error {
+	mh.mc.mut.Lock()
+	defer mh.mc.mut.Unlock()
+	delete(mh.mc.keys, mh.id+":"+owner)
+	return nil
+}
+
+// Remove this hash map
+func (mh *MemoryHashMap) Remove() error {
+	mh.mc.mut.Lock()
+	defer mh.mc.mut.Unlock()
+	for _, owner := range mh.mc.keysWithPrefix(mh.id + ":") {
+		delete(mh.mc.keys, mh.id+":"+owner)
+	}
+	return nil
+}
+
+// Clear the contents
+func (mh *MemoryHashMap) Clear() error {
+	return mh.Remove()
+}
+
+/* --- KeyValue functions --- */
+
+// Set a key and value
+func (mkv *MemoryKeyValue) Set(key, value string) error {
+	mkv.mc.mut.Lock()
+	defer mkv.mc.mut.Unlock()
+	// Like Redis SET, this replaces any type of value
+	mkv.mc.keys[mkv.id+":"+key] = value
+	return nil
+}
+
+// Get a value given a key. Returns an error if it is missing.
+func (mkv *MemoryKeyValue) Get(key string) (string, error) {
+	mkv.mc.mut.RLock()
+	defer mkv.mc.mut.RUnlock()
+	value, ok, err := mkv.mc.str(mkv.id + ":" + key)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", notFoundErr
+	}
+	return value, nil
+}
+
+// Remove a key
+func (mkv *MemoryKeyValue) Del(key string) error {
+	mkv.mc.mut.Lock()
+	defer mkv.mc.mut.Unlock()
+	delete(mkv.mc.keys, mkv.id+":"+key)
+	return nil
+}
+
+// Increase the value of a key, returns the new value.
+// A missing key counts as "0", like for Redis.
+func (mkv *MemoryKeyValue) Inc(key string) (string, error) {
+	mkv.mc.mut.Lock()
+	defer mkv.mc.mut.Unlock()
+	value, ok, err := mkv.mc.str(mkv.id + ":" + key)
+	if err != nil {
+		return "0", err
+	}
+	num := int64(0)
+	if ok {
+		num, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return "0", notIntErr
+		}
+	}
+	newValue := strconv.FormatInt(num+1, 10)
+	mkv.mc.keys[mkv.id+":"+key] = newValue
+	return newValue, nil
+}
+
+// Remove this key/value
+func (mkv *MemoryKeyValue) Remove() error {
+	mkv.mc.mut.Lock()
+	defer mkv.mc.mut.Unlock()
+	for _, key := range mkv.mc.keysWithPrefix(mkv.id + ":") {
+		delete(mkv.mc.keys, mkv.id+":"+key)
+	}
+	return nil
+}
+
+// Clear the contents
+func (mkv *MemoryKeyValue) Clear() error {
+	return mkv.Remove()
+}
@@ -0,0 +1,135 @@
+package siteengines
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestMemorySnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "siteengines")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "snapshot.json")
+
+	state, err := NewMemoryUserStateFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.AddUser("bob", "hunter22", "bob@example.com")
+	state.MarkConfirmed("bob")
+	creator := state.Creator()
+	list, _ := creator.NewList("list")
+	list.Add("a")
+	list.Add("b")
+	set, _ := creator.NewSet("set")
+	set.Add("x")
+	set.Add("y")
+	hashMap, _ := creator.NewHashMap("hashmap")
+	hashMap.Set("owner", "key", "value")
+	kv, _ := creator.NewKeyValue("kv")
+	kv.Set("key", "value")
+	state.Host().Close()
+
+	state, err = NewMemoryUserStateFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !state.HasUser("bob") || !state.IsConfirmed("bob") || !state.CorrectPassword("bob", "hunter22") {
+		t.Error("the user was not restored")
+	}
+	creator = state.Creator()
+	list, _ = creator.NewList("list")
+	if values, _ := list.All(); !reflect.DeepEqual(values, []string{"a", "b"}) {
+		t.Errorf("got the list %v", values)
+	}
+	set, _ = creator.NewSet("set")
+	if values, _ := set.All(); !reflect.DeepEqual(values, []string{"x", "y"}) {
+		t.Errorf("got the set %v", values)
+	}
+	hashMap, _ = creator.NewHashMap("hashmap")
+	if value, err := hashMap.Get("owner", "key"); value != "value" {
+		t.Errorf("got %q, %v from the hash map", value, err)
+	}
+	kv, _ = creator.NewKeyValue("kv")
+	if value, err := kv.Get("key"); value != "value" {
+		t.Errorf("got %q, %v from the key/value", value, err)
+	}
+	// No temporary files are left behind
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("got %d files, expected only the snapshot", len(files))
+	}
+	if _, err := NewMemoryUserStateFile(dir); err == nil {
+		t.Error("a directory was read as a snapshot")
+	}
+}
+
+func TestMemoryConcurrentAccess(t *testing.T) {
+	creator := NewMemoryCreator()
+	list, _ := creator.NewList("list")
+	set, _ := creator.NewSet("set")
+	hashMap, _ := creator.NewHashMap("hashmap")
+	kv, _ := creator.NewKeyValue("kv")
+	const goroutines, n = 8, 100
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			owner := "owner" + strconv.Itoa(g)
+			for i := 0; i < n; i++ {
+				list.Add(owner)
+				set.Add(strconv.Itoa(i))
+				hashMap.Set(owner, strconv.Itoa(i), "value")
+				hashMap.Get(owner, strconv.Itoa(i))
+				kv.Inc("counter")
+				creator.Save()
+			}
+		}(g)
+	}
+	wg.Wait()
+	if values, _ := list.All(); len(values) != goroutines*n {
+		t.Errorf("got %d list elements, expected %d", len(values), goroutines*n)
+	}
+	if values, _ := set.All(); len(values) != n {
+		t.Errorf("got %d set elements, expected %d", len(values), n)
+	}
+	if owners, _ := hashMap.All(); len(owners) != goroutines {
+		t.Errorf("got %d hash map owners, expected %d", len(owners), goroutines)
+	}
+	if keys, _ := hashMap.Keys("owner0"); len(keys) != n {
+		t.Errorf("got %d hash map keys, expected %d", len(keys), n)
+	}
+	if value, _ := kv.Get("counter"); value != strconv.Itoa(goroutines*n) {
+		t.Errorf("got the count %s, expected %d", value, goroutines*n)
+	}
+}
+
+func TestMemorySharedKeys(t *testing.T) {
+	creator := NewMemoryCreator()
+	list, _ := creator.NewList("users:bob")
+	list.Add("a")
+	hashMap, _ := creator.NewHashMap("users")
+	if err := hashMap.Set("bob", "key", "value"); err != wrongTypeErr {
+		t.Errorf("got %v, expected an error for using a list as a hash map", err)
+	}
+	kv, _ := creator.NewKeyValue("users")
+	kv.Set("alice", "value")
+	// Like for simpleredis, All returns every key that starts with the id
+	if owners, _ := hashMap.All(); !reflect.DeepEqual(owners, []string{"alice", "bob"}) {
+		t.Errorf("got the hash map owners %v", owners)
+	}
+	if _, err := hashMap.Get("alice", "key"); err != wrongTypeErr {
+		t.Errorf("got %v, expected an error for using a string as a hash map", err)
+	}
+	hashMap.Remove()
+	if values, _ := list.All(); len(values) != 0 {
+		t.Errorf("got the list %v after removing the hash map", values)
+	}
+}
@@ -0,0 +1,406 @@
+package siteengines
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/xyproto/cookie"
+	"github.com/xyproto/pinterface"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// This part is an in-memory user state, for developing sites and engines without Redis.
+// It behaves like the UserState in the permissions2 package.
+
+const maxConfirmationCodeLength = 100 // when are the generated confirmation codes unreasonably long
+
+// Make sure that MemoryUserState qualifies as a pinterface.IUserState
+var _ pinterface.IUserState = &MemoryUserState{}
+
+// A user state where all data is kept by a MemoryCreator
+type MemoryUserState struct {
+	mut                       sync.RWMutex
+	creator                   *MemoryCreator
+	users                     pinterface.IHashMap // Hash map of users, with several different fields per user ("loggedin", "confirmed", "email" etc)
+	usernames                 pinterface.ISet     // A list of all usernames, for easy enumeration
+	unconfirmed               pinterface.ISet     // A list of unconfirmed usernames, for easy enumeration
+	cookieSecret              string              // Secret for storing secure cookies
+	cookieTime                int64               // How long a cookie should last, in seconds
+	passwordAlgorithm         string              // Password hashing algorithm ("sha256", "bcrypt" or "bcrypt+")
+	minConfirmationCodeLength int                 // Minimum length of the confirmation code
+}
+
+// Create a new user state that only lives in memory
+func NewMemoryUserState() *MemoryUserState {
+	return newMemoryUserStateWithCreator(NewMemoryCreator())
+}
+
+// Create a new user state that lives in memory and can be saved to the given file
+// with Host().Close(). If the file already exists, the users are loaded from it.
+func NewMemoryUserStateFile(filename string) (*MemoryUserState, error) {
+	creator, err := NewMemoryCreatorFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return newMemoryUserStateWithCreator(creator), nil
+}
+
+func newMemoryUserStateWithCreator(creator *MemoryCreator) *MemoryUserState {
+	state := new(MemoryUserState)
+	state.creator = creator
+	state.users, _ = creator.NewHashMap("users")
+	state.usernames, _ = creator.NewSet("usernames")
+	state.unconfirmed, _ = creator.NewSet("unconfirmed")
+	state.cookieSecret = cookie.RandomCookieFriendlyString(30)
+	state.cookieTime = cookie.DefaultCookieTime
+	state.passwordAlgorithm = "bcrypt+"
+	state.minConfirmationCodeLength = 20
+	return state
+}
+
+// Checks if the current user is logged in and has user rights
+func (state *MemoryUserState) UserRights(req *http.Request) bool {
+	username, err := state.UsernameCookie(req)
+	if err != nil {
+		return false
+	}
+	return state.IsLoggedIn(username)
+}
+
+func (state *MemoryUserState) HasUser(username string) bool {
+	has, err := state.usernames.Has(username)
+	return err == nil && has
+}
+
+// Returns false if the user or the field is missing
+func (state *MemoryUserState) BooleanField(username, fieldname string) bool {
+	if !state.HasUser(username) {
+		return false
+	}
+	value, err := state.users.Get(username, fieldname)
+	if err != nil {
+		return false
+	}
+	return value == "true"
+}
+
+func (state *MemoryUserState) SetBooleanField(username, fieldname string, val bool) {
+	strval := "false"
+	if val {
+		strval = "true"
+	}
+	state.users.Set(username, fieldname, strval)
+}
+
+func (state *MemoryUserState) IsConfirmed(username string) bool {
+	return state.BooleanField(username, "confirmed")
+}
+
+func (state *MemoryUserState) IsLoggedIn(username string) bool {
+	return state.BooleanField(username, "loggedin")
+}
+
+// Checks if the current user is logged in and has administrator rights
+func (state *MemoryUserState) AdminRights(req *http.Request) bool {
+	username, err := state.UsernameCookie(req)
+	if err != nil {
+		return false
+	}
+	return state.IsLoggedIn(username) && state.IsAdmin(username)
+}
+
+func (state *MemoryUserState) IsAdmin(username string) bool {
+	return state.BooleanField(username, "admin")
+}
+
+// Retrieve the username that is stored in a secure cookie in the browser, if available
+func (state *MemoryUserState) UsernameCookie(req *http.Request) (string, error) {
+	username, ok := cookie.SecureCookie(req, "user", state.CookieSecret())
+	if ok && (username != "") {
+		return username, nil
+	}
+	return "", errors.New("Could not retrieve the username from browser cookie.")
+}
+
+// Store the username in a secure cookie in the browser. The user must exist.
+func (state *MemoryUserState) SetUsernameCookie(w http.ResponseWriter, username string) error {
+	if username == "" {
+		return errors.New("Can't set cookie for empty username.")
+	}
+	if !state.HasUser(username) {
+		return errors.New("Can't store cookie for non-existing user.")
+	}
+	cookie.SetSecureCookiePathWithFlags(w, "user", username, state.CookieTimeout(username), "/", state.CookieSecret(), false, true)
+	return nil
+}
+
+func (state *MemoryUserState) AllUsernames() ([]string, error) {
+	return state.usernames.All()
+}
+
+func (state *MemoryUserState) Email(username string) (string, error) {
+	return state.users.Get(username, "email")
+}
+
+func (state *MemoryUserState) PasswordHash(username string) (string, error) {
+	return state.users.Get(username, "password")
+}
+
+func (state *MemoryUserState) AllUnconfirmedUsernames() ([]string, error) {
+	return state.unconfirmed.All()
+}
+
+func (state *MemoryUserState) ConfirmationCode(username string) (string, error) {
+	return state.users.Get(username, "confirmationCode")
+}
+
+func (state *MemoryUserState) AddUnconfirmed(username, confirmationCode string) {
+	state.unconfirmed.Add(username)
+	state.users.Set(username, "confirmationCode", confirmationCode)
+}
+
+func (state *MemoryUserState) RemoveUnconfirmed(username string) {
+	state.unconfirmed.Del(username)
+	state.users.DelKey(username, "confirmationCode")
+}
+
+func (state *MemoryUserState) MarkConfirmed(username string) {
+	state.users.Set(username, "confirmed", "true")
+}
+
+// Remove the user and all the fields that belong to the user
+func (state *MemoryUserState) RemoveUser(username string) {
+	state.usernames.Del(username)
+	state.unconfirmed.Del(username)
+	state.users.Del(username)
+}
+
+func (state *MemoryUserState) SetAdminStatus(username string) {
+	state.users.Set(username, "admin", "true")
+}
+
+func (state *MemoryUserState) RemoveAdminStatus(username string) {
+	state.users.Set(username, "admin", "false")
+}
+
+// Create a user and hash the password. Does not check for rights.
+func (state *MemoryUserState) AddUser(username, password, email string) {
+	passwordHash := state.HashPassword(username, password)
+	state.usernames.Add(username)
+	state.users.Set(username, "password", passwordHash)
+	state.users.Set(username, "email", email)
+	for _, fieldname := range []string{"loggedin", "confirmed", "admin"} {
+		state.users.Set(username, fieldname, "false")
+	}
+}
+
+func (state *MemoryUserState) SetLoggedIn(username string) {
+	state.users.Set(username, "loggedin", "true")
+}
+
+func (state *MemoryUserState) SetLoggedOut(username string) {
+	state.users.Set(username, "loggedin", "false")
+}
+
+// Log in the user and store the username in a cookie
+func (state *MemoryUserState) Login(w http.ResponseWriter, username string) error {
+	state.SetLoggedIn(username)
+	return state.SetUsernameCookie(w, username)
+}
+
+func (state *MemoryUserState) ClearCookie(w http.ResponseWriter) {
+	cookie.ClearCookie(w, "user", "/")
+}
+
+func (state *MemoryUserState) Logout(username string) {
+	state.SetLoggedOut(username)
+}
+
+// Return the username from the browser cookie, or an empty string
+func (state *MemoryUserState) Username(req *http.Request) string {
+	username, err := state.UsernameCookie(req)
+	if err != nil {
+		return ""
+	}
+	return username
+}
+
+// How long a login cookie should last, in seconds
+func (state *MemoryUserState) CookieTimeout(username string) int64 {
+	state.mut.RLock()
+	defer state.mut.RUnlock()
+	return state.cookieTime
+}
+
+func (state *MemoryUserState) SetCookieTimeout(cookieTime int64) {
+	state.mut.Lock()
+	defer state.mut.Unlock()
+	state.cookieTime = cookieTime
+}
+
+func (state *MemoryUserState) CookieSecret() string {
+	state.mut.RLock()
+	defer state.mut.RUnlock()
+	return state.cookieSecret
+}
+
+func (state *MemoryUserState) SetCookieSecret(cookieSecret string) {
+	state.mut.Lock()
+	defer state.mut.Unlock()
+	state.cookieSecret = cookieSecret
+}
+
+func (state *MemoryUserState) PasswordAlgo() string {
+	state.mut.RLock()
+	defer state.mut.RUnlock()
+	return state.passwordAlgorithm
+}
+
+// Possible values are "bcrypt", "sha256" and "bcrypt+".
+// "bcrypt+" stores passwords with bcrypt, but also accepts old sha256 hashes.
+func (state *MemoryUserState) SetPasswordAlgo(algorithm string) error {
+	switch algorithm {
+	case "sha256", "bcrypt", "bcrypt+":
+		state.mut.Lock()
+		state.passwordAlgorithm = algorithm
+		state.mut.Unlock()
+	default:
+		return errors.New(algorithm + " is an unsupported encryption algorithm.")
+	}
+	return nil
+}
+
+// Hash the password with sha256, using the cookie secret and username as salt
+func (state *MemoryUserState) hashSha256(username, password string) []byte {
+	hasher := sha256.New()
+	io.WriteString(hasher, password+state.CookieSecret()+username)
+	return hasher.Sum(nil)
+}
+
+// Hash the password (the username is used for salting when using sha256)
+func (state *MemoryUserState) HashPassword(username, password string) string {
+	switch state.PasswordAlgo() {
+	case "sha256":
+		return string(state.hashSha256(username, password))
+	case "bcrypt", "bcrypt+":
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			panic("ERROR: bcrypt password hashing unsuccessful")
+		}
+		return string(hash)
+	}
+	return ""
+}
+
+func (state *MemoryUserState) SetPassword(username, password string) {
+	state.users.Set(username, "password", state.HashPassword(username, password))
+}
+
+// Check if a password is correct, without leaking timing information
+func (state *MemoryUserState) CorrectPassword(username, password string) bool {
+	if !state.HasUser(username) {
+		return false
+	}
+	hashString, err := state.PasswordHash(username)
+	if err != nil || hashString == "" {
+		return false
+	}
+	hash := []byte(hashString)
+	correctSha256 := func() bool {
+		comparisonHash := state.hashSha256(username, password)
+		return len(hash) == len(comparisonHash) && subtle.ConstantTimeCompare(hash, comparisonHash) == 1
+	}
+	switch state.PasswordAlgo() {
+	case "sha256":
+		return correctSha256()
+	case "bcrypt":
+		return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+	case "bcrypt+":
+		if len(hash) == sha256.Size && correctSha256() {
+			return true
+		}
+		return bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil
+	}
+	return false
+}
+
+func (state *MemoryUserState) AlreadyHasConfirmationCode(confirmationCode string) bool {
+	_, err := state.FindUserByConfirmationCode(confirmationCode)
+	return err == nil
+}
+
+// Find the unconfirmed user that has the given confirmation code
+func (state *MemoryUserState) FindUserByConfirmationCode(confirmationCode string) (string, error) {
+	unconfirmedUsernames, err := state.AllUnconfirmedUsernames()
+	if err != nil {
+		return "", err
+	}
+	for _, username := range unconfirmedUsernames {
+		aConfirmationCode, err := state.ConfirmationCode(username)
+		if err != nil {
+			continue
+		}
+		if confirmationCode == aConfirmationCode {
+			if !state.HasUser(username) {
+				return username, errors.New("The user that is to be confirmed no longer exists.")
+			}
+			return username, nil
+		}
+	}
+	return "", errors.New("The confirmation code is no longer valid.")
+}
+
+// Remove the user from the list of unconfirmed users and mark the user as confirmed
+func (state *MemoryUserState) Confirm(username string) {
+	state.RemoveUnconfirmed(username)
+	state.MarkConfirmed(username)
+}
+
+func (state *MemoryUserState) ConfirmUserByConfirmationCode(confirmationCode string) error {
+	username, err := state.FindUserByConfirmationCode(confirmationCode)
+	if err != nil {
+		return err
+	}
+	state.Confirm(username)
+	return nil
+}
+
+func (state *MemoryUserState) SetMinimumConfirmationCodeLength(length int) {
+	state.mut.Lock()
+	defer state.mut.Unlock()
+	state.minConfirmationCodeLength = length
+}
+
+// Generate a confirmation code that is not already in use
+func (state *MemoryUserState) GenerateUniqueConfirmationCode() (string, error) {
+	state.mut.RLock()
+	length := state.minConfirmationCodeLength
+	state.mut.RUnlock()
+	confirmationCode := cookie.RandomHumanFriendlyString(length)
+	for state.AlreadyHasConfirmationCode(confirmationCode) {
+		// Increase the length every time there is a collision
+		length++
+		if length > maxConfirmationCodeLength {
+			return "", errors.New("Too many generated confirmation codes are not unique.")
+		}
+		confirmationCode = cookie.RandomHumanFriendlyString(length)
+	}
+	return confirmationCode, nil
+}
+
+func (state *MemoryUserState) Users() pinterface.IHashMap {
+	return state.users
+}
+
+// The MemoryCreator is also the host. Closing it saves a snapshot, if there is a file.
+func (state *MemoryUserState) Host() pinterface.IHost {
+	return state.creator
+}
+
+func (state *MemoryUserState) Creator() pinterface.ICreator {
+	return state.creator
+}
@@ -0,0 +1,271 @@
+package siteengines
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"math/big"
+	"net"
+)
+
+// This part is a small reader for MaxMind DB (.mmdb) files.
+// See https://maxmind.github.io/MaxMind-DB/ for the format.
+
+var (
+	mmdbErr         = errors.New("Invalid MaxMind DB file.")
+	mmdbMetadataTag = []byte("\xab\xcd\xefMaxMind.com")
+)
+
+// The types in the data section
+const (
+	mmdbExtended = iota
+	mmdbPointer
+	mmdbString
+	mmdbDouble
+	mmdbBytes
+	mmdbUint16
+	mmdbUint32
+	mmdbMap
+	mmdbInt32
+	mmdbUint64
+	mmdbUint128
+	mmdbArray
+	mmdbContainer
+	mmdbEndMarker
+	mmdbBool
+	mmdbFloat
+)
+
+// The data section, or the metadata. Pointers are relative to the start.
+type mmdbData []byte
+
+// Read a big endian unsigned integer
+func mmdbUint(b []byte) uint64 {
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	return n
+}
+
+// Decode the value at the given offset. Returns the value and the offset after it.
+func (d mmdbData) decode(offset uint, depth int) (interface{}, uint, error) {
+	if depth > 32 || offset >= uint(len(d)) {
+		return nil, 0, mmdbErr
+	}
+	ctrl := d[offset]
+	offset++
+	typeNum := uint(ctrl >> 5)
+	if typeNum == mmdbPointer {
+		// The size bits are used for the pointer itself
+		pointerSize := uint(ctrl>>3)&3 + 1
+		if offset+pointerSize > uint(len(d)) {
+			return nil, 0, mmdbErr
+		}
+		b := d[offset : offset+pointerSize]
+		var pointer uint
+		switch pointerSize {
+		case 1:
+			pointer = uint(ctrl&7)<<8 | uint(mmdbUint(b))
+		case 2:
+			pointer = uint(ctrl&7)<<16 | uint(mmdbUint(b)) + 2048
+		case 3:
+			pointer = uint(ctrl&7)<<24 | uint(mmdbUint(b)) + 526336
+		default:
+			pointer = uint(mmdbUint(b))
+		}
+		value, _, err := d.decode(pointer, depth+1)
+		return value, offset + pointerSize, err
+	}
+	if typeNum == mmdbExtended {
+		if offset >= uint(len(d)) {
+			return nil, 0, mmdbErr
+		}
+		typeNum = 7 + uint(d[offset])
+		offset++
+	}
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		extra := size - 28
+		if offset+extra > uint(len(d)) {
+			return nil, 0, mmdbErr
+		}
+		n := uint(mmdbUint(d[offset : offset+extra]))
+		offset += extra
+		switch extra {
+		case 1:
+			size = 29 + n
+		case 2:
+			size = 285 + n
+		default:
+			size = 65821 + n
+		}
+	}
+	switch typeNum {
+	case mmdbMap:
+		m := make(map[string]interface{}, size)
+		for i := uint(0); i < size; i++ {
+			key, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			keyString, ok := key.(string)
+			if !ok {
+				return nil, 0, mmdbErr
+			}
+			value, next, err := d.decode(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[keyString] = value
+			offset = next
+		}
+		return m, offset, nil
+	case mmdbArray:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			value, next, err := d.decode(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+			offset = next
+		}
+		return a, offset, nil
+	case mmdbBool:
+		return size != 0, offset, nil
+	}
+	if offset+size > uint(len(d)) {
+		return nil, 0, mmdbErr
+	}
+	b := d[offset : offset+size]
+	offset += size
+	switch typeNum {
+	case mmdbString:
+		return string(b), offset, nil
+	case mmdbDouble:
+		if size != 8 {
+			return nil, 0, mmdbErr
+		}
+		return math.Float64frombits(mmdbUint(b)), offset, nil
+	case mmdbFloat:
+		if size != 4 {
+			return nil, 0, mmdbErr
+		}
+		return math.Float32frombits(uint32(mmdbUint(b))), offset, nil
+	case mmdbBytes:
+		return append([]byte{}, b...), offset, nil
+	case mmdbUint16, mmdbUint32, mmdbUint64:
+		return mmdbUint(b), offset, nil
+	case mmdbInt32:
+		return int32(uint32(mmdbUint(b))), offset, nil
+	case mmdbUint128:
+		return new(big.Int).SetBytes(b), offset, nil
+	}
+	return nil, 0, mmdbErr
+}
+
+// A MaxMind DB file that has been read into memory
+type mmdbReader struct {
+	tree       []byte
+	data       mmdbData
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	ipv4Start  uint // Where IPv4 lookups start, in IPv6 trees
+	dbType     string
+}
+
+// Get an unsigned integer from the metadata
+func metadataUint(metadata map[string]interface{}, key string) uint {
+	n, _ := metadata[key].(uint64)
+	return uint(n)
+}
+
+func newMMDBReader(buf []byte) (*mmdbReader, error) {
+	pos := bytes.LastIndex(buf, mmdbMetadataTag)
+	if pos < 0 {
+		return nil, mmdbErr
+	}
+	value, _, err := mmdbData(buf[pos+len(mmdbMetadataTag):]).decode(0, 0)
+	if err != nil {
+		return nil, err
+	}
+	metadata, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, mmdbErr
+	}
+	r := &mmdbReader{
+		nodeCount:  metadataUint(metadata, "node_count"),
+		recordSize: metadataUint(metadata, "record_size"),
+		ipVersion:  metadataUint(metadata, "ip_version"),
+	}
+	r.dbType, _ = metadata["database_type"].(string)
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, mmdbErr
+	}
+	if r.ipVersion != 4 && r.ipVersion != 6 {
+		return nil, mmdbErr
+	}
+	treeSize := r.nodeCount * r.recordSize / 4
+	// The search tree is followed by 16 zero bytes and then the data section
+	if treeSize+16 > uint(pos) {
+		return nil, mmdbErr
+	}
+	r.tree = buf[:treeSize]
+	r.data = mmdbData(buf[treeSize+16 : pos])
+	if r.ipVersion == 6 {
+		// IPv4 addresses are in ::/96
+		for i := 0; i < 96 && r.ipv4Start < r.nodeCount; i++ {
+			r.ipv4Start = r.record(r.ipv4Start, 0)
+		}
+	}
+	return r, nil
+}
+
+// Read the left (0) or right (1) record of a node in the search tree
+func (r *mmdbReader) record(node uint, bit uint) uint {
+	b := r.tree[node*r.recordSize/4:]
+	switch r.recordSize {
+	case 24:
+		return uint(mmdbUint(b[bit*3 : bit*3+3]))
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(mmdbUint(b[0:3]))
+		}
+		return uint(b[3]&0x0f)<<24 | uint(mmdbUint(b[4:7]))
+	}
+	return uint(mmdbUint(b[bit*4 : bit*4+4]))
+}
+
+// Find the data for an IP address. Returns nil if the address is not in the database.
+func (r *mmdbReader) lookup(ip net.IP) (map[string]interface{}, error) {
+	node := uint(0)
+	bits := ip.To16()
+	if ip4 := ip.To4(); ip4 != nil {
+		bits = ip4
+		if r.ipVersion == 6 {
+			node = r.ipv4Start
+		}
+	} else if r.ipVersion == 4 || bits == nil {
+		return nil, nil
+	}
+	for i := uint(0); i < uint(len(bits))*8 && node < r.nodeCount; i++ {
+		node = r.record(node, uint(bits[i/8]>>(7-i%8))&1)
+	}
+	if node == r.nodeCount {
+		return nil, nil
+	}
+	if node < r.nodeCount || node-r.nodeCount < 16 {
+		return nil, mmdbErr
+	}
+	value, _, err := r.data.decode(node-r.nodeCount-16, 0)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, mmdbErr
+	}
+	return m, nil
+}
@@ -0,0 +1,147 @@
+package siteengines
+
+import (
+	"bytes"
+	"math/big"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// Encode a string for the data section
+func mmdbTestString(s string) []byte {
+	return append([]byte{byte(mmdbString<<5 | len(s))}, s...)
+}
+
+// Encode a map with string values or nested maps, with the keys in sorted order
+func mmdbTestMap(m map[string]interface{}) []byte {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	b := []byte{byte(mmdbMap<<5 | len(m))}
+	for _, key := range keys {
+		b = append(b, mmdbTestString(key)...)
+		switch value := m[key].(type) {
+		case string:
+			b = append(b, mmdbTestString(value)...)
+		case uint16:
+			b = append(b, mmdbUint16<<5|2, byte(value>>8), byte(value))
+		case map[string]interface{}:
+			b = append(b, mmdbTestMap(value)...)
+		}
+	}
+	return b
+}
+
+func TestMMDBDecode(t *testing.T) {
+	tests := []struct {
+		data     []byte
+		expected interface{}
+	}{
+		{[]byte{0x42, 'N', 'O'}, "NO"},
+		{[]byte{0xa2, 0x01, 0x00}, uint64(256)},
+		{[]byte{0xc0}, uint64(0)},
+		{[]byte{0x01, 0x07}, true},                              // Extended type 14
+		{[]byte{0x04, 0x01, 0xff, 0xff, 0xff, 0xfe}, int32(-2)}, // Extended type 8
+		{[]byte{0x68, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}, 1.5},
+		{[]byte{0x02, 0x04, 0x41, 'a', 0x41, 'b'}, []interface{}{"a", "b"}}, // Extended type 11
+		{[]byte{0x01, 0x03, 0x01}, big.NewInt(1)},                           // Extended type 10
+		{[]byte{0xe1, 0x41, 'k', 0x41, 'v'}, map[string]interface{}{"k": "v"}},
+	}
+	for _, test := range tests {
+		value, next, err := mmdbData(test.data).decode(0, 0)
+		if err != nil {
+			t.Errorf("% x: %v", test.data, err)
+			continue
+		}
+		if !reflect.DeepEqual(value, test.expected) {
+			t.Errorf("% x: got %#v, expected %#v", test.data, value, test.expected)
+		}
+		if next != uint(len(test.data)) {
+			t.Errorf("% x: ended at %d, expected %d", test.data, next, len(test.data))
+		}
+	}
+	// A pointer to the string at the start
+	data := mmdbData{0x42, 'N', 'O', 0x20, 0x00}
+	if value, next, err := data.decode(3, 0); err != nil || value != "NO" || next != 5 {
+		t.Errorf("pointer: got %v, %d, %v", value, next, err)
+	}
+	// Truncated values, and a pointer to itself
+	for _, bad := range [][]byte{{}, {0x45, 'a'}, {0xe1, 0x41}, {0x68, 0x3f}, {0x20, 0x00}} {
+		if _, _, err := mmdbData(bad).decode(0, 0); err == nil {
+			t.Errorf("% x: expected an error", bad)
+		}
+	}
+}
+
+// Build an IPv4 database with record size 24, where 0.0.0.0/1 is Norway,
+// 128.0.0.0/2 is Sweden and 192.0.0.0/2 is not in the database
+func testMMDB() []byte {
+	const nodeCount = 2
+	var tree []byte
+	record := func(n uint) {
+		tree = append(tree, byte(n>>16), byte(n>>8), byte(n))
+	}
+	norway := mmdbTestMap(map[string]interface{}{"country": map[string]interface{}{"iso_code": "NO"}})
+	sweden := mmdbTestMap(map[string]interface{}{"country": map[string]interface{}{"iso_code": "SE"}})
+	// Node 0: the first bit
+	record(nodeCount + 16)
+	record(1)
+	// Node 1: the second bit
+	record(nodeCount + 16 + uint(len(norway)))
+	record(nodeCount)
+	var buf bytes.Buffer
+	buf.Write(tree)
+	buf.Write(make([]byte, 16))
+	buf.Write(norway)
+	buf.Write(sweden)
+	buf.Write(mmdbMetadataTag)
+	buf.Write(mmdbTestMap(map[string]interface{}{
+		"database_type": "Test-Country",
+		"ip_version":    uint16(4),
+		"node_count":    uint16(nodeCount),
+		"record_size":   uint16(24),
+	}))
+	return buf.Bytes()
+}
+
+func TestMMDBLookup(t *testing.T) {
+	r, err := newMMDBReader(testMMDB())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.dbType != "Test-Country" || r.nodeCount != 2 || r.recordSize != 24 || r.ipVersion != 4 {
+		t.Errorf("wrong metadata: %+v", r)
+	}
+	tests := []struct {
+		ip      string
+		country string
+	}{
+		{"10.0.0.1", "NO"},
+		{"127.255.255.255", "NO"},
+		{"128.0.0.1", "SE"},
+		{"191.1.2.3", "SE"},
+		{"192.0.2.1", ""},
+		{"::ffff:10.0.0.1", "NO"},
+		{"2001:db8::1", ""}, // IPv6 is not in an IPv4 database
+	}
+	for _, test := range tests {
+		m, err := r.lookup(net.ParseIP(test.ip))
+		if err != nil {
+			t.Errorf("%s: %v", test.ip, err)
+			continue
+		}
+		if got := lookupString(m, "country", "iso_code"); got != test.country {
+			t.Errorf("%s: got %q, expected %q", test.ip, got, test.country)
+		}
+	}
+	db := testMMDB()
+	for _, bad := range [][]byte{nil, []byte("not a database"), db[:len(db)-5]} {
+		if _, err := newMMDBReader(bad); err == nil {
+			t.Errorf("expected an error for % x", bad)
+		}
+	}
+}
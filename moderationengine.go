@@ -1,5 +1,553 @@
 package siteengines
 
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	. "github.com/xyproto/genericsite"
+	"github.com/xyproto/pinterface"
+	. "github.com/xyproto/webhandle"
+)
+
 // An engine for more than one other user to vote if something is legit or not
 // It could be the information of a new user wanting to register, a wiki change, a chat line etc
-// Every data should have a moderation-count field, that says how many times something has been okayed?
+// Every item has a moderation count, for how many times it has been approved or rejected
+
+var (
+	noItemErr    = errors.New("No such item in the moderation queue.")
+	decidedErr   = errors.New("The item has already been moderated.")
+	ownItemErr   = errors.New("Can't moderate your own contributions.")
+	notModErr    = errors.New("Not logged in as a moderator.")
+	votedErr     = errors.New("You have already voted on this item.")
+	thresholdErr = errors.New("The thresholds can not be negative.")
+)
+
+// The status of an item in the moderation queue
+const (
+	ModerationPending  = "pending"
+	ModerationApproved = "approved"
+	ModerationRejected = "rejected"
+)
+
+// Something that is held until it has been approved
+type ModerationItem struct {
+	ID         string
+	Kind       string // ie. "wiki", "chat" or "registration"
+	Username   string // The user that contributed it
+	Summary    string // HTML that describes the item, for the moderators
+	Data       string // For the engine that handles the item, ie. JSON
+	Created    time.Time
+	Status     string
+	Approvals  int
+	Rejections int
+}
+
+// What happens when an item of a certain kind has been moderated
+type ModerationHooks struct {
+	Approved func(item *ModerationItem) // Publish the content
+	Rejected func(item *ModerationItem) // May be nil
+}
+
+// How many votes are needed for an item of a certain kind.
+// An approve threshold of 0 turns off moderation for the kind.
+type moderationThresholds struct {
+	approve, reject int
+}
+
+type ModerationEngine struct {
+	state      pinterface.IUserState
+	items      pinterface.IHashMap  // The items, with "kind", "username", "summary", "data", "created", "status", "approvals" and "rejections" fields
+	votes      pinterface.IHashMap  // The votes for each item, with usernames as the keys and "approve" or "reject" as the values
+	queue      pinterface.ISet      // The IDs of the pending items
+	moderators pinterface.ISet      // Users that can vote, in addition to the administrators
+	counter    pinterface.IKeyValue // For generating item IDs
+	mut        sync.Mutex           // So that two votes can not decide an item twice
+	hooks      map[string]ModerationHooks
+	thresholds map[string]moderationThresholds
+	defaults   moderationThresholds
+}
+
+func NewModerationEngine(userState pinterface.IUserState) (*ModerationEngine, error) {
+	creator := userState.Creator()
+
+	me := new(ModerationEngine)
+	me.state = userState
+	me.hooks = make(map[string]ModerationHooks)
+	me.thresholds = make(map[string]moderationThresholds)
+	me.defaults = moderationThresholds{1, 1}
+
+	if itemsHashMap, err := creator.NewHashMap("moderation"); err != nil {
+		return nil, err
+	} else {
+		me.items = itemsHashMap
+	}
+	if votesHashMap, err := creator.NewHashMap("moderationVotes"); err != nil {
+		return nil, err
+	} else {
+		me.votes = votesHashMap
+	}
+	if queueSet, err := creator.NewSet("moderationQueue"); err != nil {
+		return nil, err
+	} else {
+		me.queue = queueSet
+	}
+	if moderatorsSet, err := creator.NewSet("moderators"); err != nil {
+		return nil, err
+	} else {
+		me.moderators = moderatorsSet
+	}
+	// Not "moderation", since "moderation:counter" would be listed as an item
+	if counterKeyValue, err := creator.NewKeyValue("moderationCounter"); err != nil {
+		return nil, err
+	} else {
+		me.counter = counterKeyValue
+	}
+	// Continue from the counter that was stored there before, so that the IDs are not reused
+	if oldKeyValue, err := creator.NewKeyValue("moderation"); err == nil {
+		if counter, err := oldKeyValue.Get("counter"); err == nil {
+			if err := me.counter.Set("counter", counter); err != nil {
+				return nil, err
+			}
+			oldKeyValue.Del("counter")
+		}
+	}
+
+	return me, nil
+}
+
+func (me *ModerationEngine) Name() string {
+	return "moderation"
+}
+
+func (me *ModerationEngine) MenuLinks() []string {
+	return []string{"Moderation:/moderation"}
+}
+
+// Let the other engines register the kinds of content they can hold
+func (me *ModerationEngine) ServeEngine(r *mux.Router, ec *EngineConfig) {
+	for _, engine := range ec.Engines {
+		if moderated, ok := engine.(Moderated); ok {
+			moderated.SetModeration(me)
+		}
+	}
+	me.ServePages(r, ec.BaseCP, ec.MenuEntries)
+}
+
+// Set how many votes are needed for approving or rejecting items of all kinds
+func (me *ModerationEngine) SetDefaultThresholds(approve, reject int) error {
+	if approve < 0 || reject < 0 {
+		return thresholdErr
+	}
+	me.mut.Lock()
+	defer me.mut.Unlock()
+	me.defaults = moderationThresholds{approve, reject}
+	return nil
+}
+
+// Set how many votes are needed for approving or rejecting items of one kind.
+// If approve is 0, items of this kind are not held.
+func (me *ModerationEngine) SetThresholds(kind string, approve, reject int) error {
+	if approve < 0 || reject < 0 {
+		return thresholdErr
+	}
+	me.mut.Lock()
+	defer me.mut.Unlock()
+	me.thresholds[kind] = moderationThresholds{approve, reject}
+	return nil
+}
+
+func (me *ModerationEngine) thresholdsFor(kind string) moderationThresholds {
+	me.mut.Lock()
+	defer me.mut.Unlock()
+	if t, ok := me.thresholds[kind]; ok {
+		return t
+	}
+	return me.defaults
+}
+
+// Register what should happen when items of the given kind have been moderated
+func (me *ModerationEngine) Handle(kind string, hooks ModerationHooks) {
+	me.mut.Lock()
+	defer me.mut.Unlock()
+	me.hooks[kind] = hooks
+}
+
+// Check if a user can vote, which administrators and moderators can
+func (me *ModerationEngine) IsModerator(username string) bool {
+	if username == "" || !me.state.HasUser(username) {
+		return false
+	}
+	if me.state.IsAdmin(username) {
+		return true
+	}
+	has, err := me.moderators.Has(username)
+	return err == nil && has
+}
+
+// Let a user vote
+func (me *ModerationEngine) AddModerator(username string) error {
+	return me.moderators.Add(username)
+}
+
+// Take away the right to vote, administrators can still vote
+func (me *ModerationEngine) RemoveModerator(username string) error {
+	return me.moderators.Del(username)
+}
+
+// Check if contributions of the given kind from the given user should be held.
+// Contributions from moderators are never held.
+func (me *ModerationEngine) Holds(kind, username string) bool {
+	return me.thresholdsFor(kind).approve > 0 && !me.IsModerator(username)
+}
+
+// Put an item in the moderation queue, returns the ID
+func (me *ModerationEngine) Hold(kind, username, summary, data string) (string, error) {
+	id, err := me.counter.Inc("counter")
+	if err != nil {
+		return "", err
+	}
+	if err := me.items.Set(id, "kind", kind); err != nil {
+		return "", err
+	}
+	me.items.Set(id, "username", username)
+	me.items.Set(id, "summary", summary)
+	me.items.Set(id, "data", data)
+	me.items.Set(id, "created", time.Now().UTC().Format(time.RFC3339))
+	me.items.Set(id, "status", ModerationPending)
+	me.items.Set(id, "approvals", "0")
+	me.items.Set(id, "rejections", "0")
+	if err := me.queue.Add(id); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// Retrieve an item
+func (me *ModerationEngine) Item(id string) (*ModerationItem, error) {
+	kind, err := me.items.Get(id, "kind")
+	if err != nil {
+		return nil, noItemErr
+	}
+	item := &ModerationItem{ID: id, Kind: kind}
+	item.Username, _ = me.items.Get(id, "username")
+	item.Summary, _ = me.items.Get(id, "summary")
+	item.Data, _ = me.items.Get(id, "data")
+	item.Status, _ = me.items.Get(id, "status")
+	if created, err := me.items.Get(id, "created"); err == nil {
+		item.Created, _ = time.Parse(time.RFC3339, created)
+	}
+	if approvals, err := me.items.Get(id, "approvals"); err == nil {
+		item.Approvals, _ = strconv.Atoi(approvals)
+	}
+	if rejections, err := me.items.Get(id, "rejections"); err == nil {
+		item.Rejections, _ = strconv.Atoi(rejections)
+	}
+	return item, nil
+}
+
+// All pending items, oldest first
+func (me *ModerationEngine) Pending() ([]*ModerationItem, error) {
+	ids, err := me.queue.All()
+	if err != nil {
+		return nil, err
+	}
+	var items []*ModerationItem
+	for _, id := range ids {
+		item, err := me.Item(id)
+		if err != nil {
+			continue
+		}
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		a, _ := strconv.Atoi(items[i].ID)
+		b, _ := strconv.Atoi(items[j].ID)
+		return a < b
+	})
+	return items, nil
+}
+
+// Remove a pending item, ie. when the contribution has been deleted.
+// Items that have been moderated are kept.
+func (me *ModerationEngine) Withdraw(id string) error {
+	me.mut.Lock()
+	defer me.mut.Unlock()
+	status, err := me.items.Get(id, "status")
+	if err != nil {
+		return noItemErr
+	}
+	if status != ModerationPending {
+		return decidedErr
+	}
+	me.queue.Del(id)
+	me.votes.Del(id)
+	return me.items.Del(id)
+}
+
+// Vote for approving or rejecting an item. When enough votes have been
+// given, the item is removed from the queue and the hook for the kind is called.
+func (me *ModerationEngine) Vote(id, username string, approve bool) (*ModerationItem, error) {
+	if !me.IsModerator(username) {
+		return nil, notModErr
+	}
+	me.mut.Lock()
+	item, err := me.Item(id)
+	if err != nil {
+		me.mut.Unlock()
+		return nil, err
+	}
+	if item.Status != ModerationPending {
+		me.mut.Unlock()
+		return nil, decidedErr
+	}
+	if item.Username == username {
+		me.mut.Unlock()
+		return nil, ownItemErr
+	}
+	if _, err := me.votes.Get(id, username); err == nil {
+		me.mut.Unlock()
+		return nil, votedErr
+	}
+	t, ok := me.thresholds[item.Kind]
+	if !ok {
+		t = me.defaults
+	}
+	if approve {
+		me.votes.Set(id, username, "approve")
+		item.Approvals++
+		me.items.Set(id, "approvals", strconv.Itoa(item.Approvals))
+	} else {
+		me.votes.Set(id, username, "reject")
+		item.Rejections++
+		me.items.Set(id, "rejections", strconv.Itoa(item.Rejections))
+	}
+	switch {
+	case item.Rejections >= t.reject && !approve:
+		item.Status = ModerationRejected
+	case item.Approvals >= t.approve && approve:
+		item.Status = ModerationApproved
+	}
+	hooks := me.hooks[item.Kind]
+	if item.Status != ModerationPending {
+		me.items.Set(id, "status", item.Status)
+		me.queue.Del(id)
+	}
+	me.mut.Unlock()
+
+	// The hooks are called without holding the lock, since they may use the moderation engine
+	switch {
+	case item.Status == ModerationApproved && hooks.Approved != nil:
+		hooks.Approved(item)
+	case item.Status == ModerationRejected && hooks.Rejected != nil:
+		hooks.Rejected(item)
+	}
+	return item, nil
+}
+
+// The items the user has contributed, and the votes the user has given
+func (me *ModerationEngine) ExportPersonalData(username string) (interface{}, error) {
+	ids, err := me.items.All()
+	if err != nil {
+		return nil, err
+	}
+	items := []*ModerationItem{}
+	votes := make(map[string]string)
+	for _, id := range ids {
+		if item, err := me.Item(id); err == nil && item.Username == username {
+			items = append(items, item)
+		}
+		if vote, err := me.votes.Get(id, username); err == nil {
+			votes[id] = vote
+		}
+	}
+	return map[string]interface{}{
+		"items":     items,
+		"votes":     votes,
+		"moderator": me.IsModerator(username),
+	}, nil
+}
+
+// Remove the items the user has contributed, and the votes the user has given.
+// The vote counts of the items are kept.
+func (me *ModerationEngine) ErasePersonalData(username string) error {
+	me.mut.Lock()
+	defer me.mut.Unlock()
+	ids, err := me.items.All()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if owner, err := me.items.Get(id, "username"); err == nil && owner == username {
+			me.queue.Del(id)
+			me.votes.Del(id)
+			if err := me.items.Del(id); err != nil {
+				return err
+			}
+			continue
+		}
+		me.votes.DelKey(id, username)
+	}
+	return me.moderators.Del(username)
+}
+
+// List the pending items, with links for voting
+func (me *ModerationEngine) GenerateModerationPage() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		username := LoggedInUsername(me.state, req)
+		if username == "" || !me.IsModerator(username) {
+			return "<div class=\"no\">Not logged in as a moderator</div>"
+		}
+		s := "<h2>Moderation queue</h2>"
+		s += "<table class=\"whitebg\">"
+		s += "<tr><th>Kind</th><th>User</th><th>Contribution</th><th>Created</th><th>Approvals</th><th>Rejections</th><th>Vote</th></tr>"
+		items, err := me.Pending()
+		if err == nil {
+			for rownr, item := range items {
+				if rownr%2 == 0 {
+					s += "<tr class=\"even\">"
+				} else {
+					s += "<tr class=\"odd\">"
+				}
+				t := me.thresholdsFor(item.Kind)
+				s += "<td>" + item.Kind + "</td>"
+				s += "<td>" + item.Username + "</td>"
+				s += "<td>" + item.Summary + "</td>"
+				s += "<td>" + item.Created.Format("2006-01-02 15:04") + "</td>"
+				s += "<td>" + strconv.Itoa(item.Approvals) + "/" + strconv.Itoa(t.approve) + "</td>"
+				s += "<td>" + strconv.Itoa(item.Rejections) + "/" + strconv.Itoa(t.reject) + "</td>"
+				if vote, err := me.votes.Get(item.ID, username); err == nil {
+					s += "<td>" + vote + "d</td>"
+				} else if item.Username == username {
+					s += "<td>your own</td>"
+				} else {
+					s += "<td><a class=\"darkgrey\" href=\"/moderation/approve/" + item.ID + "\">approve</a> "
+					s += "<a class=\"careful\" href=\"/moderation/reject/" + item.ID + "\">reject</a></td>"
+				}
+				s += "</tr>"
+			}
+		}
+		s += "</table>"
+		if !HasAdminRights(me.state, req) {
+			return s
+		}
+		s += "<br /><strong>Moderators</strong> (administrators can always moderate)<br />"
+		moderators, err := me.moderators.All()
+		if err == nil {
+			sort.Strings(moderators)
+			for _, moderator := range moderators {
+				s += moderator + " (<a class=\"careful\" href=\"/moderation/removemoderator/" + moderator + "\">remove</a>)<br />"
+			}
+		}
+		s += "<form method=\"POST\" action=\"/moderation/moderators\">"
+		s += "Username: <input name=\"username\"> "
+		s += "<input type=\"submit\" value=\"Add moderator\">"
+		s += "</form>"
+		return s
+	}
+}
+
+// Vote on an item, from the links on the moderation page
+func (me *ModerationEngine) GenerateVote(approve bool) StringHandle {
+	title := "Reject"
+	if approve {
+		title = "Approve"
+	}
+	return func(w http.ResponseWriter, req *http.Request) string {
+		username := LoggedInUsername(me.state, req)
+		if username == "" {
+			return MessageOKback(title, "Not logged in")
+		}
+		item, err := me.Vote(mux.Vars(req)["id"], username, approve)
+		if err != nil {
+			return MessageOKback(title, err.Error())
+		}
+		switch item.Status {
+		case ModerationApproved:
+			return MessageOKurl(title, "OK, the "+item.Kind+" contribution from "+item.Username+" has been approved.", "/moderation")
+		case ModerationRejected:
+			return MessageOKurl(title, "OK, the "+item.Kind+" contribution from "+item.Username+" has been rejected.", "/moderation")
+		}
+		return MessageOKurl(title, "OK, your vote has been counted.", "/moderation")
+	}
+}
+
+// Show the status of an item, for the user that contributed it and for moderators
+func (me *ModerationEngine) GenerateItemStatus() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		username := LoggedInUsername(me.state, req)
+		item, err := me.Item(mux.Vars(req)["id"])
+		if err != nil || username == "" || (item.Username != username && !me.IsModerator(username)) {
+			return MessageOKback("Moderation", noItemErr.Error())
+		}
+		switch item.Status {
+		case ModerationApproved:
+			return MessageOKback("Moderation", "Your contribution has been approved.")
+		case ModerationRejected:
+			return MessageOKback("Moderation", "Your contribution has been rejected by the moderators.")
+		}
+		return MessageOKback("Moderation", "Your contribution is waiting to be approved by a moderator.")
+	}
+}
+
+func (me *ModerationEngine) GenerateAddModerator() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		if !HasAdminRights(me.state, req) {
+			return MessageOKback("Moderators", "Not logged in as Administrator")
+		}
+		username := FindUsername(me.state, req.FormValue("username"))
+		if username == "" {
+			return MessageOKback("Moderators", "Can't find user "+CleanUserInput(req.FormValue("username")))
+		}
+		me.AddModerator(username)
+		return MessageOKurl("Moderators", "OK, "+username+" is now a moderator", "/moderation")
+	}
+}
+
+func (me *ModerationEngine) GenerateRemoveModerator() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		if !HasAdminRights(me.state, req) {
+			return MessageOKback("Moderators", "Not logged in as Administrator")
+		}
+		username := mux.Vars(req)["username"]
+		me.RemoveModerator(username)
+		return MessageOKurl("Moderators", "OK, "+CleanUserInput(username)+" is no longer a moderator", "/moderation")
+	}
+}
+
+// Show the size of the moderation queue on the administrator dashboard
+func (me *ModerationEngine) AdminStatus(req *http.Request) string {
+	s := "<strong>Moderation</strong><br />"
+	items, err := me.Pending()
+	if err != nil {
+		return s + "Could not retrieve the moderation queue.<br />"
+	}
+	return s + strconv.Itoa(len(items)) + " contributions are waiting. <a href=\"/moderation\">Moderate</a><br />"
+}
+
+// The moderation pages are styled by the site
+func (me *ModerationEngine) GenerateCSS(cs *ColorScheme) StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		w.Header().Add("Content-Type", "text/css")
+		return ""
+	}
+}
+
+func (me *ModerationEngine) ServePages(r *mux.Router, basecp BaseCP, menuEntries MenuEntries) {
+	moderationCP := basecp(me.state)
+	moderationCP.ContentTitle = "Moderation"
+
+	tvgf := DynamicMenuFactoryGenerator(menuEntries)
+	tvg := tvgf(me.state)
+
+	r.HandleFunc("/moderation", moderationCP.WrapSimpleContextHandle(r, me.GenerateModerationPage(), tvg)).Methods("GET")
+	r.Handle("/moderation/approve/{id}", me.GenerateVote(true)).Methods("GET")
+	r.Handle("/moderation/reject/{id}", me.GenerateVote(false)).Methods("GET")
+	r.Handle("/moderation/item/{id}", me.GenerateItemStatus()).Methods("GET")
+	r.Handle("/moderation/moderators", me.GenerateAddModerator()).Methods("POST")
+	r.Handle("/moderation/removemoderator/{username}", me.GenerateRemoveModerator()).Methods("GET")
+}
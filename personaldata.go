@@ -0,0 +1,149 @@
+package siteengines
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+	. "github.com/xyproto/webhandle"
+)
+
+// This part collects and erases everything the engines hold about a user,
+// for answering requests from the users about their personal data
+
+// Collect the personal data of a user from all engines that hold some, by engine name
+func CollectPersonalData(engines []Engine, username string) (map[string]interface{}, error) {
+	collected := make(map[string]interface{})
+	for _, engine := range engines {
+		if pd, ok := engine.(PersonalData); ok {
+			data, err := pd.ExportPersonalData(username)
+			if err != nil {
+				return nil, err
+			}
+			collected[engine.Name()] = data
+		}
+	}
+	return collected, nil
+}
+
+// Write the personal data of a user as a ZIP archive, with one JSON file per engine
+func WritePersonalDataZip(w io.Writer, engines []Engine, username string) error {
+	collected, err := CollectPersonalData(engines, username)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(collected))
+	for name := range collected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	zw := zip.NewWriter(w)
+	for _, name := range names {
+		f, err := zw.Create(username + "/" + name + ".json")
+		if err != nil {
+			return err
+		}
+		// The data is for reading, not for a browser, so "<" and "&" are kept as they are
+		encoder := json.NewEncoder(f)
+		encoder.SetEscapeHTML(false)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(collected[name]); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// Delete or anonymize everything the engines hold about a user. The user engine
+// goes last, since it removes the user that the other engines may look up.
+func EraseUser(engines []Engine, username string) error {
+	var last PersonalData
+	for _, engine := range engines {
+		pd, ok := engine.(PersonalData)
+		if !ok {
+			continue
+		}
+		if engine.Name() == "user" {
+			last = pd
+			continue
+		}
+		if err := pd.ErasePersonalData(username); err != nil {
+			return err
+		}
+	}
+	if last != nil {
+		return last.ErasePersonalData(username)
+	}
+	return nil
+}
+
+// Serve the personal data of a user as a ZIP file download
+func servePersonalDataZip(w http.ResponseWriter, engines []Engine, username string) string {
+	var buf bytes.Buffer
+	if err := WritePersonalDataZip(&buf, engines, username); err != nil {
+		return MessageOKback("Personal data", "Could not collect the data: "+err.Error())
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+username+"-data.zip\"")
+	return buf.String()
+}
+
+// Download the personal data of any user, for administrators
+func (ae *AdminEngine) GenerateExportUser() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		if !HasAdminRights(ae.state, req) {
+			return MessageOKback("Personal data", "Not logged in as Administrator")
+		}
+		username := FindUsername(ae.state, mux.Vars(req)["username"])
+		if username == "" {
+			return MessageOKback("Personal data", "No such user")
+		}
+		return servePersonalDataZip(w, ae.engines, username)
+	}
+}
+
+// Ask an administrator to confirm that the personal data of a user should be erased
+func (ae *AdminEngine) GenerateEraseUserForm() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		if !HasAdminRights(ae.state, req) {
+			return "<div class=\"no\">Not logged in as Administrator</div>"
+		}
+		username := FindUsername(ae.state, mux.Vars(req)["username"])
+		if username == "" {
+			return "<div class=\"no\">No such user</div>"
+		}
+		s := "<p>Everything that is stored about " + username + " is erased, including the account. This can not be undone.</p>"
+		s += "<form method=\"POST\" action=\"/personaldata/erase/" + username + "\">"
+		s += "<input type=\"checkbox\" name=\"sure\" value=\"yes\"> I want to erase " + username + "<br />"
+		s += "<input type=\"submit\" value=\"Erase\">"
+		s += "</form>"
+		return s
+	}
+}
+
+// Erase the personal data of any user, for administrators
+func (ae *AdminEngine) GenerateEraseUser() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		if !HasAdminRights(ae.state, req) {
+			return MessageOKback("Personal data", "Not logged in as Administrator")
+		}
+		username := FindUsername(ae.state, mux.Vars(req)["username"])
+		if username == "" {
+			return MessageOKback("Personal data", "No such user")
+		}
+		if username == LoggedInUsername(ae.state, req) {
+			return MessageOKback("Personal data", "Can't erase yourself from the admin dashboard")
+		}
+		if req.FormValue("sure") != "yes" {
+			return MessageOKback("Personal data", "Please check the box, to be sure.")
+		}
+		if err := EraseUser(ae.engines, username); err != nil {
+			return MessageOKback("Personal data", "Could not erase all the data: "+err.Error())
+		}
+		return MessageOKurl("Personal data", "OK, everything about "+username+" has been erased.", "/admin")
+	}
+}
@@ -0,0 +1,83 @@
+package siteengines
+
+import (
+	"archive/zip"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestEraseUser(t *testing.T) {
+	state := NewMemoryUserState()
+	ue, err := NewUserEngine(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ce, err := NewChatEngine(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engines := []Engine{ue, ce}
+	for _, username := range []string{"bob", "alice"} {
+		state.AddUser(username, "hunter22", username+"@example.com")
+		state.MarkConfirmed(username)
+		ue.skeletons.Add(username)
+		RecordLogin(state, username, "192.0.2.1")
+		RecordUserIP(state, username, "192.0.2.1")
+		ce.JoinChat(username)
+		ce.Say(username, "hello from "+username)
+	}
+	if _, err := ue.apiTokens.Create("bob", "script", []string{"read"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := WritePersonalDataZip(&buf, engines, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	if strings.Join(names, " ") != "bob/chat.json bob/user.json" {
+		t.Errorf("got the files %v", names)
+	}
+
+	if err := EraseUser(engines, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if state.HasUser("bob") {
+		t.Error("bob still exists")
+	}
+	if !state.HasUser("alice") {
+		t.Error("alice was removed too")
+	}
+	for _, line := range ce.ChatText() {
+		if chatLineUsername(line) == "bob" {
+			t.Errorf("bob is still in the chat: %s", line)
+		}
+	}
+	if lines := ce.ChatText(); len(lines) != 1 || chatLineUsername(lines[0]) != "alice" {
+		t.Errorf("got the chat lines %v, expected only the line from alice", lines)
+	}
+	if ips, _ := UserIPs(state, "bob"); len(ips) != 0 {
+		t.Errorf("the IP addresses of bob are still stored: %v", ips)
+	}
+	if logins, _ := LoginHistory(state, "bob", 10); len(logins) != 0 {
+		t.Errorf("the logins of bob are still stored: %v", logins)
+	}
+	if tokens, _ := ue.apiTokens.ForUser("bob"); len(tokens) != 0 {
+		t.Error("the API tokens of bob still exist")
+	}
+	if logins, _ := LoginHistory(state, "alice", 10); len(logins) != 1 {
+		t.Errorf("the logins of alice are gone: %v", logins)
+	}
+	// The username can be registered again
+	if other := ue.skeletons.Confusable("bob"); other != "" {
+		t.Errorf("bob is taken by %q", other)
+	}
+}
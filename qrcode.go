@@ -0,0 +1,470 @@
+package siteengines
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// This part draws QR codes, for setting up two-factor authentication apps.
+// Only byte mode, error correction level M and versions 1 to 10 are supported,
+// which is enough for otpauth:// links.
+
+var qrTooLongErr = errors.New("The text is too long for a QR code.")
+
+// The error correction blocks for level M, for each version
+type qrBlocks struct {
+	eccLen  int   // Error correction codewords per block
+	dataLen []int // Data codewords in each block
+}
+
+var qrVersions = []qrBlocks{
+	{}, // There is no version 0
+	{10, []int{16}},
+	{16, []int{28}},
+	{26, []int{44}},
+	{18, []int{32, 32}},
+	{24, []int{43, 43}},
+	{16, []int{27, 27, 27, 27}},
+	{18, []int{31, 31, 31, 31}},
+	{22, []int{38, 38, 39, 39}},
+	{22, []int{36, 36, 36, 37, 37}},
+	{26, []int{43, 43, 43, 43, 44}},
+}
+
+// The centers of the alignment patterns, for each version
+var qrAlignments = [][]int{
+	{}, {}, {6, 18}, {6, 22}, {6, 26}, {6, 30}, {6, 34},
+	{6, 22, 38}, {6, 24, 42}, {6, 26, 46}, {6, 28, 50},
+}
+
+// A QR code, as a square of dark (true) and light modules
+type qrCode struct {
+	size       int
+	modules    [][]bool
+	isFunction [][]bool // Finder patterns, timing and so on, that are not masked
+}
+
+// Multiply two numbers in GF(2^8), modulo x^8 + x^4 + x^3 + x^2 + 1
+func gfMultiply(x, y byte) byte {
+	var z int
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int((y>>uint(i))&1) * int(x)
+	}
+	return byte(z)
+}
+
+// The Reed-Solomon generator polynomial of the given degree, without the leading term
+func rsDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := 0; j < degree; j++ {
+			result[j] = gfMultiply(result[j], root)
+			if j+1 < degree {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = gfMultiply(root, 0x02)
+	}
+	return result
+}
+
+// The Reed-Solomon error correction codewords for the data
+func rsRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i := range result {
+			result[i] ^= gfMultiply(divisor[i], factor)
+		}
+	}
+	return result
+}
+
+// Appends bits to a byte slice
+type bitBuffer struct {
+	data []byte
+	n    int // Number of bits
+}
+
+func (bb *bitBuffer) write(value, length int) {
+	for i := length - 1; i >= 0; i-- {
+		if bb.n%8 == 0 {
+			bb.data = append(bb.data, 0)
+		}
+		if (value>>uint(i))&1 == 1 {
+			bb.data[bb.n/8] |= 0x80 >> uint(bb.n%8)
+		}
+		bb.n++
+	}
+}
+
+// Encode text as a QR code, using the smallest version that fits
+func newQRCode(text string) (*qrCode, error) {
+	data := []byte(text)
+	version := 0
+	for v := 1; v < len(qrVersions); v++ {
+		capacity := 0
+		for _, n := range qrVersions[v].dataLen {
+			capacity += n
+		}
+		countBits := 8
+		if v >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+len(data)*8 <= capacity*8 {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, qrTooLongErr
+	}
+	blocks := qrVersions[version]
+	capacity := 0
+	for _, n := range blocks.dataLen {
+		capacity += n
+	}
+
+	// Byte mode, the length and the data, then the terminator and padding
+	var bb bitBuffer
+	bb.write(0x4, 4)
+	if version >= 10 {
+		bb.write(len(data), 16)
+	} else {
+		bb.write(len(data), 8)
+	}
+	for _, b := range data {
+		bb.write(int(b), 8)
+	}
+	terminator := capacity*8 - bb.n
+	if terminator > 4 {
+		terminator = 4
+	}
+	bb.write(0, terminator)
+	bb.write(0, (8-bb.n%8)%8)
+	for pad := 0xEC; len(bb.data) < capacity; pad ^= 0xEC ^ 0x11 {
+		bb.write(pad, 8)
+	}
+
+	// Split into blocks, add error correction and interleave
+	divisor := rsDivisor(blocks.eccLen)
+	var dataBlocks, eccBlocks [][]byte
+	offset := 0
+	maxLen := 0
+	for _, n := range blocks.dataLen {
+		block := bb.data[offset : offset+n]
+		offset += n
+		dataBlocks = append(dataBlocks, block)
+		eccBlocks = append(eccBlocks, rsRemainder(block, divisor))
+		if n > maxLen {
+			maxLen = n
+		}
+	}
+	var codewords []byte
+	for i := 0; i < maxLen; i++ {
+		for _, block := range dataBlocks {
+			if i < len(block) {
+				codewords = append(codewords, block[i])
+			}
+		}
+	}
+	for i := 0; i < blocks.eccLen; i++ {
+		for _, block := range eccBlocks {
+			codewords = append(codewords, block[i])
+		}
+	}
+
+	qr := &qrCode{size: version*4 + 17}
+	qr.modules = make([][]bool, qr.size)
+	qr.isFunction = make([][]bool, qr.size)
+	for y := range qr.modules {
+		qr.modules[y] = make([]bool, qr.size)
+		qr.isFunction[y] = make([]bool, qr.size)
+	}
+	qr.drawFunctionPatterns(version)
+	qr.drawCodewords(codewords)
+
+	// Use the mask that gives the lowest penalty
+	bestMask, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		qr.applyMask(mask)
+		qr.drawFormatBits(mask)
+		if penalty := qr.penalty(); bestPenalty < 0 || penalty < bestPenalty {
+			bestMask, bestPenalty = mask, penalty
+		}
+		qr.applyMask(mask) // Undo, since XOR is its own inverse
+	}
+	qr.applyMask(bestMask)
+	qr.drawFormatBits(bestMask)
+	return qr, nil
+}
+
+func (qr *qrCode) setFunction(x, y int, dark bool) {
+	qr.modules[y][x] = dark
+	qr.isFunction[y][x] = true
+}
+
+func absInt(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func (qr *qrCode) drawFunctionPatterns(version int) {
+	size := qr.size
+	// Timing patterns
+	for i := 0; i < size; i++ {
+		qr.setFunction(6, i, i%2 == 0)
+		qr.setFunction(i, 6, i%2 == 0)
+	}
+	// Finder patterns, with separators
+	for _, center := range [][2]int{{3, 3}, {size - 4, 3}, {3, size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := center[0]+dx, center[1]+dy
+				if x >= 0 && x < size && y >= 0 && y < size {
+					dist := maxInt(absInt(dx), absInt(dy))
+					qr.setFunction(x, y, dist != 2 && dist != 4)
+				}
+			}
+		}
+	}
+	// Alignment patterns, except where the finder patterns are
+	positions := qrAlignments[version]
+	last := len(positions) - 1
+	for i, y := range positions {
+		for j, x := range positions {
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					qr.setFunction(x+dx, y+dy, maxInt(absInt(dx), absInt(dy)) != 1)
+				}
+			}
+		}
+	}
+	// Reserve the format bits
+	qr.drawFormatBits(0)
+	// Version information
+	if version >= 7 {
+		rem := version
+		for i := 0; i < 12; i++ {
+			rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+		}
+		bits := version<<12 | rem
+		for i := 0; i < 18; i++ {
+			dark := (bits>>uint(i))&1 == 1
+			a, b := size-11+i%3, i/3
+			qr.setFunction(a, b, dark)
+			qr.setFunction(b, a, dark)
+		}
+	}
+}
+
+// The format bits for error correction level M and the given mask
+func qrFormatBits(mask int) int {
+	data := mask // The bits for level M are 00
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	return (data<<10 | rem) ^ 0x5412
+}
+
+func (qr *qrCode) drawFormatBits(mask int) {
+	bits := qrFormatBits(mask)
+	bit := func(i int) bool {
+		return (bits>>uint(i))&1 == 1
+	}
+	size := qr.size
+	// Around the top left finder pattern
+	for i := 0; i <= 5; i++ {
+		qr.setFunction(8, i, bit(i))
+	}
+	qr.setFunction(8, 7, bit(6))
+	qr.setFunction(8, 8, bit(7))
+	qr.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		qr.setFunction(14-i, 8, bit(i))
+	}
+	// Next to the two other finder patterns
+	for i := 0; i < 8; i++ {
+		qr.setFunction(size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		qr.setFunction(8, size-15+i, bit(i))
+	}
+	// The dark module
+	qr.setFunction(8, size-8, true)
+}
+
+// Place the codewords in the zig-zag pattern, two columns at a time, from the bottom right
+func (qr *qrCode) drawCodewords(codewords []byte) {
+	size := qr.size
+	i := 0
+	for right := size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			// Skip the vertical timing pattern
+			right = 5
+		}
+		upward := (right+1)&2 == 0
+		for vert := 0; vert < size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if upward {
+					y = size - 1 - vert
+				}
+				if !qr.isFunction[y][x] && i < len(codewords)*8 {
+					qr.modules[y][x] = (codewords[i/8]>>uint(7-i%8))&1 == 1
+					i++
+				}
+			}
+		}
+	}
+}
+
+func (qr *qrCode) applyMask(mask int) {
+	for y := 0; y < qr.size; y++ {
+		for x := 0; x < qr.size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !qr.isFunction[y][x] {
+				qr.modules[y][x] = !qr.modules[y][x]
+			}
+		}
+	}
+}
+
+// How hard the QR code is to scan, as described in the QR code specification
+func (qr *qrCode) penalty() int {
+	size := qr.size
+	penalty := 0
+	at := func(x, y int, horizontal bool) bool {
+		if horizontal {
+			return qr.modules[y][x]
+		}
+		return qr.modules[x][y]
+	}
+	finderLike := []bool{true, false, true, true, true, false, true}
+	for _, horizontal := range []bool{true, false} {
+		for y := 0; y < size; y++ {
+			// Runs of five or more modules with the same color
+			run := 1
+			for x := 1; x <= size; x++ {
+				if x < size && at(x, y, horizontal) == at(x-1, y, horizontal) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					penalty += 3 + run - 5
+				}
+				run = 1
+			}
+			// Patterns that look like the finder patterns, with four light modules on one side
+			for x := 0; x+7 <= size; x++ {
+				match := true
+				for i, dark := range finderLike {
+					if at(x+i, y, horizontal) != dark {
+						match = false
+						break
+					}
+				}
+				if !match {
+					continue
+				}
+				lightBefore, lightAfter := x >= 4, x+11 <= size
+				for i := 1; i <= 4; i++ {
+					if lightBefore && at(x-i, y, horizontal) {
+						lightBefore = false
+					}
+					if lightAfter && at(x+6+i, y, horizontal) {
+						lightAfter = false
+					}
+				}
+				if lightBefore || lightAfter {
+					penalty += 40
+				}
+			}
+		}
+	}
+	// Blocks of 2x2 modules with the same color
+	dark := 0
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			if qr.modules[y][x] {
+				dark++
+			}
+			if x+1 < size && y+1 < size {
+				c := qr.modules[y][x]
+				if qr.modules[y][x+1] == c && qr.modules[y+1][x] == c && qr.modules[y+1][x+1] == c {
+					penalty += 3
+				}
+			}
+		}
+	}
+	// The balance of dark and light modules
+	percent := dark * 100 / (size * size)
+	return penalty + absInt(percent-50)/5*10
+}
+
+// Draw the QR code as SVG, with a quiet zone of four modules around it
+func (qr *qrCode) SVG(moduleSize int) string {
+	const border = 4
+	full := qr.size + border*2
+	pixels := strconv.Itoa(full * moduleSize)
+	var sb strings.Builder
+	sb.WriteString("<svg xmlns=\"http://www.w3.org/2000/svg\" width=\"" + pixels + "\" height=\"" + pixels + "\" viewBox=\"0 0 " + strconv.Itoa(full) + " " + strconv.Itoa(full) + "\" shape-rendering=\"crispEdges\">")
+	sb.WriteString("<rect width=\"100%\" height=\"100%\" fill=\"#ffffff\"/>")
+	sb.WriteString("<path fill=\"#000000\" d=\"")
+	for y := 0; y < qr.size; y++ {
+		for x := 0; x < qr.size; x++ {
+			if qr.modules[y][x] {
+				sb.WriteString("M" + strconv.Itoa(x+border) + "," + strconv.Itoa(y+border) + "h1v1h-1z")
+			}
+		}
+	}
+	sb.WriteString("\"/></svg>")
+	return sb.String()
+}
+
+// Draw text as a QR code in SVG
+func QRCodeSVG(text string, moduleSize int) (string, error) {
+	qr, err := newQRCode(text)
+	if err != nil {
+		return "", err
+	}
+	return qr.SVG(moduleSize), nil
+}
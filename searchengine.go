@@ -1,10 +1,11 @@
 package siteengines
 
 import (
+	"net/http"
 	"strings"
 	"time"
 
-	"github.com/hoisie/web"
+	"github.com/gorilla/mux"
 	. "github.com/xyproto/genericsite"
 	. "github.com/xyproto/onthefly"
 	"github.com/xyproto/pinterface"
@@ -17,6 +18,49 @@ const (
 	FOUND_IN_TEXT
 )
 
+// A search result from one of the engines
+type SearchResult struct {
+	URL        string
+	Title      string
+	FoundWhere int // FOUND_IN_URL, FOUND_IN_TITLE or FOUND_IN_TEXT
+}
+
+// This part handles the "search" pages, for the static pages and the searchable engines
+
+type SearchEngine struct {
+	state pinterface.IUserState
+}
+
+func NewSearchEngine(userState pinterface.IUserState) (*SearchEngine, error) {
+	return &SearchEngine{userState}, nil
+}
+
+func (se *SearchEngine) Name() string {
+	return "search"
+}
+
+// The search box is part of every page, so there is no menu entry
+func (se *SearchEngine) MenuLinks() []string {
+	return []string{}
+}
+
+func (se *SearchEngine) GenerateCSS(cs *ColorScheme) StringHandle {
+	return GenerateSearchCSS(cs)
+}
+
+// Search the static pages and all enabled engines that are Searchable
+func (se *SearchEngine) ServeEngine(r *mux.Router, ec *EngineConfig) {
+	var searchables []Searchable
+	for _, engine := range ec.Engines {
+		if searchable, ok := engine.(Searchable); ok {
+			searchables = append(searchables, searchable)
+		}
+	}
+	cs := ec.BaseCP(se.state).ColorScheme
+	tvg := DynamicMenuFactoryGenerator(ec.MenuEntries)(se.state)
+	ServeSearchPages(r, ec.BaseCP, se.state, ec.Pages, cs, tvg, searchables...)
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
@@ -94,18 +138,40 @@ func searchResults(userSearchText UserInput, pc PageCollection) ([]string, []str
 	return matches, titles, searchText, foundWhere
 }
 
+// Add the results from the searchable engines to the search results, skipping urls that are already there
+func addSearchables(searchables []Searchable, matches, titles []string, searchText string, foundWhere []int) ([]string, []string, []int) {
+	if searchText == "" {
+		return matches, titles, foundWhere
+	}
+	for _, searchable := range searchables {
+	NEXT:
+		for _, result := range searchable.Search(searchText) {
+			for _, url := range matches {
+				if url == result.URL {
+					continue NEXT
+				}
+			}
+			matches = append(matches, result.URL)
+			titles = append(titles, result.Title)
+			foundWhere = append(foundWhere, result.FoundWhere)
+		}
+	}
+	return matches, titles, foundWhere
+}
+
 // Generate a search handle. This is done in order to be able to modify the cp
-// Searches a list of ContentPage structs
-func GenerateSearchHandle(pc PageCollection) WebHandle {
-	return func(ctx *web.Context, val string) string {
-		q, found := ctx.Params["q"]
-		searchText := UserInput(q)
+// Searches a list of ContentPage structs, and the given searchable engines
+func GenerateSearchHandle(pc PageCollection, searchables ...Searchable) StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		q, found := req.URL.Query()["q"]
+		searchText := UserInput(strings.Join(q, " "))
 		if found {
 			content := "Search: " + string(searchText)
 			nl := TagString("br")
 			content += nl + nl
 			startTime := time.Now()
 			urls, titles, searchedFor, foundWhere := searchResults(searchText, pc)
+			urls, titles, foundWhere = addSearchables(searchables, urls, titles, searchedFor, foundWhere)
 			elapsed := time.Since(startTime)
 			page, p := StandaloneTag("p")
 			if len(urls) == 0 {
@@ -142,9 +208,9 @@ func GenerateSearchHandle(pc PageCollection) WebHandle {
 	}
 }
 
-func GenerateSearchCSS(cs *ColorScheme) SimpleContextHandle {
-	return func(ctx *web.Context) string {
-		ctx.ContentType("css")
+func GenerateSearchCSS(cs *ColorScheme) StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		w.Header().Add("Content-Type", "text/css")
 		return `
 #searchresult {
 	color: ` + cs.Nicecolor + `;
@@ -155,12 +221,12 @@ func GenerateSearchCSS(cs *ColorScheme) SimpleContextHandle {
 	}
 }
 
-func ServeSearchPages(basecp BaseCP, state pinterface.IUserState, cps PageCollection, cs *ColorScheme, tpg TemplateValueGenerator) {
+func ServeSearchPages(r *mux.Router, basecp BaseCP, state pinterface.IUserState, cps PageCollection, cs *ColorScheme, tpg TemplateValueGenerator, searchables ...Searchable) {
 	searchCP := basecp(state)
 	searchCP.ContentTitle = "Search results"
 	searchCP.ExtraCSSurls = append(searchCP.ExtraCSSurls, "/css/search.css")
 
-	// Note, no slash between "search" and "(.*)". A typical search is "/search?q=blabla"
-	web.Get("/search(.*)", searchCP.WrapWebHandle(GenerateSearchHandle(cps), tpg))
-	web.Get("/css/search.css", GenerateSearchCSS(cs))
+	// A typical search is "/search?q=blabla"
+	r.HandleFunc("/search", searchCP.WrapSimpleContextHandle(r, GenerateSearchHandle(cps, searchables...), tpg)).Methods("GET")
+	r.Handle("/css/search.css", GenerateSearchCSS(cs)).Methods("GET")
 }
@@ -0,0 +1,360 @@
+package siteengines
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	. "github.com/xyproto/genericsite"
+	"github.com/xyproto/pinterface"
+	. "github.com/xyproto/webhandle"
+)
+
+// This part keeps track of each login, so that users can see where they are
+// logged in, and log out one browser without logging out the others
+
+const (
+	sessionCookieName         = "session"
+	defaultSessionIdleTimeout = 14 * 24 * time.Hour
+	// The last activity is only stored this often, to avoid writing for every request
+	sessionActivityInterval = time.Minute
+	// The longest user agent that is stored
+	maxUserAgentLength = 200
+)
+
+var noSessionErr = errors.New("The session does not exist, or has expired.")
+
+// A browser or device where a user is logged in
+type Session struct {
+	ID         string // The hash of the token in the session cookie
+	Username   string
+	Created    time.Time
+	LastActive time.Time
+	IP         string
+	UserAgent  string
+}
+
+type Sessions struct {
+	state       pinterface.IUserState
+	sessions    pinterface.IHashMap // The token hashes, with "username", "created", "lastactive", "ip" and "useragent" fields
+	idleTimeout time.Duration
+	mut         sync.RWMutex
+}
+
+func NewSessions(state pinterface.IUserState) (*Sessions, error) {
+	sessions, err := state.Creator().NewHashMap("sessions")
+	if err != nil {
+		return nil, err
+	}
+	return &Sessions{state: state, sessions: sessions, idleTimeout: defaultSessionIdleTimeout}, nil
+}
+
+// Set how long a session can be unused before it expires
+func (ss *Sessions) SetIdleTimeout(timeout time.Duration) {
+	ss.mut.Lock()
+	defer ss.mut.Unlock()
+	ss.idleTimeout = timeout
+}
+
+func (ss *Sessions) expired(session *Session, now time.Time) bool {
+	ss.mut.RLock()
+	defer ss.mut.RUnlock()
+	return now.Sub(session.LastActive) > ss.idleTimeout
+}
+
+// Start a new session for a user that has just logged in. Returns the token for the cookie.
+func (ss *Sessions) Create(username, ip, userAgent string) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	if len(userAgent) > maxUserAgentLength {
+		userAgent = userAgent[:maxUserAgentLength]
+	}
+	id := hashToken(token)
+	now := time.Now().UTC().Format(time.RFC3339)
+	for field, value := range map[string]string{"created": now, "lastactive": now, "ip": ip, "useragent": userAgent, "username": username} {
+		if err := ss.sessions.Set(id, field, value); err != nil {
+			ss.sessions.Del(id)
+			return "", err
+		}
+	}
+	return token, nil
+}
+
+// Get a session by ID, without checking if it has expired
+func (ss *Sessions) Get(id string) (*Session, error) {
+	username, err := ss.sessions.Get(id, "username")
+	if err != nil {
+		return nil, noSessionErr
+	}
+	session := &Session{ID: id, Username: username}
+	if created, err := ss.sessions.Get(id, "created"); err == nil {
+		session.Created, _ = time.Parse(time.RFC3339, created)
+	}
+	if lastActive, err := ss.sessions.Get(id, "lastactive"); err == nil {
+		session.LastActive, _ = time.Parse(time.RFC3339, lastActive)
+	}
+	session.IP, _ = ss.sessions.Get(id, "ip")
+	session.UserAgent, _ = ss.sessions.Get(id, "useragent")
+	return session, nil
+}
+
+// Find the session for a token, and note that it is in use.
+// Sessions that have expired, or belong to removed users, are removed.
+func (ss *Sessions) Find(token string) (*Session, error) {
+	session, err := ss.Get(hashToken(token))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if ss.expired(session, now) || !ss.state.HasUser(session.Username) {
+		ss.sessions.Del(session.ID)
+		return nil, noSessionErr
+	}
+	if now.Sub(session.LastActive) > sessionActivityInterval {
+		session.LastActive = now
+		ss.sessions.Set(session.ID, "lastactive", now.UTC().Format(time.RFC3339))
+	}
+	return session, nil
+}
+
+// The sessions of a user, most recently used first. Expired sessions are removed.
+func (ss *Sessions) ForUser(username string) ([]*Session, error) {
+	ids, err := ss.sessions.All()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var sessions []*Session
+	for _, id := range ids {
+		session, err := ss.Get(id)
+		if err != nil {
+			continue
+		}
+		if ss.expired(session, now) {
+			ss.sessions.Del(id)
+			continue
+		}
+		if session.Username == username {
+			sessions = append(sessions, session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastActive.After(sessions[j].LastActive)
+	})
+	return sessions, nil
+}
+
+// End a session, so that the browser that has it is logged out
+func (ss *Sessions) Revoke(id string) error {
+	return ss.sessions.Del(id)
+}
+
+// End all sessions of a user
+func (ss *Sessions) RevokeAll(username string) error {
+	sessions, err := ss.ForUser(username)
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		ss.Revoke(session.ID)
+	}
+	return nil
+}
+
+// Set how long a session can be unused before it expires. The default is 14 days.
+func (ue *UserEngine) SetSessionIdleTimeout(timeout time.Duration) {
+	ue.sessions.SetIdleTimeout(timeout)
+}
+
+// Start a session for a user that has just logged in, and store it in the browser
+func (ue *UserEngine) startSession(w http.ResponseWriter, req *http.Request, username string) error {
+	token, err := ue.sessions.Create(username, ClientIP(req), req.UserAgent())
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(ue.state.CookieTimeout(username)),
+		HttpOnly: true,
+	})
+	return nil
+}
+
+// The session of the current request, if there is one
+func (ue *UserEngine) currentSession(req *http.Request) *Session {
+	c, err := req.Cookie(sessionCookieName)
+	if err != nil {
+		return nil
+	}
+	session, err := ue.sessions.Find(c.Value)
+	if err != nil {
+		return nil
+	}
+	return session
+}
+
+// Mark the user as logged out if there are no sessions left
+func (ue *UserEngine) logoutIfNoSessions(username string) {
+	if sessions, err := ue.sessions.ForUser(username); err == nil && len(sessions) == 0 {
+		ue.state.SetLoggedOut(username)
+	}
+}
+
+// Remove a cookie from a request, so that the handlers don't see it
+func removeRequestCookie(req *http.Request, name string) {
+	var kept []string
+	for _, c := range req.Cookies() {
+		if c.Name != name {
+			kept = append(kept, c.String())
+		}
+	}
+	req.Header.Set("Cookie", strings.Join(kept, "; "))
+}
+
+// Treat requests from browsers with a revoked or expired session as not logged in.
+// Used as middleware for all pages.
+func (ue *UserEngine) checkSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		username, err := ue.state.UsernameCookie(req)
+		if err == nil && ue.state.IsLoggedIn(username) {
+			if session := ue.currentSession(req); session == nil || session.Username != username {
+				// Revoked, expired, or from before there were sessions
+				removeRequestCookie(req, "user")
+				removeRequestCookie(req, sessionCookieName)
+				ue.state.ClearCookie(w)
+				http.SetCookie(w, &http.Cookie{Name: sessionCookieName, Path: "/", MaxAge: -1})
+				ue.logoutIfNoSessions(username)
+			}
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+// Log out the current browser, and only mark the user as logged out if there are no other sessions
+func (ue *UserEngine) GenerateLogout() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		username := ue.state.Username(req)
+		if username == "" {
+			return MessageOKback("Logout", "No user to log out")
+		}
+		if session := ue.currentSession(req); session != nil {
+			ue.sessions.Revoke(session.ID)
+		}
+		http.SetCookie(w, &http.Cookie{Name: sessionCookieName, Path: "/", MaxAge: -1})
+		ue.logoutIfNoSessions(username)
+		return MessageOKurl("Logout", username+" is now logged out. Hope to see you soon!", "/login")
+	}
+}
+
+// List the sessions of the current user, with links for ending them
+func (ue *UserEngine) GenerateSessionsPage() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		username := LoggedInUsername(ue.state, req)
+		if username == "" {
+			return "<div class=\"no\">Not logged in</div>"
+		}
+		sessions, err := ue.sessions.ForUser(username)
+		if err != nil {
+			return "<div class=\"no\">Could not retrieve the sessions</div>"
+		}
+		current := ue.currentSession(req)
+		s := "<p>These are the browsers and devices where you are logged in. Sessions that are unused for " + formatAge(ue.sessions.idleTimeout) + " end by themselves.</p>"
+		s += "<table>"
+		s += "<tr><th>Logged in</th><th>Last active</th><th>IP address</th><th>Browser</th><th>Log out</th></tr>"
+		for rownr, session := range sessions {
+			if rownr%2 == 0 {
+				s += "<tr class=\"even\">"
+			} else {
+				s += "<tr class=\"odd\">"
+			}
+			s += "<td>" + session.Created.Local().Format("2006-01-02 15:04") + "</td>"
+			s += "<td>" + session.LastActive.Local().Format("2006-01-02 15:04") + "</td>"
+			s += "<td>" + CleanUserInput(session.IP) + "</td>"
+			s += "<td>" + CleanUserInput(session.UserAgent) + "</td>"
+			if current != nil && session.ID == current.ID {
+				s += "<td>this browser</td>"
+			} else {
+				s += "<td><a class=\"careful\" href=\"/sessions/revoke/" + session.ID + "\">log out</a></td>"
+			}
+			s += "</tr>"
+		}
+		s += "</table>"
+		if len(sessions) > 1 {
+			s += "<p><a class=\"careful\" href=\"/sessions/revoke-others\">Log out everywhere else</a></p>"
+		}
+		return s
+	}
+}
+
+func (ue *UserEngine) GenerateRevokeSession() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		username := LoggedInUsername(ue.state, req)
+		if username == "" {
+			return MessageOKback("Sessions", "Not logged in")
+		}
+		session, err := ue.sessions.Get(mux.Vars(req)["id"])
+		if err != nil || session.Username != username {
+			return MessageOKurl("Sessions", noSessionErr.Error(), "/sessions")
+		}
+		ue.sessions.Revoke(session.ID)
+		return MessageOKurl("Sessions", "OK, the session from "+CleanUserInput(session.IP)+" has been logged out.", "/sessions")
+	}
+}
+
+func (ue *UserEngine) GenerateRevokeOtherSessions() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		username := LoggedInUsername(ue.state, req)
+		if username == "" {
+			return MessageOKback("Sessions", "Not logged in")
+		}
+		current := ue.currentSession(req)
+		sessions, err := ue.sessions.ForUser(username)
+		if err != nil {
+			return MessageOKback("Sessions", "Could not retrieve the sessions")
+		}
+		for _, session := range sessions {
+			if current == nil || session.ID != current.ID {
+				ue.sessions.Revoke(session.ID)
+			}
+		}
+		return MessageOKurl("Sessions", "OK, you are now only logged in here.", "/sessions")
+	}
+}
+
+// Log out a user everywhere, for administrators
+func (ue *UserEngine) GenerateForceLogout() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		if !HasAdminRights(ue.state, req) {
+			return MessageOKback("Force logout", "Not logged in as Administrator")
+		}
+		username := FindUsername(ue.state, mux.Vars(req)["username"])
+		if username == "" {
+			return MessageOKback("Force logout", "Can't log out non-existing user")
+		}
+		ue.sessions.RevokeAll(username)
+		ue.apiTokens.RevokeAll(username)
+		ue.state.SetLoggedOut(username)
+		return MessageOKurl("Force logout", "OK, "+username+" has been logged out everywhere, and the API tokens have been revoked.", "/admin")
+	}
+}
+
+func (ue *UserEngine) ServeSessionPages(r *mux.Router, basecp BaseCP, menuEntries MenuEntries) {
+	sessionsCP := basecp(ue.state)
+	sessionsCP.ContentTitle = "Sessions"
+
+	tvgf := DynamicMenuFactoryGenerator(menuEntries)
+	tvg := tvgf(ue.state)
+
+	r.HandleFunc("/sessions", sessionsCP.WrapSimpleContextHandle(r, ue.GenerateSessionsPage(), tvg)).Methods("GET")
+	r.Handle("/sessions/revoke-others", ue.GenerateRevokeOtherSessions()).Methods("GET")
+	r.Handle("/sessions/revoke/{id}", ue.GenerateRevokeSession()).Methods("GET")
+	r.Handle("/sessions/logout/{username}", ue.GenerateForceLogout()).Methods("GET")
+}
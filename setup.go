@@ -0,0 +1,230 @@
+package siteengines
+
+import (
+	"crypto/subtle"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	. "github.com/xyproto/genericsite"
+	"github.com/xyproto/pinterface"
+	. "github.com/xyproto/webhandle"
+)
+
+// This part creates the first administrator, with a setup token that is
+// printed at startup or read from a file
+
+var (
+	setupDoneErr  = errors.New("There is already an administrator.")
+	setupTokenErr = errors.New("Wrong setup token.")
+)
+
+type AdminSetup struct {
+	state    pinterface.IUserState
+	filename string // Read the setup token from this file, instead of generating one
+	hash     string // The hash of the setup token, or empty if there is none
+	mut      sync.Mutex
+}
+
+func NewAdminSetup(state pinterface.IUserState) *AdminSetup {
+	return &AdminSetup{state: state}
+}
+
+// Read the setup token from a file, instead of generating and printing one.
+// Must be called before the pages are served.
+func (as *AdminSetup) SetTokenFile(filename string) {
+	as.mut.Lock()
+	defer as.mut.Unlock()
+	as.filename = filename
+}
+
+// Check if there are no administrators yet
+func (as *AdminSetup) Needed() bool {
+	usernames, err := as.state.AllUsernames()
+	if err != nil {
+		return false
+	}
+	for _, username := range usernames {
+		if as.state.IsAdmin(username) {
+			return false
+		}
+	}
+	return true
+}
+
+// Prepare the setup token, if there are no administrators
+func (as *AdminSetup) Start() error {
+	if !as.Needed() {
+		return nil
+	}
+	as.mut.Lock()
+	defer as.mut.Unlock()
+	return as.newToken()
+}
+
+// Prepare a new setup token if there are no administrators, but the setup token
+// has already been used. This happens when the last administrator is removed.
+func (as *AdminSetup) Renew() error {
+	if !as.Needed() {
+		return nil
+	}
+	as.mut.Lock()
+	defer as.mut.Unlock()
+	if as.hash != "" {
+		return nil
+	}
+	return as.newToken()
+}
+
+// Read the setup token from the file, or generate and print one. Must be called with the lock.
+func (as *AdminSetup) newToken() error {
+	if as.filename != "" {
+		data, err := ioutil.ReadFile(as.filename)
+		if err != nil {
+			return err
+		}
+		token := strings.TrimSpace(string(data))
+		if token == "" {
+			return errors.New("The setup token in " + as.filename + " is empty.")
+		}
+		as.hash = hashToken(token)
+		log.Println("There are no administrators. Create one at /setup, with the setup token from " + as.filename)
+		return nil
+	}
+	token, err := randomToken()
+	if err != nil {
+		return err
+	}
+	as.hash = hashToken(token)
+	log.Println("There are no administrators. Create one at /setup, with this setup token: " + token)
+	return nil
+}
+
+// Use up the setup token. Returns an error if it is wrong or already used.
+func (as *AdminSetup) Use(token string) error {
+	as.mut.Lock()
+	defer as.mut.Unlock()
+	if !as.Needed() {
+		return setupDoneErr
+	}
+	if as.hash == "" {
+		// The last administrator has been removed since the setup token was used
+		if err := as.newToken(); err != nil {
+			return err
+		}
+	}
+	if subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(as.hash)) != 1 {
+		return setupTokenErr
+	}
+	as.hash = ""
+	return nil
+}
+
+// Read the setup token for the first administrator from a file, instead of printing one at startup
+func (ue *UserEngine) SetSetupTokenFile(filename string) {
+	ue.setup.SetTokenFile(filename)
+}
+
+func (ue *UserEngine) GenerateSetupForm() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		if !ue.setup.Needed() {
+			return "<div class=\"no\">" + setupDoneErr.Error() + "</div>"
+		}
+		if err := ue.setup.Renew(); err != nil {
+			return "<div class=\"no\">Could not prepare the setup token: " + err.Error() + "</div>"
+		}
+		s := "<p>Create the first administrator. The setup token was printed when the server started.</p>"
+		s += "<form method=\"POST\" action=\"/setup\">"
+		s += "Setup token: <input type=\"password\" name=\"token\"><br />"
+		s += "Username: <input name=\"username\"><br />"
+		s += "Password: <input type=\"password\" name=\"password1\"><br />"
+		s += "Confirm password: <input type=\"password\" name=\"password2\"><br />"
+		s += "Email: <input name=\"email\"><br />"
+		s += "<input type=\"submit\" value=\"Create administrator\">"
+		s += "</form>"
+		return s
+	}
+}
+
+// Create the first administrator. The setup token takes the place of the confirmation email.
+func (ue *UserEngine) GenerateSetup() StringHandle {
+	state := ue.state
+	return func(w http.ResponseWriter, req *http.Request) string {
+		if !ue.setup.Needed() {
+			return MessageOKurl("Setup", setupDoneErr.Error(), "/login")
+		}
+		ip := ClientIP(req)
+		if wait, ok := ue.throttle.Wait(ip, ""); ok {
+			return MessageOKback("Setup", "Too many wrong setup tokens. Try again in "+formatWait(wait)+".")
+		}
+		password1 := req.FormValue("password1")
+		if password1 == "" {
+			return MessageOKback("Setup", "Can't register without a password.")
+		}
+		if password1 != req.FormValue("password2") {
+			return MessageOKback("Setup", "The password and confirmation password must be equal.")
+		}
+		email := req.FormValue("email")
+		if !strings.Contains(email, "@") || !strings.Contains(email, ".") || strings.Contains(email, " ") || email != CleanUserInput(email) {
+			return MessageOKback("Setup", "Please use a valid email address.")
+		}
+		username := req.FormValue("username")
+		if username == "" {
+			return MessageOKback("Setup", "Can't register without a username.")
+		}
+		if err := ValidUsernamePassword(username, password1); err != nil {
+			return MessageOKback("Setup", err.Error())
+		}
+		if FindUsername(state, username) != "" {
+			return MessageOKback("Setup", "That user already exists, try another username.")
+		}
+		// The administrator may use a reserved username, but not one that looks like an existing user
+		if other := ue.skeletons.Confusable(username); other != "" && state.HasUser(other) {
+			return MessageOKback("Setup", "That username looks too much like "+other+", try another username.")
+		}
+		if err := ue.setup.Use(req.FormValue("token")); err != nil {
+			if err == setupTokenErr {
+				ue.throttle.Failed(ip, "")
+			}
+			return MessageOKback("Setup", err.Error())
+		}
+		state.AddUser(username, password1, email)
+		AddUsernameKey(state, username)
+		ue.skeletons.Add(username)
+		state.MarkConfirmed(username)
+		state.SetAdminStatus(username)
+		return MessageOKurl("Setup", "The administrator "+username+" has been created, you can now log in.", "/login")
+	}
+}
+
+// Serve the setup pages in the site layout. If this is not called before ServePages,
+// ServePages serves them without the layout.
+func (ue *UserEngine) ServeSetupPages(r *mux.Router, basecp BaseCP, menuEntries MenuEntries) {
+	setupCP := basecp(ue.state)
+	setupCP.ContentTitle = "Setup"
+
+	tvgf := DynamicMenuFactoryGenerator(menuEntries)
+	tvg := tvgf(ue.state)
+
+	ue.serveSetup(r, setupCP.WrapSimpleContextHandle(r, ue.GenerateSetupForm(), tvg))
+}
+
+// Prepare the setup token and serve the setup pages with the given form page, only once
+func (ue *UserEngine) serveSetup(r *mux.Router, form func(w http.ResponseWriter, req *http.Request)) {
+	ue.mut.Lock()
+	served := ue.setupServed
+	ue.setupServed = true
+	ue.mut.Unlock()
+	if served {
+		return
+	}
+	if err := ue.setup.Start(); err != nil {
+		panic("ERROR: Could not prepare the setup token: " + err.Error())
+	}
+	r.HandleFunc("/setup", form).Methods("GET")
+	r.Handle("/setup", ue.GenerateSetup()).Methods("POST")
+}
@@ -1,11 +1,12 @@
 package siteengines
 
 import (
+	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/hoisie/web"
+	"github.com/gorilla/mux"
 	"github.com/xyproto/calendar"
 	. "github.com/xyproto/genericsite"
 	"github.com/xyproto/personplan"
@@ -60,7 +61,40 @@ func NewTimeTableEngine(userState pinterface.IUserState) (*TimeTableEngine, erro
 	}
 }
 
-func (tte *TimeTableEngine) ServePages(basecp BaseCP, menuEntries MenuEntries) {
+func (tte *TimeTableEngine) Name() string {
+	return "timetable"
+}
+
+func (tte *TimeTableEngine) MenuLinks() []string {
+	return []string{"TimeTable:/timetable"}
+}
+
+func (tte *TimeTableEngine) ServeEngine(r *mux.Router, ec *EngineConfig) {
+	tte.ServePages(r, ec.BaseCP, ec.MenuEntries)
+}
+
+// The plans of the user, which are stored with the username as the owner
+func (tte *TimeTableEngine) ExportPersonalData(username string) (interface{}, error) {
+	plans := tte.timeTableState.plans
+	keys, err := plans.Keys(username)
+	if err != nil {
+		return nil, err
+	}
+	data := make(map[string]string)
+	for _, key := range keys {
+		if value, err := plans.Get(username, key); err == nil {
+			data[key] = value
+		}
+	}
+	return map[string]interface{}{"plans": data}, nil
+}
+
+// Remove the plans of the user
+func (tte *TimeTableEngine) ErasePersonalData(username string) error {
+	return tte.timeTableState.plans.Del(username)
+}
+
+func (tte *TimeTableEngine) ServePages(r *mux.Router, basecp BaseCP, menuEntries MenuEntries) {
 	timeTableCP := basecp(tte.state)
 
 	timeTableCP.ContentTitle = "TimeTable"
@@ -69,9 +103,9 @@ func (tte *TimeTableEngine) ServePages(basecp BaseCP, menuEntries MenuEntries) {
 	tvgf := DynamicMenuFactoryGenerator(menuEntries)
 	tvg := tvgf(tte.state)
 
-	web.Get("/timetable", tte.GenerateTimeTableRedirect())                                  // Redirect to /timeTable/main
-	web.Get("/timetable/(.*)", timeTableCP.WrapWebHandle(tte.GenerateShowTimeTable(), tvg)) // Displaying timeTable pages
-	web.Get("/css/timetable.css", tte.GenerateCSS(timeTableCP.ColorScheme))                 // CSS that is specific for timeTable pages
+	r.Handle("/timetable", tte.GenerateTimeTableRedirect()).Methods("GET")                                                         // Redirect to /timeTable/main
+	r.HandleFunc("/timetable/{userdate}", timeTableCP.WrapSimpleContextHandle(r, tte.GenerateShowTimeTable(), tvg)).Methods("GET") // Displaying timeTable pages
+	r.Handle("/css/timetable.css", tte.GenerateCSS(timeTableCP.ColorScheme)).Methods("GET")                                        // CSS that is specific for timeTable pages
 }
 
 func AllPlansDummyContent() *personplan.Plans {
@@ -169,8 +203,9 @@ func Num2dd(num int) string {
 	return s
 }
 
-func (we *TimeTableEngine) GenerateShowTimeTable() WebHandle {
-	return func(ctx *web.Context, userdate string) string {
+func (we *TimeTableEngine) GenerateShowTimeTable() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		userdate := mux.Vars(req)["userdate"]
 		date := CleanUserInput(userdate)
 		ymd := strings.Split(date, "-")
 		if len(ymd) != 3 {
@@ -199,18 +234,18 @@ func (we *TimeTableEngine) GenerateShowTimeTable() WebHandle {
 	}
 }
 
-func (we *TimeTableEngine) GenerateTimeTableRedirect() SimpleContextHandle {
-	return func(ctx *web.Context) string {
+func (we *TimeTableEngine) GenerateTimeTableRedirect() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
 		t := time.Now()
 		// Redirect to the current date on the form yyyy-mm-dd
-		ctx.SetHeader("Refresh", "0; url=/timetable/"+t.String()[:10], true)
+		w.Header().Set("Refresh", "0; url=/timetable/"+t.String()[:10])
 		return ""
 	}
 }
 
-func (tte *TimeTableEngine) GenerateCSS(cs *ColorScheme) SimpleContextHandle {
-	return func(ctx *web.Context) string {
-		ctx.ContentType("css")
+func (tte *TimeTableEngine) GenerateCSS(cs *ColorScheme) StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		w.Header().Add("Content-Type", "text/css")
 		return `
 .even {
 	background-color: "a0a0a0;
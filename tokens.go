@@ -0,0 +1,116 @@
+package siteengines
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/xyproto/pinterface"
+)
+
+var invalidTokenErr = errors.New("The link is invalid or has expired.")
+
+// Generate a random token that can be used in URLs
+func randomToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Tokens are only stored as hashes, so that they can't be used if the database leaks
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Single use tokens that expire, for links that are sent by email.
+// Each user has at most one valid token.
+type OneTimeTokens struct {
+	tokens   pinterface.IHashMap  // The token hashes, with "username" and "expires" fields
+	current  pinterface.IKeyValue // The current token hash for each username
+	duration time.Duration
+	mut      sync.Mutex // So that a token can only be used once
+}
+
+// Create a token store with the given name, ie. "passwordReset"
+func NewOneTimeTokens(state pinterface.IUserState, name string, duration time.Duration) (*OneTimeTokens, error) {
+	creator := state.Creator()
+	ott := &OneTimeTokens{duration: duration}
+	if tokensHashMap, err := creator.NewHashMap(name + "Tokens"); err != nil {
+		return nil, err
+	} else {
+		ott.tokens = tokensHashMap
+	}
+	if currentKeyValue, err := creator.NewKeyValue(name + "Current"); err != nil {
+		return nil, err
+	} else {
+		ott.current = currentKeyValue
+	}
+	return ott, nil
+}
+
+// Create a new token for the user. Any previous token stops working.
+func (ott *OneTimeTokens) Issue(username string) (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	ott.Revoke(username)
+	hash := hashToken(token)
+	if err := ott.tokens.Set(hash, "username", username); err != nil {
+		return "", err
+	}
+	if err := ott.tokens.Set(hash, "expires", time.Now().Add(ott.duration).UTC().Format(time.RFC3339)); err != nil {
+		return "", err
+	}
+	if err := ott.current.Set(username, hash); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Find the user a token belongs to, without using it up
+func (ott *OneTimeTokens) Check(token string) (string, error) {
+	hash := hashToken(token)
+	username, err := ott.tokens.Get(hash, "username")
+	if err != nil {
+		return "", invalidTokenErr
+	}
+	expires, err := ott.tokens.Get(hash, "expires")
+	if err != nil {
+		return "", invalidTokenErr
+	}
+	when, err := time.Parse(time.RFC3339, expires)
+	if err != nil || time.Now().After(when) {
+		ott.Revoke(username)
+		return "", invalidTokenErr
+	}
+	return username, nil
+}
+
+// Use up a token, and return the user it belongs to
+func (ott *OneTimeTokens) Use(token string) (string, error) {
+	ott.mut.Lock()
+	defer ott.mut.Unlock()
+	username, err := ott.Check(token)
+	if err != nil {
+		return "", err
+	}
+	ott.Revoke(username)
+	return username, nil
+}
+
+// Make the token of a user stop working
+func (ott *OneTimeTokens) Revoke(username string) error {
+	hash, err := ott.current.Get(username)
+	if err != nil {
+		return nil
+	}
+	ott.tokens.Del(hash)
+	return ott.current.Del(username)
+}
@@ -0,0 +1,552 @@
+package siteengines
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	. "github.com/xyproto/genericsite"
+	"github.com/xyproto/pinterface"
+	. "github.com/xyproto/webhandle"
+)
+
+// This part is about two-factor authentication with TOTP (RFC 6238),
+// as used by authenticator apps, and single use recovery codes.
+
+const (
+	totpPeriod         = 30 // Seconds per code
+	totpDigits         = 6
+	recoveryCodeCount  = 10
+	maxTwoFactorTries  = 5               // Wrong codes before the password must be given again
+	twoFactorLoginTime = 5 * time.Minute // How long the second step of logging in can take
+)
+
+var (
+	wrongCodeErr      = errors.New("Wrong code.")
+	noTwoFactorErr    = errors.New("Two-factor authentication is not enabled.")
+	twoFactorSetupErr = errors.New("Two-factor authentication has not been set up.")
+
+	base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// Generate a new random TOTP secret, base32 encoded
+func newTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base32NoPadding.EncodeToString(b), nil
+}
+
+// The HOTP code (RFC 4226) for the given counter
+func hotpCode(secret []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulo := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		modulo *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%modulo)
+}
+
+// The TOTP counter for the given time
+func totpCounter(t time.Time) uint64 {
+	return uint64(t.Unix() / totpPeriod)
+}
+
+// Check a TOTP code, allowing one period of clock drift in each direction.
+// Returns the counter that matched, so that the code can't be used again.
+func checkTOTP(secret, code string, now time.Time) (uint64, bool) {
+	key, err := base32NoPadding.DecodeString(strings.ToUpper(secret))
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	counter := totpCounter(now)
+	for _, c := range []uint64{counter - 1, counter, counter + 1} {
+		if subtle.ConstantTimeCompare([]byte(hotpCode(key, c)), []byte(code)) == 1 {
+			return c, true
+		}
+	}
+	return 0, false
+}
+
+// Generate a recovery code, like "k3j5d-9vqpa"
+func newRecoveryCode() (string, error) {
+	b := make([]byte, 7)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	s := strings.ToLower(base32NoPadding.EncodeToString(b))[:10]
+	return s[:5] + "-" + s[5:], nil
+}
+
+// The secrets and recovery codes for two-factor authentication
+type TwoFactor struct {
+	state    pinterface.IUserState
+	users    pinterface.IHashMap  // Usernames, with "secret", "pending", "lastcounter" and "failures" fields
+	recovery pinterface.IHashMap  // Usernames, with the hashes of the unused recovery codes as keys
+	settings pinterface.IKeyValue // "requireForAdmins"
+	logins   *OneTimeTokens       // For the second step of logging in
+	mut      sync.Mutex           // So that codes can only be used once
+}
+
+func NewTwoFactor(state pinterface.IUserState) (*TwoFactor, error) {
+	creator := state.Creator()
+	tf := &TwoFactor{state: state}
+	if usersHashMap, err := creator.NewHashMap("twoFactor"); err != nil {
+		return nil, err
+	} else {
+		tf.users = usersHashMap
+	}
+	if recoveryHashMap, err := creator.NewHashMap("twoFactorRecovery"); err != nil {
+		return nil, err
+	} else {
+		tf.recovery = recoveryHashMap
+	}
+	// Not "twoFactor", since "twoFactor:requireForAdmins" is the same key as the hash map element
+	if settingsKeyValue, err := creator.NewKeyValue("twoFactorSettings"); err != nil {
+		return nil, err
+	} else {
+		tf.settings = settingsKeyValue
+	}
+	// Keep the setting that was stored there before
+	if oldKeyValue, err := creator.NewKeyValue("twoFactor"); err == nil {
+		if value, err := oldKeyValue.Get("requireForAdmins"); err == nil {
+			if err := tf.settings.Set("requireForAdmins", value); err != nil {
+				return nil, err
+			}
+			oldKeyValue.Del("requireForAdmins")
+		}
+	}
+	if logins, err := NewOneTimeTokens(state, "twoFactorLogin", twoFactorLoginTime); err != nil {
+		return nil, err
+	} else {
+		tf.logins = logins
+	}
+	return tf, nil
+}
+
+// Check if a user has two-factor authentication enabled
+func (tf *TwoFactor) Enabled(username string) bool {
+	has, err := tf.users.Has(username, "secret")
+	return err == nil && has
+}
+
+// Check if a user must use two-factor authentication to log in
+func (tf *TwoFactor) Required(username string) bool {
+	return tf.RequiredForAdmins() && tf.state.IsAdmin(username)
+}
+
+func (tf *TwoFactor) RequiredForAdmins() bool {
+	value, err := tf.settings.Get("requireForAdmins")
+	return err == nil && value == "true"
+}
+
+// Require two-factor authentication for all administrators
+func (tf *TwoFactor) SetRequiredForAdmins(required bool) error {
+	if required {
+		return tf.settings.Set("requireForAdmins", "true")
+	}
+	return tf.settings.Del("requireForAdmins")
+}
+
+// Start setting up two-factor authentication, and return the secret for the app
+func (tf *TwoFactor) Begin(username string) (string, error) {
+	if secret, err := tf.users.Get(username, "pending"); err == nil {
+		return secret, nil
+	}
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return "", err
+	}
+	return secret, tf.users.Set(username, "pending", secret)
+}
+
+// The link for adding the secret to an authenticator app, as a QR code.
+// Issuer is ie. "archlinux.no".
+func (tf *TwoFactor) QRCode(issuer, username, secret string) (string, error) {
+	link := "otpauth://totp/" + url.PathEscape(issuer+":"+username) + "?secret=" + secret + "&issuer=" + url.QueryEscape(issuer)
+	return QRCodeSVG(link, 4)
+}
+
+// Finish setting up two-factor authentication, with the first code from the app.
+// Returns the recovery codes.
+func (tf *TwoFactor) Enable(username, code string) ([]string, error) {
+	tf.mut.Lock()
+	defer tf.mut.Unlock()
+	secret, err := tf.users.Get(username, "pending")
+	if err != nil {
+		return nil, twoFactorSetupErr
+	}
+	counter, ok := checkTOTP(secret, strings.TrimSpace(code), time.Now())
+	if !ok {
+		return nil, wrongCodeErr
+	}
+	if err := tf.users.Set(username, "secret", secret); err != nil {
+		return nil, err
+	}
+	tf.users.DelKey(username, "pending")
+	tf.users.Set(username, "lastcounter", strconv.FormatUint(counter, 10))
+	return tf.newRecoveryCodes(username)
+}
+
+// Turn off two-factor authentication for a user
+func (tf *TwoFactor) Disable(username string) error {
+	tf.recovery.Del(username)
+	return tf.users.Del(username)
+}
+
+// Check a code from the app, or a recovery code. Each code can only be used once.
+func (tf *TwoFactor) Verify(username, code string) error {
+	tf.mut.Lock()
+	defer tf.mut.Unlock()
+	secret, err := tf.users.Get(username, "secret")
+	if err != nil {
+		return noTwoFactorErr
+	}
+	code = strings.ToLower(strings.TrimSpace(code))
+	if strings.Contains(code, "-") {
+		// A recovery code
+		hash := hashToken(code)
+		if has, err := tf.recovery.Has(username, hash); err != nil || !has {
+			return wrongCodeErr
+		}
+		return tf.recovery.DelKey(username, hash)
+	}
+	counter, ok := checkTOTP(secret, code, time.Now())
+	if !ok {
+		return wrongCodeErr
+	}
+	if last, err := tf.users.Get(username, "lastcounter"); err == nil {
+		if lastCounter, err := strconv.ParseUint(last, 10, 64); err == nil && counter <= lastCounter {
+			// The code has already been used
+			return wrongCodeErr
+		}
+	}
+	return tf.users.Set(username, "lastcounter", strconv.FormatUint(counter, 10))
+}
+
+// Replace the recovery codes of a user, and return the new ones
+func (tf *TwoFactor) NewRecoveryCodes(username string) ([]string, error) {
+	tf.mut.Lock()
+	defer tf.mut.Unlock()
+	if !tf.Enabled(username) {
+		return nil, noTwoFactorErr
+	}
+	return tf.newRecoveryCodes(username)
+}
+
+func (tf *TwoFactor) newRecoveryCodes(username string) ([]string, error) {
+	tf.recovery.Del(username)
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		code, err := newRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		if err := tf.recovery.Set(username, hashToken(code), "unused"); err != nil {
+			return nil, err
+		}
+		codes[i] = code
+	}
+	return codes, nil
+}
+
+// The number of recovery codes a user has left
+func (tf *TwoFactor) RecoveryCodesLeft(username string) int {
+	hashes, err := tf.recovery.Keys(username)
+	if err != nil {
+		return 0
+	}
+	return len(hashes)
+}
+
+// Count a wrong code while logging in, and return true if there have been too many.
+// The count is kept when the password is given again, and is only reset by a correct code.
+func (tf *TwoFactor) failed(username string) bool {
+	failures := 0
+	if s, err := tf.users.Get(username, "failures"); err == nil {
+		failures, _ = strconv.Atoi(s)
+	}
+	failures++
+	tf.users.Set(username, "failures", strconv.Itoa(failures))
+	return failures >= maxTwoFactorTries
+}
+
+// Reset the count of wrong codes, after a correct code
+func (tf *TwoFactor) succeeded(username string) {
+	tf.users.DelKey(username, "failures")
+}
+
+func (ue *UserEngine) TwoFactor() *TwoFactor {
+	return ue.twoFactor
+}
+
+// Show the recovery codes, which are only shown once
+func recoveryCodesHTML(codes []string) string {
+	return "<p>Keep these recovery codes somewhere safe. Each of them can be used once instead of a code from the app. They will not be shown again.</p><pre>" + strings.Join(codes, "\n") + "</pre>"
+}
+
+// The form for setting up two-factor authentication, with the QR code for the app
+func (ue *UserEngine) twoFactorSetupForm(site, username, action string) string {
+	secret, err := ue.twoFactor.Begin(username)
+	if err != nil {
+		return "<div class=\"no\">Could not set up two-factor authentication</div>"
+	}
+	svg, err := ue.twoFactor.QRCode(site, username, secret)
+	if err != nil {
+		return "<div class=\"no\">Could not set up two-factor authentication</div>"
+	}
+	s := "<p>Scan the QR code with an authenticator app, or enter this key in the app: <code>" + secret + "</code></p>"
+	s += svg
+	s += "<form method=\"POST\" action=\"" + action + "\">"
+	s += "Code from the app: <input name=\"code\" autocomplete=\"one-time-code\"> "
+	s += "<input type=\"submit\" value=\"Enable\">"
+	s += "</form>"
+	return s
+}
+
+// A form that asks for a code, for the actions on the two-factor page
+func twoFactorCodeForm(action, buttonText string) string {
+	s := "<form method=\"POST\" action=\"" + action + "\">"
+	s += "Code: <input name=\"code\" autocomplete=\"one-time-code\"> "
+	s += "<input type=\"submit\" value=\"" + buttonText + "\">"
+	s += "</form>"
+	return s
+}
+
+// The two-factor authentication page for the current user. Site is ie. "archlinux.no".
+func (ue *UserEngine) GenerateTwoFactorPage(site string) StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		username := LoggedInUsername(ue.state, req)
+		if username == "" {
+			return "<div class=\"no\">Not logged in</div>"
+		}
+		if !ue.twoFactor.Enabled(username) {
+			return ue.twoFactorSetupForm(site, username, "/2fa/enable")
+		}
+		s := "<p>Two-factor authentication is enabled. You have " + strconv.Itoa(ue.twoFactor.RecoveryCodesLeft(username)) + " recovery codes left.</p>"
+		s += "<p>Get new recovery codes:</p>"
+		s += twoFactorCodeForm("/2fa/recovery", "New recovery codes")
+		if !ue.twoFactor.Required(username) {
+			s += "<p>Turn off two-factor authentication:</p>"
+			s += twoFactorCodeForm("/2fa/disable", "Disable")
+		}
+		return s
+	}
+}
+
+func (ue *UserEngine) GenerateEnableTwoFactor() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		username := LoggedInUsername(ue.state, req)
+		if username == "" {
+			return MessageOKback("Two-factor authentication", "Not logged in")
+		}
+		codes, err := ue.twoFactor.Enable(username, req.FormValue("code"))
+		if err != nil {
+			return MessageOKback("Two-factor authentication", err.Error())
+		}
+		return MessageOKurl("Two-factor authentication", "OK, two-factor authentication is now enabled."+recoveryCodesHTML(codes), "/2fa")
+	}
+}
+
+func (ue *UserEngine) GenerateDisableTwoFactor() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		username := LoggedInUsername(ue.state, req)
+		if username == "" {
+			return MessageOKback("Two-factor authentication", "Not logged in")
+		}
+		if ue.twoFactor.Required(username) {
+			return MessageOKback("Two-factor authentication", "Two-factor authentication is required for administrators.")
+		}
+		if err := ue.twoFactor.Verify(username, req.FormValue("code")); err != nil {
+			return MessageOKback("Two-factor authentication", err.Error())
+		}
+		ue.twoFactor.Disable(username)
+		return MessageOKurl("Two-factor authentication", "OK, two-factor authentication is now disabled.", "/2fa")
+	}
+}
+
+func (ue *UserEngine) GenerateNewRecoveryCodes() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		username := LoggedInUsername(ue.state, req)
+		if username == "" {
+			return MessageOKback("Recovery codes", "Not logged in")
+		}
+		if err := ue.twoFactor.Verify(username, req.FormValue("code")); err != nil {
+			return MessageOKback("Recovery codes", err.Error())
+		}
+		codes, err := ue.twoFactor.NewRecoveryCodes(username)
+		if err != nil {
+			return MessageOKback("Recovery codes", err.Error())
+		}
+		return MessageOKurl("Recovery codes", "OK, the old recovery codes no longer work."+recoveryCodesHTML(codes), "/2fa")
+	}
+}
+
+// Let administrators require two-factor authentication for all administrators
+func (ue *UserEngine) GenerateRequireTwoFactor(required bool) StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		if !HasAdminRights(ue.state, req) {
+			return MessageOKback("Two-factor authentication", "Not logged in as Administrator")
+		}
+		if required && !ue.twoFactor.Enabled(LoggedInUsername(ue.state, req)) {
+			return MessageOKurl("Two-factor authentication", "Please set up two-factor authentication for yourself first.", "/2fa")
+		}
+		if err := ue.twoFactor.SetRequiredForAdmins(required); err != nil {
+			return MessageOKback("Two-factor authentication", err.Error())
+		}
+		if required {
+			if err := ue.logOutAdminsWithoutTwoFactor(); err != nil {
+				return MessageOKback("Two-factor authentication", "Two-factor authentication is now required, but not all administrators could be logged out.")
+			}
+			return MessageOKurl("Two-factor authentication", "OK, administrators must now use two-factor authentication. Administrators that have not set it up have been logged out, and will be asked to do so when logging in.", "/admin")
+		}
+		return MessageOKurl("Two-factor authentication", "OK, two-factor authentication is now optional for administrators.", "/admin")
+	}
+}
+
+// Log out the administrators that have not set up two-factor authentication,
+// so that they have to set it up when logging in again
+func (ue *UserEngine) logOutAdminsWithoutTwoFactor() error {
+	usernames, err := ue.state.AllUsernames()
+	if err != nil {
+		return err
+	}
+	for _, username := range usernames {
+		if !ue.state.IsAdmin(username) || ue.twoFactor.Enabled(username) {
+			continue
+		}
+		if err := ue.sessions.RevokeAll(username); err != nil {
+			return err
+		}
+		ue.state.SetLoggedOut(username)
+	}
+	return nil
+}
+
+// Start the second step of logging in, for users with two-factor authentication
+func (ue *UserEngine) beginTwoFactorLogin(w http.ResponseWriter, req *http.Request, username string) string {
+	token, err := ue.twoFactor.logins.Issue(username)
+	if err != nil {
+		return MessageOKback("Login", "Could not log in, please try again later.")
+	}
+	path := "/login/2fa/" + token
+	if next := sameOriginPath(req, req.FormValue("next")); next != "" {
+		path += "?next=" + url.QueryEscape(next)
+	}
+	w.Header().Set("Refresh", "0; url="+path)
+	return ""
+}
+
+// The second step of logging in, which asks for a code, or sets up two-factor
+// authentication if it is required. Site is ie. "archlinux.no".
+func (ue *UserEngine) GenerateTwoFactorLoginForm(site string) StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		token := mux.Vars(req)["token"]
+		username, err := ue.twoFactor.logins.Check(token)
+		if err != nil {
+			return "<div class=\"no\">" + invalidTokenErr.Error() + " <a href=\"/login\">Log in again</a></div>"
+		}
+		action := "/login/2fa/" + token
+		if next := sameOriginPath(req, req.FormValue("next")); next != "" {
+			action += "?next=" + url.QueryEscape(next)
+		}
+		if !ue.twoFactor.Enabled(username) {
+			return "<p>Administrators must use two-factor authentication.</p>" + ue.twoFactorSetupForm(site, username, action)
+		}
+		s := "<p>Enter the code from the authenticator app, or a recovery code.</p>"
+		s += twoFactorCodeForm(action, "Log in")
+		return s
+	}
+}
+
+// Check the code in the second step of logging in. Wrong codes count as failed logins,
+// so that they are slowed down and lock the account like wrong passwords.
+func (ue *UserEngine) GenerateTwoFactorLogin(site string) StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		token := mux.Vars(req)["token"]
+		username, err := ue.twoFactor.logins.Check(token)
+		if err != nil {
+			return MessageOKurl("Login", invalidTokenErr.Error(), "/login")
+		}
+		ip := ClientIP(req)
+		if wait, ok := ue.throttle.Wait(ip, username); ok {
+			return MessageOKback("Login", "Too many failed logins for "+username+". Try again in "+formatWait(wait)+".")
+		}
+		var codes []string
+		if ue.twoFactor.Enabled(username) {
+			err = ue.twoFactor.Verify(username, req.FormValue("code"))
+		} else {
+			codes, err = ue.twoFactor.Enable(username, req.FormValue("code"))
+		}
+		if err != nil {
+			locked := ue.loginFailed(site, ip, username)
+			if ue.twoFactor.failed(username) || locked {
+				ue.twoFactor.logins.Revoke(username)
+				if locked {
+					return MessageOKurl("Login", "Wrong code. The account has been locked for a while, because of too many failed logins.", "/login")
+				}
+				return MessageOKurl("Login", "Too many wrong codes, please log in again.", "/login")
+			}
+			return MessageOKback("Login", err.Error())
+		}
+		ue.twoFactor.succeeded(username)
+		if _, err := ue.twoFactor.logins.Use(token); err != nil {
+			return MessageOKurl("Login", invalidTokenErr.Error(), "/login")
+		}
+		extra := ""
+		if codes != nil {
+			extra = recoveryCodesHTML(codes)
+		}
+		return ue.completeLogin(w, req, username, extra)
+	}
+}
+
+// Show if two-factor authentication is required, on the administrator dashboard
+func (ue *UserEngine) twoFactorAdminStatus() string {
+	s := "<strong>Two-factor authentication</strong><br />"
+	if ue.twoFactor.RequiredForAdmins() {
+		s += "Required for administrators. <a class=\"careful\" href=\"/2fa/require/off\">Make optional</a><br />"
+	} else {
+		s += "Optional for administrators. <a class=\"darkgrey\" href=\"/2fa/require/on\">Require</a><br />"
+	}
+	return s
+}
+
+func (ue *UserEngine) ServeTwoFactorPages(r *mux.Router, basecp BaseCP, menuEntries MenuEntries, site string) {
+	twoFactorCP := basecp(ue.state)
+	twoFactorCP.ContentTitle = "Two-factor authentication"
+
+	loginCP := basecp(ue.state)
+	loginCP.ContentTitle = "Login"
+
+	tvgf := DynamicMenuFactoryGenerator(menuEntries)
+	tvg := tvgf(ue.state)
+
+	r.HandleFunc("/2fa", twoFactorCP.WrapSimpleContextHandle(r, ue.GenerateTwoFactorPage(site), tvg)).Methods("GET")
+	r.Handle("/2fa/enable", ue.GenerateEnableTwoFactor()).Methods("POST")
+	r.Handle("/2fa/disable", ue.GenerateDisableTwoFactor()).Methods("POST")
+	r.Handle("/2fa/recovery", ue.GenerateNewRecoveryCodes()).Methods("POST")
+	r.Handle("/2fa/require/on", ue.GenerateRequireTwoFactor(true)).Methods("GET")
+	r.Handle("/2fa/require/off", ue.GenerateRequireTwoFactor(false)).Methods("GET")
+	r.HandleFunc("/login/2fa/{token}", loginCP.WrapSimpleContextHandle(r, ue.GenerateTwoFactorLoginForm(site), tvg)).Methods("GET")
+	r.Handle("/login/2fa/{token}", ue.GenerateTwoFactorLogin(site)).Methods("POST")
+}
@@ -0,0 +1,134 @@
+package siteengines
+
+import (
+	"testing"
+	"time"
+)
+
+// The secret from the test vectors in RFC 4226 and RFC 6238
+const rfcSecret = "12345678901234567890"
+
+func TestHOTPCode(t *testing.T) {
+	// RFC 4226, appendix D
+	expected := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+	for counter, code := range expected {
+		if got := hotpCode([]byte(rfcSecret), uint64(counter)); got != code {
+			t.Errorf("counter %d: got %s, expected %s", counter, got, code)
+		}
+	}
+}
+
+func TestCheckTOTP(t *testing.T) {
+	secret := base32NoPadding.EncodeToString([]byte(rfcSecret))
+	// RFC 6238, appendix B, with the last 6 of the 8 digits
+	tests := []struct {
+		unix int64
+		code string
+		ok   bool
+	}{
+		{59, "287082", true},
+		{1111111109, "081804", true},
+		{1111111111, "050471", true},
+		{1234567890, "005924", true},
+		{2000000000, "279037", true},
+		{20000000000, "353130", true},
+		// One period of clock drift is allowed, but not two
+		{89, "287082", true},
+		{120, "287082", false},
+		{59, "287083", false},
+		{59, "28708", false},
+	}
+	for _, test := range tests {
+		if _, ok := checkTOTP(secret, test.code, time.Unix(test.unix, 0)); ok != test.ok {
+			t.Errorf("%s at %d: got %v, expected %v", test.code, test.unix, ok, test.ok)
+		}
+	}
+	// Lowercase secrets, as typed in by hand, work too
+	if _, ok := checkTOTP("gezdgnbvgy3tqojqgezdgnbvgy3tqojq", "287082", time.Unix(59, 0)); !ok {
+		t.Error("lowercase secret was not accepted")
+	}
+}
+
+// The code from the app for the given secret and time
+func currentCode(t *testing.T, secret string, now time.Time) string {
+	key, err := base32NoPadding.DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hotpCode(key, totpCounter(now))
+}
+
+func TestTwoFactorReplay(t *testing.T) {
+	tf, err := NewTwoFactor(NewMemoryUserState())
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := tf.Begin("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	code := currentCode(t, secret, now)
+	codes, err := tf.Enable("bob", code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tf.Enabled("bob") {
+		t.Fatal("two-factor authentication was not enabled")
+	}
+	// The code that enabled it has been used
+	if err := tf.Verify("bob", code); err != wrongCodeErr {
+		t.Errorf("the setup code could be used again: %v", err)
+	}
+	next := currentCode(t, secret, now.Add(totpPeriod*time.Second))
+	if err := tf.Verify("bob", next); err != nil {
+		t.Errorf("the next code was not accepted: %v", err)
+	}
+	if err := tf.Verify("bob", next); err != wrongCodeErr {
+		t.Errorf("the next code could be used twice: %v", err)
+	}
+	// Recovery codes can also only be used once
+	if len(codes) == 0 {
+		t.Fatal("no recovery codes")
+	}
+	left := tf.RecoveryCodesLeft("bob")
+	if err := tf.Verify("bob", codes[0]); err != nil {
+		t.Errorf("the recovery code was not accepted: %v", err)
+	}
+	if err := tf.Verify("bob", codes[0]); err != wrongCodeErr {
+		t.Errorf("the recovery code could be used twice: %v", err)
+	}
+	if tf.RecoveryCodesLeft("bob") != left-1 {
+		t.Errorf("got %d recovery codes left, expected %d", tf.RecoveryCodesLeft("bob"), left-1)
+	}
+	if err := tf.Verify("alice", next); err != noTwoFactorErr {
+		t.Errorf("got %v for a user without two-factor authentication", err)
+	}
+}
+
+func TestTwoFactorRequired(t *testing.T) {
+	state := NewMemoryUserState()
+	// Where the setting was stored before
+	old, _ := state.Creator().NewKeyValue("twoFactor")
+	old.Set("requireForAdmins", "true")
+	tf, err := NewTwoFactor(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tf.RequiredForAdmins() {
+		t.Error("the old setting was not kept")
+	}
+	// The setting is not listed as a user
+	if usernames, _ := tf.users.All(); len(usernames) != 0 {
+		t.Errorf("got the users %v", usernames)
+	}
+	state.AddUser("bob", "hunter22", "bob@example.com")
+	state.SetAdminStatus("bob")
+	if !tf.Required("bob") || tf.Required("alice") {
+		t.Error("only administrators should be required to use two-factor authentication")
+	}
+	tf.SetRequiredForAdmins(false)
+	if tf.Required("bob") {
+		t.Error("still required after making it optional")
+	}
+}
@@ -2,11 +2,16 @@ package siteengines
 
 import (
 	"errors"
+	"log"
+	"math"
 	"math/rand"
+	"net/http"
+	"net/url"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/hoisie/web"
+	"github.com/gorilla/mux"
 	"github.com/xyproto/cookie"
 	. "github.com/xyproto/genericsite"
 	. "github.com/xyproto/onthefly"
@@ -42,54 +47,479 @@ NEXT:
 // An Engine is a specific piece of a website
 // This part handles the login/logout/registration/confirmation pages
 
+const (
+	// How long a link for resetting the password works
+	passwordResetDuration = time.Hour
+	// How long the "Did you not request this email?" links work
+	notRequestedDuration = 7 * 24 * time.Hour
+)
+
 type UserEngine struct {
-	state pinterface.IUserState
+	state      pinterface.IUserState
+	unapproved pinterface.ISet   // Users that are waiting to be approved by the moderators
+	moderation *ModerationEngine // Holds new registrations until they are approved, may be nil
+	resets     *OneTimeTokens    // For resetting forgotten passwords
+	limits     *emailLimits      // So that the same email is not sent too often
+	mailer     Mailer            // For all emails
+	// The confirmation codes, indexed by code
+	confirmations *ConfirmationCodes
+	invites       *Invites
+	twoFactor     *TwoFactor
+	throttle      *LoginThrottle       // Slows down and locks out repeated failed logins
+	setup         *AdminSetup          // For creating the first administrator
+	sessions      *Sessions            // Each browser or device where a user is logged in
+	emailChanges  *OneTimeTokens       // For confirming new email addresses
+	pendingEmails pinterface.IKeyValue // The new email addresses, until they are confirmed
+	apiTokens     *APITokens           // Personal access tokens, for scripts
+	engines       []Engine             // All enabled engines, for exporting and erasing personal data
+	skeletons     *UsernameSkeletons   // For finding usernames that look like other usernames
+	inviteOnly    bool                 // Only allow registration with invite links
+	setupServed   bool                 // If the setup pages for the first administrator are served
+	mut           sync.RWMutex
+	// For the "Did you not request this email?" links
+	cancelRegistrations *OneTimeTokens
+	cancelResets        *OneTimeTokens
 }
 
 func NewUserEngine(userState pinterface.IUserState) (*UserEngine, error) {
-	// For the secure cookies
-	// This must happen before the random seeding, or
-	// else people will have to log in again after every server restart
-	web.Config.CookieSecret = cookie.RandomCookieFriendlyString(30)
+	// For the secure cookies. The secret of the site is kept, if it has one,
+	// so that people don't have to log in again after every server restart.
+	if userState.CookieSecret() == "" {
+		userState.SetCookieSecret(cookie.RandomCookieFriendlyString(30))
+	}
 
 	rand.Seed(time.Now().UnixNano())
 
-	return &UserEngine{userState}, nil
+	unapproved, err := userState.Creator().NewSet("unapprovedUsers")
+	if err != nil {
+		return nil, err
+	}
+
+	resets, err := NewOneTimeTokens(userState, "passwordReset", passwordResetDuration)
+	if err != nil {
+		return nil, err
+	}
+
+	limits, err := newEmailLimits(userState)
+	if err != nil {
+		return nil, err
+	}
+
+	cancelRegistrations, err := NewOneTimeTokens(userState, "cancelRegistration", notRequestedDuration)
+	if err != nil {
+		return nil, err
+	}
+
+	cancelResets, err := NewOneTimeTokens(userState, "cancelReset", notRequestedDuration)
+	if err != nil {
+		return nil, err
+	}
+
+	confirmations, err := NewConfirmationCodes(userState)
+	if err != nil {
+		return nil, err
+	}
+
+	invites, err := NewInvites(userState)
+	if err != nil {
+		return nil, err
+	}
+
+	skeletons, err := NewUsernameSkeletons(userState)
+	if err != nil {
+		return nil, err
+	}
+
+	// Usernames that only differ in case are shown on the admin dashboard
+	if collisions, err := MigrateUsernameKeys(userState); err != nil {
+		return nil, err
+	} else if len(collisions) > 0 {
+		log.Println("WARNING: There are usernames that only differ in case, see the admin dashboard:", collisions)
+	}
+
+	if err := MigrateUserIPHistory(userState); err != nil {
+		return nil, err
+	}
+
+	twoFactor, err := NewTwoFactor(userState)
+	if err != nil {
+		return nil, err
+	}
+
+	throttle, err := NewLoginThrottle(userState)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions, err := NewSessions(userState)
+	if err != nil {
+		return nil, err
+	}
+
+	emailChanges, err := NewOneTimeTokens(userState, "emailChange", emailChangeDuration)
+	if err != nil {
+		return nil, err
+	}
+
+	pendingEmails, err := userState.Creator().NewKeyValue("pendingEmails")
+	if err != nil {
+		return nil, err
+	}
+
+	apiTokens, err := NewAPITokens(userState)
+	if err != nil {
+		return nil, err
+	}
+
+	ue := &UserEngine{
+		state:               userState,
+		sessions:            sessions,
+		emailChanges:        emailChanges,
+		pendingEmails:       pendingEmails,
+		apiTokens:           apiTokens,
+		throttle:            throttle,
+		setup:               NewAdminSetup(userState),
+		twoFactor:           twoFactor,
+		skeletons:           skeletons,
+		confirmations:       confirmations,
+		invites:             invites,
+		unapproved:          unapproved,
+		resets:              resets,
+		limits:              limits,
+		mailer:              NewSMTPMailer("localhost", 25, "", ""),
+		cancelRegistrations: cancelRegistrations,
+		cancelResets:        cancelResets,
+	}
+	confirmations.removeUser = ue.removeRegistration
+	return ue, nil
 }
 
 func (ue *UserEngine) GetState() pinterface.IUserState {
 	return ue.state
 }
 
-// Create a user by adding the username to the list of usernames
-func GenerateConfirmUser(state pinterface.IUserState) WebHandle {
-	return func(ctx *web.Context, val string) string {
-		confirmationCode := val
+func (ue *UserEngine) Name() string {
+	return "user"
+}
+
+func (ue *UserEngine) MenuLinks() []string {
+	return []string{"Login:/login", "Register:/register", "Account:/account", "Logout:/logout"}
+}
+
+func (ue *UserEngine) ServeEngine(r *mux.Router, ec *EngineConfig) {
+	ue.engines = ec.Engines
+	if ec.Mailer != nil {
+		ue.SetMailer(ec.Mailer)
+	}
+	// Before ServePages, so that the setup pages are in the site layout
+	ue.ServeSetupPages(r, ec.BaseCP, ec.MenuEntries)
+	ue.ServePages(r, ec.Site)
+	ue.ServeSessionPages(r, ec.BaseCP, ec.MenuEntries)
+	ue.ServeAccountSettingsPages(r, ec.BaseCP, ec.MenuEntries, ec.Site)
+	ue.ServeAccountPages(r, ec.BaseCP, ec.MenuEntries, ec.Site)
+	ue.ServeInvitePages(r, ec.BaseCP, ec.MenuEntries, ec.Site)
+	ue.ServeTwoFactorPages(r, ec.BaseCP, ec.MenuEntries, ec.Site)
+}
+
+// Use the given mailer for all emails. The default is SMTP to localhost:25.
+func (ue *UserEngine) SetMailer(mailer Mailer) {
+	ue.mailer = mailer
+}
+
+// Send the confirmation link, with a link for cancelling the registration in the footer
+func (ue *UserEngine) sendConfirmationEmail(site, username, email, confirmationCode string) error {
+	data := &EmailData{
+		Site:      site,
+		Username:  username,
+		Email:     email,
+		Link:      "https://" + site + "/confirm/" + confirmationCode,
+		NotMeLink: "https://" + site + "/not-requested",
+	}
+	if token, err := ue.cancelRegistrations.Issue(username); err == nil {
+		data.NotMeLink += "/registration/" + token
+	}
+	return sendTemplateEmail(ue.mailer, "confirmation", data)
+}
+
+// Send a password reset link, with a link for cancelling the reset in the footer
+func (ue *UserEngine) sendPasswordResetEmail(site, username, email, token string) error {
+	data := &EmailData{
+		Site:      site,
+		Username:  username,
+		Email:     email,
+		Link:      "https://" + site + "/reset/" + token,
+		NotMeLink: "https://" + site + "/not-requested",
+	}
+	if token, err := ue.cancelResets.Issue(username); err == nil {
+		data.NotMeLink += "/reset/" + token
+	}
+	return sendTemplateEmail(ue.mailer, "passwordReset", data)
+}
+
+// Send the usernames that are registered with an email address
+func (ue *UserEngine) sendForgotUsernameEmail(site string, usernames []string, email string) error {
+	return sendTemplateEmail(ue.mailer, "forgotUsername", &EmailData{
+		Site:      site,
+		Usernames: usernames,
+		Email:     email,
+		NotMeLink: "https://" + site + "/not-requested",
+	})
+}
+
+// Tell the owner of an account that it has been locked
+func (ue *UserEngine) sendAccountLockedEmail(site, username, ip string) error {
+	email, err := ue.state.Email(username)
+	if err != nil || !ue.limits.allow("accountLocked", email) {
+		return err
+	}
+	data := &EmailData{
+		Site:     site,
+		Username: username,
+		Email:    email,
+		Link:     "https://" + site + "/forgot-password",
+		IP:       ip,
+		Until:    time.Now().Add(ue.throttle.lockDuration).Format("2006-01-02 15:04 MST"),
+	}
+	if err := sendTemplateEmail(ue.mailer, "accountLocked", data); err != nil {
+		ue.limits.forget("accountLocked", email)
+		return err
+	}
+	return nil
+}
 
-		unconfirmedUsernames, err := state.AllUnconfirmedUsernames()
+// Hold new registrations in the moderation queue
+func (ue *UserEngine) SetModeration(me *ModerationEngine) {
+	ue.moderation = me
+	me.Handle("registration", ModerationHooks{
+		Approved: func(item *ModerationItem) {
+			if ue.heldRegistration(item) {
+				ue.unapproved.Del(item.Data)
+				ue.state.Users().DelKey(item.Data, "moderationitem")
+			}
+		},
+		Rejected: func(item *ModerationItem) {
+			if ue.heldRegistration(item) {
+				ue.removeRegistration(item.Data)
+			}
+		},
+	})
+}
+
+// Check if a moderation item is for the current registration of the user,
+// and not for an earlier user with the same username
+func (ue *UserEngine) heldRegistration(item *ModerationItem) bool {
+	username := item.Data
+	id, err := ue.state.Users().Get(username, "moderationitem")
+	if err != nil {
+		// Held before the item ID was stored for the user
+		waiting, err := ue.unapproved.Has(username)
+		return err == nil && waiting
+	}
+	return id == item.ID
+}
+
+// Put users that have just registered in the moderation queue, if registrations are moderated
+func (ue *UserEngine) holdRegistrations(register StringHandle) StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		username := mux.Vars(req)["username"]
+		existed := ue.state.HasUser(username)
+		s := register(w, req)
+		if existed || !ue.state.HasUser(username) || ue.moderation == nil || !ue.moderation.Holds("registration", username) {
+			return s
+		}
+		summary := "New user " + username
+		if email, err := ue.state.Email(username); err == nil {
+			summary += " (" + CleanUserInput(email) + ")"
+		}
+		if id, err := ue.moderation.Hold("registration", username, summary, username); err == nil {
+			ue.unapproved.Add(username)
+			ue.state.Users().Set(username, "moderationitem", id)
+		}
+		return s
+	}
+}
+
+// Don't let users that are waiting to be approved log in
+func (ue *UserEngine) checkApproved(login StringHandle) StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		username := FindUsername(ue.state, mux.Vars(req)["username"])
+		if waiting, err := ue.unapproved.Has(username); err == nil && waiting {
+			return MessageOKback("Login", "The registration of "+username+" is waiting to be approved by a moderator.")
+		}
+		return login(w, req)
+	}
+}
+
+// Show the invites, the two-factor authentication settings and the login lockouts on the administrator dashboard
+func (ue *UserEngine) AdminStatus(req *http.Request) string {
+	return ue.invitesAdminStatus() + "<br />" + ue.twoFactorAdminStatus() + "<br />" + ue.lockoutsAdminStatus()
+}
+
+// What is stored about a user by the user engine
+type userPersonalData struct {
+	Username       string          `json:"username"`
+	Email          string          `json:"email"`
+	DisplayName    string          `json:"displayname"`
+	Confirmed      bool            `json:"confirmed"`
+	Admin          bool            `json:"admin"`
+	TwoFactor      bool            `json:"twofactor"`
+	Logins         []LoginRecord   `json:"logins"`
+	IPs            []string        `json:"ips"`
+	AccountChanges []AccountChange `json:"accountchanges"`
+	Sessions       []*Session      `json:"sessions"`
+	InvitedBy      string          `json:"invitedby,omitempty"`
+	Invites        []*Invite       `json:"invites"`
+	APITokens      []*APIToken     `json:"apitokens"`
+}
+
+// The user record, with the login, IP and account history
+func (ue *UserEngine) ExportPersonalData(username string) (interface{}, error) {
+	state := ue.state
+	data := &userPersonalData{
+		Username:    username,
+		DisplayName: DisplayName(state, username),
+		Confirmed:   state.IsConfirmed(username),
+		Admin:       state.IsAdmin(username),
+		TwoFactor:   ue.twoFactor.Enabled(username),
+	}
+	data.Email, _ = state.Email(username)
+	var err error
+	if data.Logins, err = LoginHistory(state, username, math.MaxInt32); err != nil {
+		return nil, err
+	}
+	if data.IPs, err = UserIPs(state, username); err != nil {
+		return nil, err
+	}
+	if data.AccountChanges, err = AccountHistory(state, username, math.MaxInt32); err != nil {
+		return nil, err
+	}
+	if data.Sessions, err = ue.sessions.ForUser(username); err != nil {
+		return nil, err
+	}
+	created, usedBy, err := ue.invites.ForUser(username)
+	if err != nil {
+		return nil, err
+	}
+	data.Invites = created
+	if usedBy != nil {
+		data.InvitedBy = usedBy.By
+	}
+	if data.APITokens, err = ue.apiTokens.ForUser(username); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Remove the user, and everything that is stored about the user
+func (ue *UserEngine) ErasePersonalData(username string) error {
+	state := ue.state
+	creator := state.Creator()
+	if email, err := state.Email(username); err == nil {
+		ue.limits.forgetAddress(email)
+	}
+	for _, id := range []string{"logins:" + username, "userIPHistory:" + username, "accountChanges:" + username} {
+		list, err := creator.NewList(id)
 		if err != nil {
-			return MessageOKurl("Confirmation", "All users are confirmed already.", "/register")
+			return err
 		}
+		list.Remove()
+	}
+	if userIPs, err := creator.NewHashMap("userIPs"); err == nil {
+		userIPs.Del(username)
+	}
+	if err := ue.sessions.RevokeAll(username); err != nil {
+		return err
+	}
+	if err := ue.invites.ForgetUser(username); err != nil {
+		return err
+	}
+	if err := ue.apiTokens.RevokeAll(username); err != nil {
+		return err
+	}
+	ue.twoFactor.Disable(username)
+	ue.pendingEmails.Del(username)
+	ue.throttle.Clear("user:" + username)
+	for _, tokens := range []*OneTimeTokens{ue.resets, ue.emailChanges, ue.cancelResets} {
+		tokens.Revoke(username)
+	}
+	return ue.removeRegistration(username)
+}
 
-		// Find the username by looking up the confirmationCode on unconfirmed users
-		username := ""
-		for _, aUsername := range unconfirmedUsernames {
-			aConfirmationCode, err := state.ConfirmationCode(aUsername)
-			if err != nil {
-				// If the confirmation code can not be found, just skip this one
-				continue
-			}
-			if confirmationCode == aConfirmationCode {
-				// Found the right user
-				username = aUsername
-				break
+// Remove a user along with what is stored for registering: the confirmation code,
+// the moderation status, the cancel link and the username indexes. Used when a
+// registration is cancelled, rejected, expires or fails, so that the username is free again.
+func (ue *UserEngine) removeRegistration(username string) error {
+	state := ue.state
+	if ue.moderation != nil {
+		if items, err := ue.moderation.Pending(); err == nil {
+			for _, item := range items {
+				if item.Kind == "registration" && item.Data == username {
+					ue.moderation.Withdraw(item.ID)
+				}
 			}
 		}
+	}
+	ue.confirmations.Remove(username)
+	ue.unapproved.Del(username)
+	ue.cancelRegistrations.Revoke(username)
+	RemoveUsernameKey(state, username)
+	ue.skeletons.Remove(username)
+	state.RemoveUnconfirmed(username)
+	state.RemoveUser(username)
+	// Also remove the fields that RemoveUser may leave behind, like the email address
+	return state.Users().Del(username)
+}
+
+// All enabled engines, or only this one if the pages are served without an engine registry
+func (ue *UserEngine) personalDataEngines() []Engine {
+	for _, engine := range ue.engines {
+		if engine == Engine(ue) {
+			return ue.engines
+		}
+	}
+	return append(append([]Engine{}, ue.engines...), ue)
+}
 
-		// Check that the user is there
-		if username == "" {
-			// Say "no longer" because we don't care about people that just try random confirmation links
-			return MessageOKurl("Confirmation", "The confirmation link is no longer valid.", "/register")
+// The login and registration pages are styled by the site
+func (ue *UserEngine) GenerateCSS(cs *ColorScheme) StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		w.Header().Add("Content-Type", "text/css")
+		return ""
+	}
+}
+
+// Set the usernames that new usernames may not look like. The default is "admin".
+func (ue *UserEngine) SetReservedUsernames(usernames ...string) {
+	ue.skeletons.SetReserved(usernames...)
+}
+
+// Set how long the confirmation links work. The default is 7 days, and 0 means forever.
+func (ue *UserEngine) SetConfirmationExpiry(duration time.Duration) {
+	ue.confirmations.SetDuration(duration)
+}
+
+// Remove unconfirmed users after the given number of days, checking once per hour.
+// 0 means that unconfirmed users are never removed, which is the default.
+func (ue *UserEngine) RemoveUnconfirmedAfter(days int) {
+	if days <= 0 {
+		ue.confirmations.SweepEvery(0, 0)
+		return
+	}
+	ue.confirmations.SweepEvery(time.Hour, time.Duration(days)*24*time.Hour)
+}
+
+// Create a user by adding the username to the list of usernames
+func (ue *UserEngine) GenerateConfirmUser() StringHandle {
+	state := ue.state
+	return func(w http.ResponseWriter, req *http.Request) string {
+		confirmationCode := mux.Vars(req)["code"]
+
+		// Say "no longer" because we don't care about people that just try random confirmation links
+		username, err := ue.confirmations.Find(confirmationCode)
+		if err == confirmationExpiredErr {
+			return MessageOKurl("Confirmation", "The confirmation link has expired. A new one can be sent to you.", "/resend-confirmation")
+		} else if err != nil {
+			return MessageOKurl("Confirmation", err.Error(), "/register")
 		}
 		hasUser := state.HasUser(username)
 		if !hasUser {
@@ -97,7 +527,7 @@ func GenerateConfirmUser(state pinterface.IUserState) WebHandle {
 		}
 
 		// Remove from the list of unconfirmed usernames
-		state.RemoveUnconfirmed(username)
+		ue.confirmations.Remove(username)
 
 		// Mark user as confirmed
 		state.MarkConfirmed(username)
@@ -106,70 +536,159 @@ func GenerateConfirmUser(state pinterface.IUserState) WebHandle {
 	}
 }
 
-// Log in a user by changing the loggedin value
-func GenerateLoginUser(state pinterface.IUserState) WebHandle {
-	return func(ctx *web.Context, val string) string {
-		// Fetch password from ctx
-		password, found := ctx.Params["password"]
-		if !found {
+// Log in a user by changing the loggedin value.
+// Site is used for telling the owner when an account is locked.
+func (ue *UserEngine) GenerateLoginUser(site string) StringHandle {
+	state := ue.state
+	bans, err := NewIPBans(state)
+	if err != nil {
+		panic("ERROR: Could not access the IP bans")
+	}
+	return func(w http.ResponseWriter, req *http.Request) string {
+		ip := ClientIP(req)
+		if ban := bans.Banned(ip); ban != nil {
+			return MessageOKback("Login", ban.Message())
+		}
+		if wait, ok := ue.throttle.Wait(ip, ""); ok {
+			return MessageOKback("Login", "Too many failed logins. Try again in "+formatWait(wait)+".")
+		}
+		// Fetch password from the form
+		password := req.FormValue("password")
+		if password == "" {
 			return MessageOKback("Login", "Can't log in without a password.")
 		}
-		username := val
+		username := mux.Vars(req)["username"]
 		if username == "" {
 			return MessageOKback("Login", "Can't log in with a blank username.")
 		}
-		if !state.HasUser(username) {
-			return MessageOKback("Login", "User "+username+" does not exist, could not log in.")
+		// Usernames are case insensitive
+		if found := FindUsername(state, username); found != "" {
+			username = found
+		} else {
+			ue.throttle.Failed(ip, "")
+			return MessageOKback("Login", "User "+CleanUserInput(username)+" does not exist, could not log in.")
+		}
+		if wait, ok := ue.throttle.Wait(ip, username); ok {
+			return MessageOKback("Login", "Too many failed logins for "+username+". Try again in "+formatWait(wait)+".")
 		}
 		if !state.IsConfirmed(username) {
 			return MessageOKback("Login", "The email for "+username+" has not been confirmed, check your email and follow the link.")
 		}
 		if !state.CorrectPassword(username, password) {
+			if ue.loginFailed(site, ip, username) {
+				return MessageOKback("Login", "Wrong password. The account has been locked for a while, because of too many failed logins.")
+			}
 			return MessageOKback("Login", "Wrong password.")
 		}
 
-		// Log in the user by changing the database and setting a secure cookie
-		state.SetLoggedIn(username)
+		// Ask for a code as well, if two-factor authentication is enabled or required
+		if ue.twoFactor.Enabled(username) || ue.twoFactor.Required(username) {
+			return ue.beginTwoFactorLogin(w, req, username)
+		}
 
-		// Also store the username in the browser
-		state.SetUsernameCookie(ctx.ResponseWriter, username)
+		return ue.completeLogin(w, req, username, "")
+	}
+}
 
-		// TODO: Use a welcoming messageOK where the user can see when he/she last logged in and from which host
+// Log in a user that has been authenticated, and show a welcome message with
+// the previous login. Extra is HTML that is added to the message.
+func (ue *UserEngine) completeLogin(w http.ResponseWriter, req *http.Request, username, extra string) string {
+	state := ue.state
+	// Each browser gets a session, so that it can be logged out by itself
+	if err := ue.startSession(w, req, username); err != nil {
+		return MessageOKback("Login", "Could not start a session for "+username+", please try again.")
+	}
+
+	// Log in the user by changing the database and setting a secure cookie
+	state.SetLoggedIn(username)
+
+	// Also store the username in the browser
+	state.SetUsernameCookie(w, username)
+
+	// Find the previous login before recording this one
+	previous, _ := LoginHistory(state, username, 1)
 
-		if username == "admin" {
-			ctx.SetHeader("Refresh", "0; url=/admin", true)
+	// Keep track of where the user logs in from
+	ip := ClientIP(req)
+	RecordUserIP(state, username, ip)
+	RecordLogin(state, username, ip)
+	ue.throttle.Succeeded(ip, username)
+
+	// Go back to the page the user was at before logging in
+	next := sameOriginPath(req, req.FormValue("next"))
+	if next == "" {
+		if state.IsAdmin(username) {
+			next = "/admin"
 		} else {
-			// TODO: Redirect to the page the user was at before logging in
-			ctx.SetHeader("Refresh", "0; url=/", true)
+			next = "/"
 		}
+	}
 
+	welcome := "Welcome, " + username + "."
+	if len(previous) > 0 {
+		welcome += " You last logged in " + previous[0].When.Local().Format("2006-01-02 15:04") + " from " + CleanUserInput(previous[0].IP) + "."
+	}
+	return MessageOKurl("Login", welcome+extra, next)
+}
+
+// Check that a path to redirect to is on the same site, and return it as a path.
+// Full URLs, like the referer, are allowed if the host is the same as for the request.
+// Returns an empty string if the path can not be used.
+func sameOriginPath(req *http.Request, next string) string {
+	if next == "" || strings.ContainsAny(next, "\\\r\n\t'\"<>") {
+		return ""
+	}
+	u, err := url.Parse(next)
+	if err != nil || u.Opaque != "" || u.User != nil {
+		return ""
+	}
+	if u.Scheme != "" || u.Host != "" {
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host != req.Host {
+			return ""
+		}
+	}
+	// "//example.com" would be another site
+	if !strings.HasPrefix(u.Path, "/") || strings.HasPrefix(u.Path, "//") {
 		return ""
 	}
+	// Don't go back to the pages for logging in and out
+	for _, prefix := range []string{"/login", "/logout", "/register"} {
+		if u.Path == prefix || strings.HasPrefix(u.Path, prefix+"/") {
+			return ""
+		}
+	}
+	return u.RequestURI()
 }
 
-// TODO: Forgot username? Enter email, send username.
-// TODO: Lost confirmation link? Enter mail, Receive confirmation link.
-// TODO: Forgot password? Enter mail, receive reset-password link.
 // TODO: Make sure not two usernames can register at once before confirming
 // TODO: Only one username per email address? (meh? can use more than one address?=
 // TODO: Maximum 1 confirmation email per email adress
-// TODO: Maximum 1 forgot username per email adress per day
 // TODO: Maximum 1 forgot password per email adress per day
-// TODO: Maximum 1 lost confirmation link per email adress per day
-// TODO: Link for "Did you not request this email? Click here" i alle eposter som sendes.
 // TODO: Rate limiting, maximum rate per minute or day
 
 // Register a new user, site is ie. "archlinux.no"
-func GenerateRegisterUser(state pinterface.IUserState, site string) WebHandle {
-	return func(ctx *web.Context, val string) string {
-
+func (ue *UserEngine) GenerateRegisterUser(site string) StringHandle {
+	state := ue.state
+	bans, err := NewIPBans(state)
+	if err != nil {
+		panic("ERROR: Could not access the IP bans")
+	}
+	return func(w http.ResponseWriter, req *http.Request) string {
+		if ban := bans.Banned(ClientIP(req)); ban != nil {
+			return MessageOKback("Register", ban.Message())
+		}
+		// The first administrator is created at /setup, and can then create invites.
+		// This is checked first, so that the usernames that are taken are not revealed.
+		if ue.InviteOnly() {
+			return MessageOKback("Register", inviteOnlyErr.Error())
+		}
 		// Password checks
-		password1, found := ctx.Params["password1"]
-		if password1 == "" || !found {
+		password1 := req.FormValue("password1")
+		if password1 == "" {
 			return MessageOKback("Register", "Can't register without a password.")
 		}
-		password2, found := ctx.Params["password2"]
-		if password2 == "" || !found {
+		password2 := req.FormValue("password2")
+		if password2 == "" {
 			return MessageOKback("Register", "Please confirm the password by typing it in twice.")
 		}
 		if password1 != password2 {
@@ -177,8 +696,8 @@ func GenerateRegisterUser(state pinterface.IUserState, site string) WebHandle {
 		}
 
 		// Email checks
-		email, found := ctx.Params["email"]
-		if !found {
+		email := req.FormValue("email")
+		if email == "" {
 			return MessageOKback("Register", "Can't register without an email address.")
 		}
 		// must have @ and ., but no " "
@@ -190,11 +709,11 @@ func GenerateRegisterUser(state pinterface.IUserState, site string) WebHandle {
 		}
 
 		// Username checks
-		username := val
+		username := mux.Vars(req)["username"]
 		if username == "" {
 			return MessageOKback("Register", "Can't register without a username.")
 		}
-		if state.HasUser(username) {
+		if FindUsername(state, username) != "" {
 			return MessageOKback("Register", "That user already exists, try another username.")
 		}
 
@@ -204,43 +723,28 @@ func GenerateRegisterUser(state pinterface.IUserState, site string) WebHandle {
 			return MessageOKback("Register", err.Error())
 		}
 
-		adminuser := false
-		// A special case
-		if username == "admin" {
-			// The first user to register with the username "admin" becomes the administrator
-			adminuser = true
+		// Usernames that look like other usernames could be used for impersonation
+		if other := ue.skeletons.Confusable(username); other != "" {
+			return MessageOKback("Register", "That username looks too much like "+other+", try another username.")
 		}
 
 		// Register the user
 		state.AddUser(username, password1, email)
+		AddUsernameKey(state, username)
+		ue.skeletons.Add(username)
 
-		// Mark user as administrator if that is the case
-		if adminuser {
-			// Set admin status
-			state.SetAdminStatus(username)
-		}
-
-		confirmationCode, err := state.GenerateUniqueConfirmationCode()
+		// Register the need to be confirmed
+		confirmationCode, err := ue.confirmations.Add(username)
 		if err != nil {
 			panic(err.Error())
 		}
 
-		// If registering the admin user (first user on the system), don't send a confirmation email, just register it
-		if adminuser {
-
-			// Mark user as confirmed
-			state.MarkConfirmed(username)
-
-			// Redirect
-			return MessageOKurl("Registration complete", "Thanks for registering, the admin user has been created.", "/login")
-
-		}
-
 		// Send confirmation email
-		ConfirmationEmail(site, "https://"+site+"/confirm/"+confirmationCode, username, email)
-
-		// Register the need to be confirmed
-		state.AddUnconfirmed(username, confirmationCode)
+		if err := ue.sendConfirmationEmail(site, username, email, confirmationCode); err != nil {
+			// Let the user try again
+			ue.removeRegistration(username)
+			return MessageOKback("Register", "Could not send the confirmation e-mail to "+email+", please try again later.")
+		}
 
 		// Redirect
 		return MessageOKurl("Registration complete", "Thanks for registering, the confirmation e-mail has been sent.", "/login")
@@ -248,9 +752,9 @@ func GenerateRegisterUser(state pinterface.IUserState, site string) WebHandle {
 }
 
 // Log out a user by changing the loggedin value
-func GenerateLogoutCurrentUser(state pinterface.IUserState) SimpleContextHandle {
-	return func(ctx *web.Context) string {
-		username := state.Username(ctx.Request)
+func GenerateLogoutCurrentUser(state pinterface.IUserState) StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		username := state.Username(req)
 		if username == "" {
 			return MessageOKback("Logout", "No user to log out")
 		}
@@ -262,13 +766,13 @@ func GenerateLogoutCurrentUser(state pinterface.IUserState) SimpleContextHandle
 		state.SetLoggedOut(username)
 
 		// Redirect
-		//ctx.SetHeader("Refresh", "0; url=/login", true)
+		//w.Header().Set("Refresh", "0; url=/login")
 		return MessageOKurl("Logout", username+" is now logged out. Hope to see you soon!", "/login")
 	}
 }
 
-func GenerateNoJavascriptMessage() SimpleContextHandle {
-	return func(ctx *web.Context) string {
+func GenerateNoJavascriptMessage() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
 		return MessageOKback("JavaScript error", "Cookies and Javascript must be enabled.<br />Older browsers might be supported in the future.")
 	}
 }
@@ -276,8 +780,9 @@ func GenerateNoJavascriptMessage() SimpleContextHandle {
 func LoginCP(basecp BaseCP, state pinterface.IUserState, url string) *ContentPage {
 	cp := basecp(state)
 	cp.ContentTitle = "Login"
-	cp.ContentHTML = LoginForm()
-	cp.ContentJS += OnClick("#loginButton", "$('#loginForm').get(0).setAttribute('action', '/login/' + $('#username').val());")
+	cp.ContentHTML = LoginForm() + "<p><a href=\"/forgot-password\">Forgot password?</a> <a href=\"/forgot-username\">Forgot username?</a> <a href=\"/resend-confirmation\">Lost the confirmation link?</a></p>"
+	// The page to go to after logging in is the "next" parameter, or else the previous page
+	cp.ContentJS += OnClick("#loginButton", "var next = (location.search.match(/[?&]next=([^&]*)/) || [])[1] || encodeURIComponent(document.referrer); $('#loginForm').get(0).setAttribute('action', '/login/' + $('#username').val() + (next ? '?next=' + next : ''));")
 	//cp.ExtraCSSurls = append(cp.ExtraCSSurls, "/css/login.css")
 	cp.Url = url
 
@@ -303,13 +808,291 @@ func RegisterCP(basecp BaseCP, state pinterface.IUserState, url string) *Content
 	return cp
 }
 
+// Find the confirmed users that have the given email address
+func confirmedUsersByEmail(state pinterface.IUserState, email string) []string {
+	var found []string
+	usernames, err := state.AllUsernames()
+	if err != nil {
+		return found
+	}
+	for _, username := range usernames {
+		userEmail, err := state.Email(username)
+		if err == nil && strings.EqualFold(userEmail, email) && state.IsConfirmed(username) {
+			found = append(found, username)
+		}
+	}
+	return found
+}
+
+// A form for asking for a password reset link
+func (ue *UserEngine) GenerateForgotPasswordForm() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		s := "<p>Enter the email address you registered with, and a link for choosing a new password will be sent to you.</p>"
+		s += "<form method=\"POST\" action=\"/forgot-password\">"
+		s += "Email: <input name=\"email\"> "
+		s += "<input type=\"submit\" value=\"Send link\">"
+		s += "</form>"
+		return s
+	}
+}
+
+// Send password reset links to all users with the given email address, at most once per day.
+// The response is the same whether the address is registered or not, and whether sending worked.
+func (ue *UserEngine) GenerateForgotPassword(site string) StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		email := strings.TrimSpace(req.FormValue("email"))
+		if email == "" {
+			return MessageOKback("Forgot password", "Please enter an email address.")
+		}
+		if usernames := confirmedUsersByEmail(ue.state, email); len(usernames) > 0 && ue.limits.allow("passwordReset", email) {
+			for _, username := range usernames {
+				token, err := ue.resets.Issue(username)
+				if err == nil {
+					err = ue.sendPasswordResetEmail(site, username, email, token)
+				}
+				if err != nil {
+					log.Println("Could not send the password reset email for "+username+":", err)
+					ue.limits.forget("passwordReset", email)
+				}
+			}
+		}
+		return MessageOKurl("Forgot password", "If "+CleanUserInput(email)+" is registered, a link for choosing a new password has been sent to it. This can only be done once per day.", "/login")
+	}
+}
+
+// A form for choosing a new password, if the reset link is valid
+func (ue *UserEngine) GenerateResetPasswordForm() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		token := mux.Vars(req)["token"]
+		username, err := ue.resets.Check(token)
+		if err != nil {
+			return "<div class=\"no\">" + err.Error() + " <a href=\"/forgot-password\">Ask for a new link.</a></div>"
+		}
+		s := "<p>Choose a new password for " + username + ".</p>"
+		s += "<form method=\"POST\" action=\"/reset/" + token + "\">"
+		s += "Password: <input type=\"password\" name=\"password1\"><br />"
+		s += "Confirm password: <input type=\"password\" name=\"password2\"><br />"
+		s += "<input type=\"submit\" value=\"Set password\">"
+		s += "</form>"
+		return s
+	}
+}
+
+// Set the new password and log the user out everywhere
+func (ue *UserEngine) GenerateResetPassword() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		token := mux.Vars(req)["token"]
+		username, err := ue.resets.Check(token)
+		if err != nil {
+			return MessageOKurl("Reset password", err.Error(), "/forgot-password")
+		}
+		password1 := req.FormValue("password1")
+		if password1 == "" {
+			return MessageOKback("Reset password", "Can't use a blank password.")
+		}
+		if password1 != req.FormValue("password2") {
+			return MessageOKback("Reset password", "The password and confirmation password must be equal.")
+		}
+		if err := ValidUsernamePassword(username, password1); err != nil {
+			return MessageOKback("Reset password", err.Error())
+		}
+		// Use up the token, in case it was used by another request in the meantime
+		if _, err := ue.resets.Use(token); err != nil {
+			return MessageOKurl("Reset password", err.Error(), "/forgot-password")
+		}
+		ue.state.SetPassword(username, password1)
+		// Log out existing sessions and revoke the API tokens, in case someone else knew the old password
+		ue.sessions.RevokeAll(username)
+		ue.apiTokens.RevokeAll(username)
+		ue.state.SetLoggedOut(username)
+		return MessageOKurl("Reset password", "OK, the password for "+username+" has been changed. You can now log in.", "/login")
+	}
+}
+
+// A form for entering an email address, for the given action
+func emailForm(description, action, buttonText string) string {
+	s := "<p>" + description + "</p>"
+	s += "<form method=\"POST\" action=\"" + action + "\">"
+	s += "Email: <input name=\"email\"> "
+	s += "<input type=\"submit\" value=\"" + buttonText + "\">"
+	s += "</form>"
+	return s
+}
+
+// A form for asking for the usernames that belong to an email address
+func (ue *UserEngine) GenerateForgotUsernameForm() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		return emailForm("Enter the email address you registered with, and your username will be sent to you.", "/forgot-username", "Send username")
+	}
+}
+
+// Send the usernames that are registered with an email address, at most once per day.
+// The response is the same whether the address is registered or not.
+func (ue *UserEngine) GenerateForgotUsername(site string) StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		email := strings.TrimSpace(req.FormValue("email"))
+		if email == "" {
+			return MessageOKback("Forgot username", "Please enter an email address.")
+		}
+		if usernames := confirmedUsersByEmail(ue.state, email); len(usernames) > 0 && ue.limits.allow("forgotUsername", email) {
+			if err := ue.sendForgotUsernameEmail(site, usernames, email); err != nil {
+				ue.limits.forget("forgotUsername", email)
+				return MessageOKback("Forgot username", "Could not send the e-mail, please try again later.")
+			}
+		}
+		return MessageOKurl("Forgot username", "If "+CleanUserInput(email)+" is registered, the username has been sent to it. This can only be done once per day.", "/login")
+	}
+}
+
+// A form for asking for the confirmation link again
+func (ue *UserEngine) GenerateResendConfirmationForm() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		return emailForm("Enter the email address you registered with, and the confirmation link will be sent to you again.", "/resend-confirmation", "Send link")
+	}
+}
+
+// Send the confirmation links for the unconfirmed users with an email address, at most once per day.
+// The response is the same whether the address is registered or not.
+func (ue *UserEngine) GenerateResendConfirmation(site string) StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		email := strings.TrimSpace(req.FormValue("email"))
+		if email == "" {
+			return MessageOKback("Confirmation", "Please enter an email address.")
+		}
+		var usernames []string
+		if unconfirmed, err := ue.state.AllUnconfirmedUsernames(); err == nil {
+			for _, username := range unconfirmed {
+				if userEmail, err := ue.state.Email(username); err == nil && strings.EqualFold(userEmail, email) {
+					usernames = append(usernames, username)
+				}
+			}
+		}
+		if len(usernames) > 0 && ue.limits.allow("resendConfirmation", email) {
+			for _, username := range usernames {
+				// A new code, in case the old one has expired
+				confirmationCode, err := ue.confirmations.Add(username)
+				if err != nil {
+					continue
+				}
+				if err := ue.sendConfirmationEmail(site, username, email, confirmationCode); err != nil {
+					ue.limits.forget("resendConfirmation", email)
+					return MessageOKback("Confirmation", "Could not send the e-mail, please try again later.")
+				}
+			}
+		}
+		return MessageOKurl("Confirmation", "If "+CleanUserInput(email)+" is waiting to be confirmed, the confirmation link has been sent to it again. This can only be done once per day.", "/login")
+	}
+}
+
+// The page for the "Did you not request this email?" links. Shows a button for
+// undoing what the email was about, since links in emails may be visited automatically.
+func (ue *UserEngine) GenerateNotRequestedForm() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		kind := mux.Vars(req)["kind"]
+		token := mux.Vars(req)["token"]
+		var s string
+		switch kind {
+		case "registration":
+			username, err := ue.cancelRegistrations.Check(token)
+			if err != nil || ue.state.IsConfirmed(username) {
+				return "<div class=\"no\">" + invalidTokenErr.Error() + "</div>"
+			}
+			s = "<p>Someone registered the user " + username + " with your e-mail address. If it was not you, the registration can be cancelled.</p>"
+		case "reset":
+			username, err := ue.cancelResets.Check(token)
+			if err != nil {
+				return "<div class=\"no\">" + invalidTokenErr.Error() + "</div>"
+			}
+			s = "<p>Someone asked to reset the password for " + username + ". If it was not you, the password reset link can be cancelled. The password has not been changed.</p>"
+		case "":
+			return "<p>Thank you. No changes have been made, and nobody can log in with the information in the e-mail alone. You can ignore the e-mail.</p>"
+		default:
+			return "<div class=\"no\">" + invalidTokenErr.Error() + "</div>"
+		}
+		s += "<form method=\"POST\" action=\"/not-requested/" + kind + "/" + token + "\">"
+		s += "<input type=\"submit\" value=\"Cancel\">"
+		s += "</form>"
+		return s
+	}
+}
+
+// Undo what an unrequested email was about
+func (ue *UserEngine) GenerateNotRequested() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		kind := mux.Vars(req)["kind"]
+		token := mux.Vars(req)["token"]
+		switch kind {
+		case "registration":
+			username, err := ue.cancelRegistrations.Use(token)
+			if err != nil || ue.state.IsConfirmed(username) {
+				return MessageOKurl("Cancel registration", invalidTokenErr.Error(), "/")
+			}
+			ue.removeRegistration(username)
+			return MessageOKurl("Cancel registration", "OK, the registration of "+username+" has been cancelled.", "/")
+		case "reset":
+			username, err := ue.cancelResets.Use(token)
+			if err != nil {
+				return MessageOKurl("Cancel password reset", invalidTokenErr.Error(), "/")
+			}
+			ue.resets.Revoke(username)
+			return MessageOKurl("Cancel password reset", "OK, the password reset link for "+username+" no longer works.", "/")
+		}
+		return MessageOKurl("Not requested", invalidTokenErr.Error(), "/")
+	}
+}
+
+// The pages that are wrapped in the site layout. Site is ie. "archlinux.no" and used for sending emails.
+func (ue *UserEngine) ServeAccountPages(r *mux.Router, basecp BaseCP, menuEntries MenuEntries, site string) {
+	forgotCP := basecp(ue.state)
+	forgotCP.ContentTitle = "Forgot password"
+
+	resetCP := basecp(ue.state)
+	resetCP.ContentTitle = "Reset password"
+
+	forgotUsernameCP := basecp(ue.state)
+	forgotUsernameCP.ContentTitle = "Forgot username"
+
+	resendCP := basecp(ue.state)
+	resendCP.ContentTitle = "Confirmation"
+
+	notRequestedCP := basecp(ue.state)
+	notRequestedCP.ContentTitle = "Did you not request this e-mail?"
+
+	tvgf := DynamicMenuFactoryGenerator(menuEntries)
+	tvg := tvgf(ue.state)
+
+	r.HandleFunc("/forgot-password", forgotCP.WrapSimpleContextHandle(r, ue.GenerateForgotPasswordForm(), tvg)).Methods("GET")
+	r.Handle("/forgot-password", ue.GenerateForgotPassword(site)).Methods("POST")
+	r.HandleFunc("/reset/{token}", resetCP.WrapSimpleContextHandle(r, ue.GenerateResetPasswordForm(), tvg)).Methods("GET")
+	r.Handle("/reset/{token}", ue.GenerateResetPassword()).Methods("POST")
+	r.HandleFunc("/forgot-username", forgotUsernameCP.WrapSimpleContextHandle(r, ue.GenerateForgotUsernameForm(), tvg)).Methods("GET")
+	r.Handle("/forgot-username", ue.GenerateForgotUsername(site)).Methods("POST")
+	r.HandleFunc("/resend-confirmation", resendCP.WrapSimpleContextHandle(r, ue.GenerateResendConfirmationForm(), tvg)).Methods("GET")
+	r.Handle("/resend-confirmation", ue.GenerateResendConfirmation(site)).Methods("POST")
+	r.HandleFunc("/not-requested", notRequestedCP.WrapSimpleContextHandle(r, ue.GenerateNotRequestedForm(), tvg)).Methods("GET")
+	r.HandleFunc("/not-requested/{kind}/{token}", notRequestedCP.WrapSimpleContextHandle(r, ue.GenerateNotRequestedForm(), tvg)).Methods("GET")
+	r.Handle("/not-requested/{kind}/{token}", ue.GenerateNotRequested()).Methods("POST")
+}
+
 // Site is ie. "archlinux.no" and used for sending confirmation emails
-func (ue *UserEngine) ServePages(site string) {
-	state := ue.state
-	web.Post("/register/(.*)", GenerateRegisterUser(state, site))
-	web.Post("/register", GenerateNoJavascriptMessage())
-	web.Post("/login/(.*)", GenerateLoginUser(state))
-	web.Post("/login", GenerateNoJavascriptMessage())
-	web.Get("/logout", GenerateLogoutCurrentUser(state))
-	web.Get("/confirm/(.*)", GenerateConfirmUser(state))
+func (ue *UserEngine) ServePages(r *mux.Router, site string) {
+	// Browsers with a session that has been logged out are not logged in, on any page
+	r.Use(ue.checkSession)
+	// Scripts with a personal access token act as the user the token belongs to,
+	// for the handlers that use LoggedInUsername and HasAdminRights.
+	// This must come after checkSession, since there is no session for it.
+	r.Use(ue.checkAPIToken)
+	// The first administrator is created at /setup. The page is without the site
+	// layout, unless ServeSetupPages has been called first.
+	form := ue.GenerateSetupForm()
+	ue.serveSetup(r, func(w http.ResponseWriter, req *http.Request) {
+		Ret(w, Message("Setup", form(w, req)))
+	})
+	r.Handle("/register/{username}", ue.holdRegistrations(ue.GenerateRegisterUser(site))).Methods("POST")
+	r.Handle("/register", GenerateNoJavascriptMessage()).Methods("POST")
+	r.Handle("/login/{username}", ue.checkApproved(ue.GenerateLoginUser(site))).Methods("POST")
+	r.Handle("/login", GenerateNoJavascriptMessage()).Methods("POST")
+	r.Handle("/logout", ue.GenerateLogout()).Methods("GET")
+	r.Handle("/confirm/{code}", ue.GenerateConfirmUser()).Methods("GET")
+	r.Handle("/lockouts/clear/{key}", ue.GenerateClearLockout()).Methods("GET")
 }
@@ -0,0 +1,110 @@
+package siteengines
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/xyproto/pinterface"
+)
+
+// This part makes usernames case insensitive, while keeping the case the user chose
+
+// The canonical key for a username. Usernames that only differ in case have the same key.
+func UsernameKey(username string) string {
+	return strings.ToLower(username)
+}
+
+// Find a user by username, in any case. Returns the username with the case it was
+// registered with, or an empty string if there is no such user.
+func FindUsername(state pinterface.IUserState, username string) string {
+	if username == "" {
+		return ""
+	}
+	if state.HasUser(username) {
+		return username
+	}
+	keys, err := state.Creator().NewKeyValue("usernameKeys")
+	if err != nil {
+		return ""
+	}
+	found, err := keys.Get(UsernameKey(username))
+	if err != nil {
+		return ""
+	}
+	if !state.HasUser(found) {
+		// Left behind by a user that has been removed
+		keys.Del(UsernameKey(username))
+		return ""
+	}
+	return found
+}
+
+// Make a new user possible to find with FindUsername
+func AddUsernameKey(state pinterface.IUserState, username string) error {
+	keys, err := state.Creator().NewKeyValue("usernameKeys")
+	if err != nil {
+		return err
+	}
+	return keys.Set(UsernameKey(username), username)
+}
+
+// Make a removed user impossible to find with FindUsername
+func RemoveUsernameKey(state pinterface.IUserState, username string) error {
+	keys, err := state.Creator().NewKeyValue("usernameKeys")
+	if err != nil {
+		return err
+	}
+	if found, err := keys.Get(UsernameKey(username)); err != nil || found != username {
+		// Another user with the same key, or no key at all
+		return nil
+	}
+	return keys.Del(UsernameKey(username))
+}
+
+// Find the users with usernames that only differ in case. These were registered
+// before usernames were case insensitive, and can only log in with the exact case.
+func UsernameCollisions(state pinterface.IUserState) ([][]string, error) {
+	usernames, err := state.AllUsernames()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(usernames)
+	byKey := make(map[string][]string)
+	var keys []string
+	for _, username := range usernames {
+		key := UsernameKey(username)
+		if _, ok := byKey[key]; !ok {
+			keys = append(keys, key)
+		}
+		byKey[key] = append(byKey[key], username)
+	}
+	var collisions [][]string
+	for _, key := range keys {
+		if len(byKey[key]) > 1 {
+			collisions = append(collisions, byKey[key])
+		}
+	}
+	return collisions, nil
+}
+
+// Add the users that were registered before usernames were case insensitive,
+// and report the usernames that only differ in case.
+func MigrateUsernameKeys(state pinterface.IUserState) ([][]string, error) {
+	keys, err := state.Creator().NewKeyValue("usernameKeys")
+	if err != nil {
+		return nil, err
+	}
+	usernames, err := state.AllUsernames()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(usernames)
+	for _, username := range usernames {
+		if _, err := keys.Get(UsernameKey(username)); err != nil {
+			if err := keys.Set(UsernameKey(username), username); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return UsernameCollisions(state)
+}
@@ -1,10 +1,13 @@
 package siteengines
 
 import (
+	"encoding/json"
+	"net/http"
 	"regexp"
 	"strings"
+	"time"
 
-	"github.com/hoisie/web"
+	"github.com/gorilla/mux"
 	"github.com/russross/blackfriday"
 	. "github.com/xyproto/genericsite"
 	. "github.com/xyproto/onthefly"
@@ -20,8 +23,10 @@ import (
 // TODO: Add the wiki pages to the search engine somehow (and the other engines too, like the chat)
 
 type WikiEngine struct {
-	state     pinterface.IUserState
-	wikiState *WikiState
+	state      pinterface.IUserState
+	wikiState  *WikiState
+	bans       *IPBans
+	moderation *ModerationEngine // Holds edits until they are approved, may be nil
 }
 
 type WikiState struct {
@@ -45,10 +50,123 @@ func NewWikiEngine(userState pinterface.IUserState) (*WikiEngine, error) {
 		wikiState.pages = pagesHashMap
 	}
 
-	return &WikiEngine{userState, wikiState}, nil
+	bans, err := NewIPBans(userState)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WikiEngine{userState, wikiState, bans, nil}, nil
+}
+
+func (we *WikiEngine) Name() string {
+	return "wiki"
+}
+
+func (we *WikiEngine) MenuLinks() []string {
+	return []string{"Wiki:/wiki"}
+}
+
+func (we *WikiEngine) ServeEngine(r *mux.Router, ec *EngineConfig) {
+	we.ServePages(r, ec.BaseCP, ec.MenuEntries)
+}
+
+// A wiki edit that is waiting to be approved
+type wikiEdit struct {
+	PageID string `json:"id"`
+	Title  string `json:"title"`
+	Text   string `json:"text"`
+}
+
+// A wiki edit and when it was made, for the personal data of the user that made it
+type authoredWikiEdit struct {
+	When time.Time `json:"when"`
+	wikiEdit
+}
+
+// Remember that a user has edited a page
+func (we *WikiEngine) recordEdit(username string, edit wikiEdit) error {
+	edits, err := we.state.Creator().NewList("wikiEdits:" + username)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(authoredWikiEdit{time.Now().UTC(), edit})
+	if err != nil {
+		return err
+	}
+	return edits.Add(string(data))
+}
+
+// The edits the user has made, oldest first
+func (we *WikiEngine) ExportPersonalData(username string) (interface{}, error) {
+	edits, err := we.state.Creator().NewList("wikiEdits:" + username)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := edits.All()
+	if err != nil {
+		return nil, err
+	}
+	authored := []authoredWikiEdit{}
+	for _, entry := range entries {
+		var edit authoredWikiEdit
+		if err := json.Unmarshal([]byte(entry), &edit); err == nil {
+			authored = append(authored, edit)
+		}
+	}
+	return map[string]interface{}{"edits": authored}, nil
+}
+
+// Forget which edits the user has made. The pages only store the title and the text,
+// so they are kept as they are.
+func (we *WikiEngine) ErasePersonalData(username string) error {
+	edits, err := we.state.Creator().NewList("wikiEdits:" + username)
+	if err != nil {
+		return err
+	}
+	return edits.Remove()
 }
 
-func (we *WikiEngine) ServePages(basecp BaseCP, menuEntries MenuEntries) {
+// Hold wiki edits in the moderation queue
+func (we *WikiEngine) SetModeration(me *ModerationEngine) {
+	we.moderation = me
+	me.Handle("wiki", ModerationHooks{
+		Approved: func(item *ModerationItem) {
+			var edit wikiEdit
+			if err := json.Unmarshal([]byte(item.Data), &edit); err != nil {
+				return
+			}
+			if !we.HasPage(edit.PageID) {
+				we.CreatePage(edit.PageID)
+			}
+			we.ChangePage(edit.PageID, edit.Title, edit.Text)
+			we.recordEdit(item.Username, edit)
+		},
+	})
+}
+
+// Search the page ids, titles and texts of all wiki pages
+func (we *WikiEngine) Search(searchText string) []SearchResult {
+	var results []SearchResult
+	pageids, err := we.wikiState.pages.All()
+	if err != nil {
+		return results
+	}
+	for _, pageid := range pageids {
+		title := we.GetTitle(pageid)
+		url := "/wiki/" + pageid
+		switch {
+		case strings.Contains(strings.ToLower(pageid), searchText):
+			results = append(results, SearchResult{url, title, FOUND_IN_URL})
+		case strings.Contains(strings.ToLower(title), searchText):
+			results = append(results, SearchResult{url, title, FOUND_IN_TITLE})
+		case strings.Contains(strings.ToLower(we.GetText(pageid, false)), searchText):
+			results = append(results, SearchResult{url, title, FOUND_IN_TEXT})
+		}
+	}
+	return results
+}
+
+func (we *WikiEngine) ServePages(r *mux.Router, basecp BaseCP, menuEntries MenuEntries) {
 	wikiCP := basecp(we.state)
 	wikiCP.ContentTitle = "Wiki"
 	wikiCP.ExtraCSSurls = append(wikiCP.ExtraCSSurls, "/css/wiki.css")
@@ -56,19 +174,19 @@ func (we *WikiEngine) ServePages(basecp BaseCP, menuEntries MenuEntries) {
 	tvgf := DynamicMenuFactoryGenerator(menuEntries)
 	tvg := tvgf(we.state)
 
-	web.Get("/wiki", we.GenerateWikiRedirect())                                         // Redirect to /wiki/main
-	web.Get("/wikiedit/(.*)", wikiCP.WrapWebHandle(we.GenerateWikiEditForm(), tvg))     // Form for editing wiki pages
-	web.Get("/wikisource/(.*)", wikiCP.WrapWebHandle(we.GenerateWikiViewSource(), tvg)) // Page for viewing the source
-	web.Get("/wikidelete/(.*)", wikiCP.WrapWebHandle(we.GenerateWikiDeleteForm(), tvg)) // Form for deleting wiki pages
-	web.Get("/wiki/(.*)", wikiCP.WrapWebHandle(we.GenerateShowWiki(), tvg))             // Displaying wiki pages
-	web.Get("/wikipages", wikiCP.WrapSimpleContextHandle(we.GenerateListPages(), tvg))  // Listing wiki pages
-	web.Post("/wiki", we.GenerateCreateOrUpdateWiki())                                  // Create or update pages
-	web.Post("/wikideletenow", we.GenerateDeleteWikiNow())                              // Delete pages (admin only)
-	web.Get("/css/wiki.css", we.GenerateCSS(wikiCP.ColorScheme))                        // CSS that is specific for wiki pages
+	r.Handle("/wiki", we.GenerateWikiRedirect()).Methods("GET")                                                                 // Redirect to /wiki/main
+	r.HandleFunc("/wikiedit/{pageid:.*}", wikiCP.WrapSimpleContextHandle(r, we.GenerateWikiEditForm(), tvg)).Methods("GET")     // Form for editing wiki pages
+	r.HandleFunc("/wikisource/{pageid:.*}", wikiCP.WrapSimpleContextHandle(r, we.GenerateWikiViewSource(), tvg)).Methods("GET") // Page for viewing the source
+	r.HandleFunc("/wikidelete/{pageid:.*}", wikiCP.WrapSimpleContextHandle(r, we.GenerateWikiDeleteForm(), tvg)).Methods("GET") // Form for deleting wiki pages
+	r.HandleFunc("/wiki/{pageid:.*}", wikiCP.WrapSimpleContextHandle(r, we.GenerateShowWiki(), tvg)).Methods("GET")             // Displaying wiki pages
+	r.HandleFunc("/wikipages", wikiCP.WrapSimpleContextHandle(r, we.GenerateListPages(), tvg)).Methods("GET")                   // Listing wiki pages
+	r.Handle("/wiki", we.GenerateCreateOrUpdateWiki()).Methods("POST")                                                          // Create or update pages
+	r.Handle("/wikideletenow", we.GenerateDeleteWikiNow()).Methods("POST")                                                      // Delete pages (admin only)
+	r.Handle("/css/wiki.css", we.GenerateCSS(wikiCP.ColorScheme)).Methods("GET")                                                // CSS that is specific for wiki pages
 }
 
 func (we *WikiEngine) ListPages() string {
-	pageids, err := we.wikiState.pages.GetAll()
+	pageids, err := we.wikiState.pages.All()
 	if err != nil {
 		return ""
 	}
@@ -127,7 +245,7 @@ func (we *WikiEngine) GetText(pageid string, formatted bool) string {
 		text = re.ReplaceAllString(text, "<a href='/wiki/$1'>$1</a>")
 
 		// Markdown
-		text = string(blackfriday.MarkdownCommon([]byte(text)))
+		text = string(blackfriday.Run([]byte(text)))
 	}
 	return text
 }
@@ -149,15 +267,12 @@ func (we *WikiEngine) HasPage(pageid string) bool {
 	return has
 }
 
-func (we *WikiEngine) GenerateListPages() SimpleContextHandle {
-	return func(ctx *web.Context) string {
-		username := we.state.Username(ctx.Request)
+func (we *WikiEngine) GenerateListPages() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		username := LoggedInUsername(we.state, req)
 		if username == "" {
 			return "No user logged in"
 		}
-		if !we.state.IsLoggedIn(username) {
-			return "Not logged in"
-		}
 		retval := ""
 		retval += "<h2>All wiki pages</h2>"
 		retval += we.ListPages()
@@ -167,41 +282,52 @@ func (we *WikiEngine) GenerateListPages() SimpleContextHandle {
 	}
 }
 
-func (we *WikiEngine) GenerateCreateOrUpdateWiki() SimpleContextHandle {
-	return func(ctx *web.Context) string {
-		username := we.state.Username(ctx.Request)
+func (we *WikiEngine) GenerateCreateOrUpdateWiki() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		username := LoggedInUsername(we.state, req)
 		if username == "" {
 			return "No user logged in"
 		}
-		if !we.state.IsLoggedIn(username) {
-			return "Not logged in"
+		if ban := we.bans.Banned(ClientIP(req)); ban != nil {
+			return ban.Message()
+		}
+		pageid := CleanUserInput(req.FormValue("id"))
+		title := CleanUserInput(req.FormValue("title"))
+		text := CleanUserInput(req.FormValue("text"))
+
+		if we.moderation != nil && we.moderation.Holds("wiki", username) {
+			data, err := json.Marshal(wikiEdit{pageid, title, text})
+			if err != nil {
+				return "/wiki/" + pageid
+			}
+			summary := "Edit of <a href=\"/wiki/" + pageid + "\">" + pageid + "</a>: <b>" + title + "</b><br />" + text
+			id, err := we.moderation.Hold("wiki", username, summary, string(data))
+			if err != nil {
+				return "/wiki/" + pageid
+			}
+			return "/moderation/item/" + id
 		}
-		pageid := CleanUserInput(ctx.Params["id"])
-		title := CleanUserInput(ctx.Params["title"])
-		text := CleanUserInput(ctx.Params["text"])
 
 		if !we.HasPage(pageid) {
 			we.CreatePage(pageid)
 		}
 		we.ChangePage(pageid, title, text)
+		we.recordEdit(username, wikiEdit{pageid, title, text})
 
 		return "/wiki/" + pageid
 	}
 }
 
-func (we *WikiEngine) GenerateDeleteWikiNow() SimpleContextHandle {
-	return func(ctx *web.Context) string {
-		username := we.state.Username(ctx.Request)
+func (we *WikiEngine) GenerateDeleteWikiNow() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		username := LoggedInUsername(we.state, req)
 		if username == "" {
 			return "No user logged in"
 		}
-		if !we.state.IsLoggedIn(username) {
-			return "Not logged in"
-		}
 		if !we.state.IsAdmin(username) {
 			return "Not admin"
 		}
-		pageid := CleanUserInput(ctx.Params["id"])
+		pageid := CleanUserInput(req.FormValue("id"))
 
 		if pageid == "" {
 			return "Could not delete empty pageid"
@@ -217,15 +343,13 @@ func (we *WikiEngine) GenerateDeleteWikiNow() SimpleContextHandle {
 	}
 }
 
-func (we *WikiEngine) GenerateWikiEditForm() WebHandle {
-	return func(ctx *web.Context, pageid string) string {
-		username := we.state.Username(ctx.Request)
+func (we *WikiEngine) GenerateWikiEditForm() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		pageid := mux.Vars(req)["pageid"]
+		username := LoggedInUsername(we.state, req)
 		if username == "" {
 			return "No user logged in"
 		}
-		if !we.state.IsLoggedIn(username) {
-			return "Not logged in"
-		}
 
 		pageid = CleanUserInput(pageid)
 		title := we.GetTitle(pageid)
@@ -245,15 +369,13 @@ func (we *WikiEngine) GenerateWikiEditForm() WebHandle {
 	}
 }
 
-func (we *WikiEngine) GenerateWikiViewSource() WebHandle {
-	return func(ctx *web.Context, pageid string) string {
-		username := we.state.Username(ctx.Request)
+func (we *WikiEngine) GenerateWikiViewSource() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		pageid := mux.Vars(req)["pageid"]
+		username := LoggedInUsername(we.state, req)
 		if username == "" {
 			return "No user logged in"
 		}
-		if !we.state.IsLoggedIn(username) {
-			return "Not logged in"
-		}
 
 		pageid = CleanUserInput(pageid)
 		title := we.GetTitle(pageid)
@@ -269,15 +391,13 @@ func (we *WikiEngine) GenerateWikiViewSource() WebHandle {
 	}
 }
 
-func (we *WikiEngine) GenerateWikiDeleteForm() WebHandle {
-	return func(ctx *web.Context, pageid string) string {
-		username := we.state.Username(ctx.Request)
+func (we *WikiEngine) GenerateWikiDeleteForm() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		pageid := mux.Vars(req)["pageid"]
+		username := LoggedInUsername(we.state, req)
 		if username == "" {
 			return "No user logged in"
 		}
-		if !we.state.IsLoggedIn(username) {
-			return "Not logged in"
-		}
 		if !we.state.IsAdmin(username) {
 			return "Must be admin"
 		}
@@ -294,8 +414,9 @@ func (we *WikiEngine) GenerateWikiDeleteForm() WebHandle {
 	}
 }
 
-func (we *WikiEngine) GenerateShowWiki() WebHandle {
-	return func(ctx *web.Context, pageid string) string {
+func (we *WikiEngine) GenerateShowWiki() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		pageid := mux.Vars(req)["pageid"]
 		retval := ""
 		// Always show the wiki page
 		// TODO: Add a feature for marking wiki pages as unofficial and/or locked?
@@ -306,8 +427,8 @@ func (we *WikiEngine) GenerateShowWiki() WebHandle {
 			retval += "<h1>No such page: " + pageid + "</h1>"
 		}
 		// Display edit or create buttons if the user is logged in
-		username := we.state.Username(ctx.Request)
-		if (username != "") && we.state.IsLoggedIn(username) {
+		username := LoggedInUsername(we.state, req)
+		if username != "" {
 			if we.HasPage(pageid) {
 				// Page actions for regular users for pages that exists and are not the main page
 				if pageid != "main" {
@@ -336,16 +457,16 @@ func (we *WikiEngine) GenerateShowWiki() WebHandle {
 	}
 }
 
-func (we *WikiEngine) GenerateWikiRedirect() SimpleContextHandle {
-	return func(ctx *web.Context) string {
-		ctx.SetHeader("Refresh", "0; url=/wiki/main", true)
+func (we *WikiEngine) GenerateWikiRedirect() StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		w.Header().Set("Refresh", "0; url=/wiki/main")
 		return ""
 	}
 }
 
-func (we *WikiEngine) GenerateCSS(cs *ColorScheme) SimpleContextHandle {
-	return func(ctx *web.Context) string {
-		ctx.ContentType("css")
+func (we *WikiEngine) GenerateCSS(cs *ColorScheme) StringHandle {
+	return func(w http.ResponseWriter, req *http.Request) string {
+		w.Header().Add("Content-Type", "text/css")
 		return `
 .yes {
 	background-color: #90ff90;